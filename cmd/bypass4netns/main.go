@@ -5,12 +5,15 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strconv"
+	"runtime"
 	"strings"
 
+	"github.com/gorilla/mux"
+	handlerapi "github.com/rootless-containers/bypass4netns/pkg/api/handler"
 	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns"
 	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/nsagent"
 	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/tracer"
@@ -25,6 +28,9 @@ import (
 var (
 	socketFile           string
 	comSocketFile        string
+	apiSocketFile        string
+	handoverSocketFile   string
+	takeoverSocketFile   string
 	pidFile              string
 	logFilePath          string
 	multinodeEtcdAddress string
@@ -43,6 +49,9 @@ func main() {
 
 	flag.StringVar(&socketFile, "socket", filepath.Join(xdgRuntimeDir, oci.SocketName), "Socket file")
 	flag.StringVar(&comSocketFile, "com-socket", filepath.Join(xdgRuntimeDir, "bypass4netnsd-com.sock"), "Socket file for communication with bypass4netns")
+	flag.StringVar(&apiSocketFile, "api-socket", "", "Socket file to serve the API listing the handled containers (disabled if empty)")
+	flag.StringVar(&handoverSocketFile, "handover-socket", "", "Socket file to hand over the handled containers to a new bypass4netns started with --takeover (disabled if empty)")
+	flag.StringVar(&takeoverSocketFile, "takeover", "", "Take over the handled containers from the bypass4netns serving --handover-socket on the socket file")
 	flag.StringVar(&pidFile, "pid-file", "", "Pid file")
 	flag.StringVar(&logFilePath, "log-file", "", "Output logs to file")
 	flag.StringVar(&multinodeEtcdAddress, "multinode-etcd-address", "", "Etcd address for multinode communication")
@@ -51,7 +60,8 @@ func main() {
 	flag.IntVar(&readyFd, "ready-fd", -1, "File descriptor to notify when ready")
 	flag.IntVar(&exitFd, "exit-fd", -1, "File descriptor for terminating bypass4netns")
 	ignoredSubnets := flag.StringSlice("ignore", []string{"127.0.0.0/8"}, "Subnets to ignore in bypass4netns. Can be also set to \"auto\".")
-	fowardPorts := flag.StringArrayP("publish", "p", []string{}, "Publish a container's port(s) to the host")
+	fowardPorts := flag.StringArrayP("publish", "p", []string{}, "Publish a container's port(s) to the host. Format: [parentIP:]hostPort:childPort")
+	bindAddressPolicy := flag.String("bind-address-policy", string(bypass4netns.BindAddressPolicyWildcard), "Policy to translate bind addresses (\"wildcard\": bind container interface addresses to the wildcard or the parent IP, \"strict\": bypass only binds to the wildcard address)")
 	debug := flag.Bool("debug", false, "Enable debug mode")
 	version := flag.Bool("version", false, "Show version")
 	help := flag.Bool("help", false, "Show help")
@@ -62,6 +72,10 @@ func main() {
 	tracerEnable := flag.Bool("tracer", false, "Enable connection tracer")
 	multinodeEnable := flag.Bool("multinode", false, "Enable multinode communication")
 	ignoreBind := flag.Bool("ignore-bind", false, "Disable bypassing bind")
+	ioUringPolicy := flag.String("io-uring", string(bypass4netns.IOUringPolicyWarn), "Policy for io_uring which is not handled by bypass4netns (\"warn\", \"deny\" or \"allow\")")
+	connectFallback := flag.Bool("connect-fallback", false, "Connect on the host before bypassing and use the container's network when it fails (implies --connect-in-supervisor for TCP)")
+	notifWorkers := flag.Int("notif-workers", runtime.NumCPU(), "Number of workers handling seccomp notifications concurrently")
+	connectInSupervisor := flag.Bool("connect-in-supervisor", false, "Perform connect(2) of bypassed sockets in bypass4netns instead of rewriting the destination in the container's memory")
 
 	// Parse arguments
 	flag.Parse()
@@ -143,8 +157,11 @@ func main() {
 		logrus.WithFields(logrus.Fields{"etcdAddress": multinodeEtcdAddress, "hostAddress": multinodeHostAddress}).Infof("Multinode communication is enabled.")
 	}
 
-	if err := os.Remove(socketFile); err != nil && !errors.Is(err, os.ErrNotExist) {
-		logrus.Fatalf("Cannot cleanup socket file: %v", err)
+	// the socket file is still used by the listener taken over
+	if takeoverSocketFile == "" {
+		if err := os.Remove(socketFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.Fatalf("Cannot cleanup socket file: %v", err)
+		}
 	}
 
 	if pidFile != "" {
@@ -160,49 +177,40 @@ func main() {
 	handler := bypass4netns.NewHandler(socketFile, comSocketFile, strings.Replace(logFilePath, ".log", "-tracer.log", -1), *ignoreBind, handlerIP)
 
 	logrus.Infof("%s is added to handle", handlerIP)
-	subnets := []net.IPNet{}
-	var subnetsAuto bool
-	for _, subnetStr := range *ignoredSubnets {
-		switch subnetStr {
-		case "auto":
-			if subnetsAuto {
-				logrus.Warn("--ignore=\"auto\" appeared multiple times")
-			}
-			subnetsAuto = true
-			logrus.Info("Enabling auto-update for --ignore")
-		default:
-			_, subnet, err := net.ParseCIDR(subnetStr)
-			if err != nil {
-				logrus.Fatalf("%s is not CIDR format", subnetStr)
-			}
-			subnets = append(subnets, *subnet)
-			logrus.Infof("%s is added to ignore", subnet)
-		}
+	subnets, subnetsAuto, err := bypass4netns.ParseIgnoredSubnets(*ignoredSubnets)
+	if err != nil {
+		logrus.Fatalf("invalid --ignore: %s", err)
+	}
+	for _, subnet := range subnets {
+		logrus.Infof("%s is added to ignore", &subnet)
+	}
+	if subnetsAuto {
+		logrus.Info("Enabling auto-update for --ignore")
 	}
 	handler.SetIgnoredSubnets(subnets, subnetsAuto)
 
+	handler.SetConnectInSupervisor(*connectInSupervisor)
+	if err := handler.SetIOUringPolicy(bypass4netns.IOUringPolicy(*ioUringPolicy)); err != nil {
+		logrus.Fatalf("failed to set io_uring policy: %s", err)
+	}
+	handler.SetConnectFallback(*connectFallback)
+	if err := handler.SetNotifWorkers(*notifWorkers); err != nil {
+		logrus.Fatalf("failed to set notification workers: %s", err)
+	}
+	if err := handler.SetBindAddressPolicy(bypass4netns.BindAddressPolicy(*bindAddressPolicy)); err != nil {
+		logrus.Fatalf("failed to set bind address policy: %s", err)
+	}
+
 	for _, forwardPortStr := range *fowardPorts {
-		ports := strings.Split(forwardPortStr, ":")
-		if len(ports) != 2 {
-			logrus.Fatalf("invalid publish port format: '%s'", forwardPortStr)
-		}
-		hostPort, err := strconv.Atoi(ports[0])
-		if err != nil {
-			logrus.Fatalf("not interger %s in '%s'", ports[0], forwardPortStr)
-		}
-		childPort, err := strconv.Atoi(ports[1])
+		portMap, err := bypass4netns.ParseForwardPortMapping(forwardPortStr)
 		if err != nil {
-			logrus.Fatalf("not interger %s in '%s'", ports[1], forwardPortStr)
-		}
-		portMap := bypass4netns.ForwardPortMapping{
-			HostPort:  hostPort,
-			ChildPort: childPort,
+			logrus.Fatal(err)
 		}
 		err = handler.SetForwardingPort(portMap)
 		if err != nil {
 			logrus.Fatalf("failed to set fowardind port '%s' : %s", forwardPortStr, err)
 		}
-		logrus.Infof("fowarding port %s (host=%d container=%d) is added", forwardPortStr, hostPort, childPort)
+		logrus.Infof("fowarding port %s (parent=%s host=%d container=%d) is added", forwardPortStr, portMap.ParentIP, portMap.HostPort, portMap.ChildPort)
 	}
 
 	if readyFd >= 0 {
@@ -239,6 +247,12 @@ func main() {
 		if err := os.RemoveAll(socketFile); err != nil {
 			logrus.Warnf("Failed to remove socket %q", socketFile)
 		}
+		if apiSocketFile != "" {
+			logrus.Infof("Removing API socket %q", apiSocketFile)
+			if err := os.RemoveAll(apiSocketFile); err != nil {
+				logrus.Warnf("Failed to remove API socket %q", apiSocketFile)
+			}
+		}
 		if pidFile != "" {
 			logrus.Infof("Removing pid file %q", pidFile)
 			if err := os.RemoveAll(pidFile); err != nil {
@@ -258,5 +272,54 @@ func main() {
 		EtcdAddress: multinodeEtcdAddress,
 		HostAddress: multinodeHostAddress,
 	}
+	if apiSocketFile != "" {
+		// the API is listened before the ready fd is notified
+		l, err := listenAPI(apiSocketFile)
+		if err != nil {
+			logrus.Fatalf("failed to listen API: %q", err)
+		}
+		go func() {
+			if err := serveAPI(l, handler); err != nil {
+				logrus.Fatalf("failed to serve API: %q", err)
+			}
+		}()
+	}
+
+	if takeoverSocketFile != "" {
+		if err := handler.TakeOver(takeoverSocketFile); err != nil {
+			logrus.Fatalf("failed to take over containers: %s", err)
+		}
+	}
+	if handoverSocketFile != "" {
+		go func() {
+			if err := handler.ServeHandover(handoverSocketFile); err != nil {
+				logrus.WithError(err).Error("failed to hand over containers")
+			}
+		}()
+	}
+
 	handler.StartHandle(c2cConfig, multinode)
+	logrus.Info("containers are handed over, exiting...")
+}
+
+func listenAPI(socketPath string) (net.Listener, error) {
+	err := os.RemoveAll(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Starting API to serve on %s", socketPath)
+	return l, nil
+}
+
+func serveAPI(l net.Listener, h *bypass4netns.Handler) error {
+	r := mux.NewRouter()
+	handlerapi.AddRoutes(r, &handlerapi.Backend{
+		Handler: h,
+	})
+	srv := &http.Server{Handler: r}
+	return srv.Serve(l)
 }
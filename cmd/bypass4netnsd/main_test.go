@@ -130,4 +130,39 @@ func TestBypass4netnsAPI(t *testing.T) {
 
 	_, err = client.GetInterface(context.TODO(), containerIf.ContainerID)
 	assert.NotEqual(t, nil, err)
+
+	// Registering connection
+	conn := com.ContainerConnection{
+		HostAddress:      "127.0.0.1:54321",
+		ContainerID:      cid,
+		ContainerAddress: "10.4.0.53:54321",
+		DestinationPort:  8080,
+	}
+	_, err = client.GetConnection(context.TODO(), conn.HostAddress)
+	assert.NotEqual(t, nil, err)
+
+	postedConn, err := client.PostConnection(context.TODO(), &conn)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, conn.ContainerAddress, postedConn.ContainerAddress)
+
+	conn2, err := client.GetConnection(context.TODO(), conn.HostAddress)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, conn.ContainerID, conn2.ContainerID)
+	assert.Equal(t, conn.ContainerAddress, conn2.ContainerAddress)
+
+	conns, err := client.ListConnections(context.TODO(), conn.DestinationPort)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(conns))
+	assert.Equal(t, conn.HostAddress, conns[0].HostAddress)
+
+	conns, err = client.ListConnections(context.TODO(), 8081)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(conns))
+
+	// Removing connection
+	err = client.DeleteConnection(context.TODO(), conn.HostAddress)
+	assert.Equal(t, nil, err)
+
+	_, err = client.GetConnection(context.TODO(), conn.HostAddress)
+	assert.NotEqual(t, nil, err)
 }
@@ -27,3 +27,24 @@ type PortSpec struct {
 type ErrorJSON struct {
 	Message string `json:"message"`
 }
+
+// ContainerStatus is the status of a container handled by a bypass4netns process.
+type ContainerStatus struct {
+	ID                   string     `json:"id"`
+	Pid                  int        `json:"pid"`
+	PortMapping          []PortSpec `json:"portMapping"`
+	IgnoreSubnets        []string   `json:"ignoreSubnets"` // CIDR or "auto"
+	HandleC2CConnections bool       `json:"handleC2CConnections"`
+	Multinode            bool       `json:"multinode"`
+	// ConnectFallbacks is the number of connections fallen back to the container's network
+	ConnectFallbacks uint64           `json:"connectFallbacks"`
+	ReuseportGroups  []ReuseportGroup `json:"reuseportGroups"`
+}
+
+// ReuseportGroup is the set of the sockets bound to the same published port with SO_REUSEPORT.
+type ReuseportGroup struct {
+	Proto       string `json:"proto"` // "tcp" or "udp"
+	ChildPort   int    `json:"childPort"`
+	HostAddress string `json:"hostAddress"`
+	Members     int    `json:"members"`
+}
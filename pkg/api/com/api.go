@@ -16,3 +16,15 @@ type Interface struct {
 	Addresses  []net.IPNet      `json:"addresses"`
 	IsLoopback bool             `json:"isLoopback"`
 }
+
+// ContainerConnection associates the host-side address of a bypassed connection between containers
+// with the container which initiated it.
+type ContainerConnection struct {
+	// HostAddress is the client's host-side address e.g. "127.0.0.1:54321"
+	HostAddress string `json:"hostAddress"`
+	ContainerID string `json:"containerID"`
+	// ContainerAddress is the address seen by the peer container e.g. "10.4.0.5:54321"
+	ContainerAddress string `json:"containerAddress"`
+	// DestinationPort is the host-side port of the destination listener e.g. 8080
+	DestinationPort int `json:"destinationPort"`
+}
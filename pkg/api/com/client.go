@@ -12,6 +12,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 
 	"github.com/rootless-containers/bypass4netns/pkg/api"
@@ -225,3 +226,105 @@ func (c *ComClient) DeleteInterface(ctx context.Context, id string) error {
 	}
 	return nil
 }
+
+// ListConnections lists the connections to destPort. All the connections are listed when destPort is 0.
+func (c *ComClient) ListConnections(ctx context.Context, destPort int) ([]ContainerConnection, error) {
+	u := fmt.Sprintf("http://%s/%s/connections", c.dummyHost, c.version)
+	if destPort != 0 {
+		u += fmt.Sprintf("?destinationPort=%d", destPort)
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ctx)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := successful(resp); err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(resp.Body)
+	var conns []ContainerConnection
+	if err := dec.Decode(&conns); err != nil {
+		return nil, err
+	}
+
+	return conns, nil
+}
+
+func (c *ComClient) GetConnection(ctx context.Context, hostAddr string) (*ContainerConnection, error) {
+	u := fmt.Sprintf("http://%s/%s/connection/%s", c.dummyHost, c.version, url.PathEscape(hostAddr))
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ctx)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := successful(resp); err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(resp.Body)
+	var conn ContainerConnection
+	if err := dec.Decode(&conn); err != nil {
+		return nil, err
+	}
+
+	return &conn, nil
+}
+
+func (c *ComClient) PostConnection(ctx context.Context, conn *ContainerConnection) (*ContainerConnection, error) {
+	m, err := json.Marshal(conn)
+	if err != nil {
+		return nil, err
+	}
+	u := fmt.Sprintf("http://%s/%s/connection/%s", c.dummyHost, c.version, url.PathEscape(conn.HostAddress))
+	req, err := http.NewRequest("POST", u, bytes.NewReader(m))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ctx)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := successful(resp); err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(resp.Body)
+	var posted ContainerConnection
+	if err := dec.Decode(&posted); err != nil {
+		return nil, err
+	}
+
+	return &posted, nil
+}
+
+func (c *ComClient) DeleteConnection(ctx context.Context, hostAddr string) error {
+	u := fmt.Sprintf("http://%s/%s/connection/%s", c.dummyHost, c.version, url.PathEscape(hostAddr))
+	req, err := http.NewRequest("DELETE", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ctx)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := successful(resp); err != nil {
+		return err
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/rootless-containers/bypass4netns/pkg/api"
@@ -18,6 +19,10 @@ type BypassDriver interface {
 	GetInterface(id string) *ContainerInterfaces
 	PostInterface(id string, containerIfs *ContainerInterfaces)
 	DeleteInterface(id string)
+	ListConnections(destPort int) []ContainerConnection
+	GetConnection(hostAddr string) *ContainerConnection
+	PostConnection(conn *ContainerConnection)
+	DeleteConnection(hostAddr string)
 }
 
 func AddRoutes(r *mux.Router, b *Backend) {
@@ -28,6 +33,10 @@ func AddRoutes(r *mux.Router, b *Backend) {
 	v1.Path("/interface/{id}").Methods("GET").HandlerFunc(b.getInterface)
 	v1.Path("/interface/{id}").Methods("POST").HandlerFunc(b.postInterface)
 	v1.Path("/interface/{id}").Methods("DELETE").HandlerFunc(b.deleteInterface)
+	v1.Path("/connections").Methods("GET").HandlerFunc(b.listConnections)
+	v1.Path("/connection/{hostAddr}").Methods("GET").HandlerFunc(b.getConnection)
+	v1.Path("/connection/{hostAddr}").Methods("POST").HandlerFunc(b.postConnection)
+	v1.Path("/connection/{hostAddr}").Methods("DELETE").HandlerFunc(b.deleteConnection)
 }
 
 func (b *Backend) onError(w http.ResponseWriter, r *http.Request, err error, ec int) {
@@ -121,3 +130,89 @@ func (b *Backend) deleteInterface(w http.ResponseWriter, r *http.Request) {
 
 	b.BypassDriver.DeleteInterface(id)
 }
+
+// listConnections lists the connections to the destination port specified by the "destinationPort" query.
+// All the connections are listed without the query.
+func (b *Backend) listConnections(w http.ResponseWriter, r *http.Request) {
+	destPort := 0
+	if q := r.URL.Query().Get("destinationPort"); q != "" {
+		var err error
+		destPort, err = strconv.Atoi(q)
+		if err != nil {
+			b.onError(w, r, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	conns := b.BypassDriver.ListConnections(destPort)
+	m, err := json.Marshal(conns)
+	if err != nil {
+		b.onError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(m)
+}
+
+func (b *Backend) getConnection(w http.ResponseWriter, r *http.Request) {
+	hostAddr, ok := mux.Vars(r)["hostAddr"]
+	if !ok {
+		b.onError(w, r, errors.New("hostAddr not specified"), http.StatusBadRequest)
+		return
+	}
+
+	conn := b.BypassDriver.GetConnection(hostAddr)
+	if conn == nil {
+		b.onError(w, r, errors.New("not found"), http.StatusNotFound)
+		return
+	}
+
+	m, err := json.Marshal(conn)
+	if err != nil {
+		b.onError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(m)
+}
+
+func (b *Backend) postConnection(w http.ResponseWriter, r *http.Request) {
+	hostAddr, ok := mux.Vars(r)["hostAddr"]
+	if !ok {
+		b.onError(w, r, errors.New("hostAddr not specified"), http.StatusBadRequest)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var conn ContainerConnection
+	if err := decoder.Decode(&conn); err != nil {
+		b.onError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if conn.HostAddress != hostAddr {
+		b.onError(w, r, errors.New("hostAddr mismatch"), http.StatusBadRequest)
+		return
+	}
+	b.BypassDriver.PostConnection(&conn)
+
+	m, err := json.Marshal(conn)
+	if err != nil {
+		b.onError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(m)
+}
+
+func (b *Backend) deleteConnection(w http.ResponseWriter, r *http.Request) {
+	hostAddr, ok := mux.Vars(r)["hostAddr"]
+	if !ok {
+		b.onError(w, r, errors.New("hostAddr not specified"), http.StatusBadRequest)
+		return
+	}
+
+	b.BypassDriver.DeleteConnection(hostAddr)
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+)
+
+type Backend struct {
+	Handler Handler
+}
+
+// Handler is the seccomp notification handler of a bypass4netns process.
+type Handler interface {
+	ListContainers() []api.ContainerStatus
+	// AddContainer adds the container. Its seccomp fds are received on spec.SocketPath.
+	AddContainer(spec *api.BypassSpec) error
+	// RemoveContainer removes the container added with AddContainer.
+	RemoveContainer(id string) error
+}
+
+func AddRoutes(r *mux.Router, b *Backend) {
+	v1 := r.PathPrefix("/v1").Subrouter()
+	v1.Path("/containers").Methods("GET").HandlerFunc(b.listContainers)
+	v1.Path("/containers").Methods("POST").HandlerFunc(b.addContainer)
+	v1.Path("/containers/{id}").Methods("DELETE").HandlerFunc(b.removeContainer)
+}
+
+func (b *Backend) onError(w http.ResponseWriter, r *http.Request, err error, ec int) {
+	w.WriteHeader(ec)
+	w.Header().Set("Content-Type", "application/json")
+	// it is safe to return the err to the client, because the client is reliable
+	e := api.ErrorJSON{
+		Message: err.Error(),
+	}
+	_ = json.NewEncoder(w).Encode(e)
+}
+
+func (b *Backend) listContainers(w http.ResponseWriter, r *http.Request) {
+	containers := b.Handler.ListContainers()
+	m, err := json.Marshal(containers)
+	if err != nil {
+		b.onError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(m)
+}
+
+func (b *Backend) addContainer(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var spec api.BypassSpec
+	if err := decoder.Decode(&spec); err != nil {
+		b.onError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if err := b.Handler.AddContainer(&spec); err != nil {
+		b.onError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (b *Backend) removeContainer(w http.ResponseWriter, r *http.Request) {
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		b.onError(w, r, errors.New("id not specified"), http.StatusBadRequest)
+		return
+	}
+	if err := b.Handler.RemoveContainer(id); err != nil {
+		b.onError(w, r, err, http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -6,18 +6,22 @@ package bypass4netns
 import (
 	"bytes"
 	gocontext "context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
+	"runtime"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rootless-containers/bypass4netns/pkg/api"
 	"github.com/rootless-containers/bypass4netns/pkg/api/com"
 	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/iproute2"
 	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/nonbypassable"
@@ -31,9 +35,10 @@ import (
 
 const ETCD_MULTINODE_PREFIX = "bypass4netns/multinode/"
 
+// closeStateFds closes the received fds.
 func closeStateFds(recvFds []int) {
-	for i := range recvFds {
-		unix.Close(i)
+	for _, fd := range recvFds {
+		unix.Close(fd)
 	}
 }
 
@@ -115,7 +120,10 @@ func (h *notifHandler) writeProcMem(pid int, offset uint64, buf []byte) error {
 }
 
 func (h *notifHandler) openMem(pid int) (int, error) {
-	if memfd, ok := h.memfds[pid]; ok {
+	h.pidMu.Lock()
+	memfd, ok := h.memfds[pid]
+	h.pidMu.Unlock()
+	if ok {
 		return memfd, nil
 	}
 	memfd, err := unix.Open(fmt.Sprintf("/proc/%d/mem", pid), unix.O_RDWR, 0o777)
@@ -128,11 +136,35 @@ func (h *notifHandler) openMem(pid int) (int, error) {
 		logrus.WithField("pid", pid).Info("succeeded to open mem with agent. continue to process")
 		memfd = newMemfd
 	}
+
+	// opening mem with agent is slow. so the lock is not held while opening.
+	h.pidMu.Lock()
+	defer h.pidMu.Unlock()
+	if cached, ok := h.memfds[pid]; ok {
+		unix.Close(memfd)
+		return cached, nil
+	}
 	h.memfds[pid] = memfd
 
 	return memfd, nil
 }
 
+// closeMem closes the memfds of the process tgid and its threads.
+func (h *notifHandler) closeMem(tgid int) {
+	h.pidMu.Lock()
+	defer h.pidMu.Unlock()
+	if memfd, ok := h.memfds[tgid]; ok {
+		syscall.Close(memfd)
+		delete(h.memfds, tgid)
+	}
+	for pid, info := range h.pidInfos {
+		if memfd, ok := h.memfds[pid]; ok && info.tgid == tgid {
+			syscall.Close(memfd)
+			delete(h.memfds, pid)
+		}
+	}
+}
+
 func openMemWithNSEnter(pid int) (int, error) {
 	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
 	if err != nil {
@@ -276,66 +308,185 @@ type context struct {
 	notifFd libseccomp.ScmpFd
 	req     *libseccomp.ScmpNotifReq
 	resp    *libseccomp.ScmpNotifResp
+	// deferResponse is true when resp is sent asynchronously by the handler of the syscall.
+	deferResponse bool
 }
 
+// getPidFdInfo resolves the pid (thread id) to its thread group and returns pidfd of the thread group.
+// pidfd is shared by all the threads in the thread group.
+// The cached thread entries are dropped by dropExitedThread when their notifications become invalid.
 func (h *notifHandler) getPidFdInfo(pid int) (*pidInfo, error) {
+	h.pidMu.Lock()
+	defer h.pidMu.Unlock()
+
 	// retrieve pidfd from cache
-	if pidfd, ok := h.pidInfos[pid]; ok {
-		return &pidfd, nil
+	if info, ok := h.pidInfos[pid]; ok {
+		return &info, nil
+	}
+
+	info := pidInfo{
+		pidType: PROCESS,
+		tgid:    pid, // process's pid is equal to its tgid
+	}
+	if pidfd, ok := h.pidfds[pid]; ok {
+		info.pidfd = pidfd
+		h.pidInfos[pid] = info
+		return &info, nil
 	}
 
-	targetPidfd, err := unix.PidfdOpen(int(pid), 0)
+	// pidfd_open(2) fails with thread's pid.
+	targetPidfd, err := unix.PidfdOpen(pid, 0)
 	if err == nil {
-		info := pidInfo{
-			pidType: PROCESS,
-			pidfd:   targetPidfd,
-			tgid:    pid, // process's pid is equal to its tgid
-		}
+		info.pidfd = targetPidfd
+		h.pidfds[pid] = targetPidfd
+		h.watchExit(pid, targetPidfd)
 		h.pidInfos[pid] = info
 		return &info, nil
 	}
 
-	// pid can be thread and pidfd_open fails with thread's pid.
-	// retrieve process's pid (tgid) from /proc/<pid>/status and retry to get pidfd with the tgid.
-	logrus.Warnf("pidfd Open failed: pid=%d err=%q, this pid maybe thread and retrying with tgid", pid, err)
-	st, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	// retrieve process's pid (tgid) from /proc/<pid>/status and reuse pidfd of the tgid.
+	tgid, err := getTgid(pid)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read %d's status err=%q", pid, err)
+		return nil, fmt.Errorf("failed to get tgid of pid=%d: %w", pid, err)
+	}
+	info.pidType = THREAD
+	info.tgid = tgid
+	if pidfd, ok := h.pidfds[tgid]; ok {
+		info.pidfd = pidfd
+	} else {
+		info.pidfd, err = unix.PidfdOpen(tgid, 0)
+		if err != nil {
+			return nil, fmt.Errorf("pidfd Open failed with Tgid: pid=%d %w", tgid, err)
+		}
+		h.pidfds[tgid] = info.pidfd
+		h.watchExit(tgid, info.pidfd)
 	}
 
-	nextTgid := -1
-	for _, s := range strings.Split(string(st), "\n") {
-		if strings.Contains(s, "Tgid") {
-			tgids := strings.Split(s, "\t")
-			if len(tgids) < 2 {
-				return nil, fmt.Errorf("unexpected /proc/%d/status len=%q status=%q", pid, len(tgids), string(st))
-			}
-			tgid, err := strconv.Atoi(tgids[1])
-			if err != nil {
-				return nil, fmt.Errorf("unexpected /proc/%d/status err=%q status=%q", pid, err, string(st))
-			}
-			nextTgid = tgid
+	logrus.Debugf("pid=%d is a thread of tgid=%d", pid, tgid)
+	h.pidInfos[pid] = info
+	return &info, nil
+}
+
+// dropExitedThread removes the cached thread entry when the thread has exited.
+// Thread ids can be reused by other processes after the thread exits.
+func (h *notifHandler) dropExitedThread(pid int) {
+	h.pidMu.Lock()
+	defer h.pidMu.Unlock()
+
+	info, ok := h.pidInfos[pid]
+	if !ok || info.pidType != THREAD {
+		return
+	}
+	if !threadExists(info.tgid, pid) {
+		logrus.Debugf("thread pid=%d of tgid=%d exited", pid, info.tgid)
+		delete(h.pidInfos, pid)
+	}
+}
+
+// watchExit starts watching the exit of the process to release its resources.
+func (h *notifHandler) watchExit(tgid, pidfd int) {
+	if h.exitWatcher == nil {
+		return
+	}
+	if err := h.exitWatcher.watch(tgid, pidfd); err != nil {
+		logrus.WithError(err).Warn("failed to watch process exit")
+	}
+}
+
+// handleProcessExit removes the exited process.
+// It is queued after the requests of the main thread. The requests of the other threads are serialized with the lock of the process.
+func (h *notifHandler) handleProcessExit(tgid, pidfd int) {
+	h.pool.dispatch(tgid, func() {
+		h.pidMu.Lock()
+		current, ok := h.pidfds[tgid]
+		h.pidMu.Unlock()
+		// the process is already removed
+		if !ok || current != pidfd {
+			return
 		}
-		if nextTgid > 0 {
-			break
+		h.removeProcess(tgid)
+	})
+}
+
+// removeProcess releases all the resources related to the process.
+func (h *notifHandler) removeProcess(tgid int) {
+	h.processesMu.Lock()
+	proc, ok := h.processes[tgid]
+	delete(h.processes, tgid)
+	h.processesMu.Unlock()
+	if ok {
+		proc.mu.Lock()
+		for _, sock := range proc.sockets {
+			h.releaseSocket(sock)
 		}
+		proc.releaseForkSnapshot()
+		proc.mu.Unlock()
 	}
-	if nextTgid < 0 {
-		logrus.Errorf("cannot get Tgid from /proc/%d/status status=%q", pid, string(st))
+
+	h.pidMu.Lock()
+	defer h.pidMu.Unlock()
+	if memfd, ok := h.memfds[tgid]; ok {
+		syscall.Close(memfd)
+		delete(h.memfds, tgid)
 	}
-	targetPidfd, err = unix.PidfdOpen(nextTgid, 0)
-	if err != nil {
-		return nil, fmt.Errorf("pidfd Open failed with Tgid: pid=%d %s", nextTgid, err)
+	if pidfd, ok := h.pidfds[tgid]; ok {
+		syscall.Close(pidfd)
+		delete(h.pidfds, tgid)
+	}
+	for pid, info := range h.pidInfos {
+		if info.tgid == tgid {
+			delete(h.pidInfos, pid)
+		}
 	}
+	logrus.WithFields(logrus.Fields{"pid": tgid}).Infof("process is removed")
+}
 
-	logrus.Infof("successfully got pidfd for pid=%d tgid=%d", pid, nextTgid)
-	info := pidInfo{
-		pidType: THREAD,
-		pidfd:   targetPidfd,
-		tgid:    nextTgid,
+// handleSysSocket records the IP socket being created.
+// The fd is not allocated yet and the socket is registered when the fd is used first.
+func (h *notifHandler) handleSysSocket(pid int, proc *processStatus, ctx *context) {
+	// int socket(int domain, int type, int protocol)
+	args := socketArgs{
+		sockDomain: int(ctx.req.Data.Args[0]),
+		sockType:   int(ctx.req.Data.Args[1]),
+		sockProto:  int(ctx.req.Data.Args[2]),
 	}
-	h.pidInfos[pid] = info
-	return &info, nil
+	if args.sockDomain != syscall.AF_INET && args.sockDomain != syscall.AF_INET6 {
+		return
+	}
+	if t := args.sockType & sockTypeMask; t != syscall.SOCK_STREAM && t != syscall.SOCK_DGRAM {
+		return
+	}
+	h.socketNotified.Store(true)
+	proc.addPendingSocket(args)
+	logrus.WithFields(logrus.Fields{"pid": pid}).Debugf("socket domain=%d type=0x%x protocol=%d is being created", args.sockDomain, args.sockType, args.sockProto)
+}
+
+// registerPendingSocket registers the socket created with socket(2) without retrieving the fd.
+// The flags changed after socket(2) are read from fdinfo.
+func (h *notifHandler) registerPendingSocket(pid int, proc *processStatus, sockfd int, args socketArgs, ino uint64) *socketStatus {
+	logger := logrus.WithFields(logrus.Fields{"pid": pid, "sockfd": sockfd})
+	sockType := args.sockType &^ (syscall.SOCK_NONBLOCK | syscall.SOCK_CLOEXEC)
+	if flags, err := getFdFlags(pid, sockfd); err == nil {
+		if flags&unix.O_NONBLOCK != 0 {
+			sockType |= syscall.SOCK_NONBLOCK
+		}
+		if flags&unix.O_CLOEXEC != 0 {
+			sockType |= syscall.SOCK_CLOEXEC
+		}
+	} else {
+		logger.WithError(err).Warn("failed to get fd flags")
+		sockType = args.sockType
+	}
+	sock := newSocketStatus(pid, sockfd, args.sockDomain, sockType, args.sockProto, h.ignoreBind)
+	if sock.isDatagram() && !h.notifySendmsg {
+		// sendmsg(2) on the host socket would not be checked
+		sock.state = NotBypassable
+	}
+	sock.ino = ino
+	h.trackInode(sock)
+	proc.sockets[sockfd] = sock
+	logger.Infof("socket is registered (state=%s)", sock.state)
+	return sock
 }
 
 // getFdInProcess get the file descriptor in other process
@@ -399,13 +550,509 @@ func (h *notifHandler) readSockaddrFromProcess(pid int, offset uint64, addrlen u
 	return newSockaddr(buf)
 }
 
+// readMsghdrName reads msg_name and msg_namelen of struct msghdr from the process.
+// ptrSize is the size of pointers in the ABI of the process.
+func (h *notifHandler) readMsghdrName(pid int, offset uint64, ptrSize int) (uint64, uint64, error) {
+	buf, err := h.readProcMem(pid, offset, uint64(ptrSize+4))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed readProcMem pid %v offset 0x%x: %s", pid, offset, err)
+	}
+	return decodeMsghdrName(buf, ptrSize, binary.NativeEndian)
+}
+
+// decodeMsghdrName decodes msg_name and msg_namelen of struct msghdr.
+func decodeMsghdrName(buf []byte, ptrSize int, order binary.ByteOrder) (uint64, uint64, error) {
+	// struct msghdr {
+	//   void         *msg_name;
+	//   socklen_t     msg_namelen;
+	//   ...
+	// }
+	if len(buf) != ptrSize+4 {
+		return 0, 0, fmt.Errorf("unexpected msghdr length %d", len(buf))
+	}
+	namePtr := decodePointer(buf, ptrSize, order)
+	nameLen := order.Uint32(buf[ptrSize : ptrSize+4])
+	return namePtr, uint64(nameLen), nil
+}
+
+const (
+	// maxIovecs is UIO_MAXIOV, the limit of msg_iovlen.
+	maxIovecs = 1024
+	// maxControlLen limits msg_control read from the process. It exceeds the kernel's default net.core.optmem_max.
+	maxControlLen = 64 * 1024
+)
+
+// readMsghdrPayload reads the data referred by msg_iov and msg_control of struct msghdr.
+// The data is truncated to maxLen.
+func (h *notifHandler) readMsghdrPayload(pid int, offset uint64, ptrSize int, maxLen int) ([]byte, []byte, error) {
+	buf, err := h.readProcMem(pid, offset, uint64(ptrSize*6))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed readProcMem pid %v offset 0x%x: %s", pid, offset, err)
+	}
+	iovPtr, iovLen, controlPtr, controlLen, err := decodeMsghdrPayload(buf, ptrSize, binary.NativeEndian)
+	if err != nil {
+		return nil, nil, err
+	}
+	if iovLen > maxIovecs {
+		return nil, nil, fmt.Errorf("too many iovecs %d", iovLen)
+	}
+	if controlLen > maxControlLen {
+		return nil, nil, fmt.Errorf("too long msg_control %d", controlLen)
+	}
+
+	var data []byte
+	if iovLen > 0 {
+		buf, err = h.readProcMem(pid, iovPtr, iovLen*uint64(ptrSize*2))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read iovecs: %w", err)
+		}
+		iovs, err := decodeIovecs(buf, ptrSize, binary.NativeEndian)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, iov := range iovs {
+			remaining := uint64(maxLen - len(data))
+			if remaining == 0 {
+				break
+			}
+			b, err := h.readProcMem(pid, iov.base, min(iov.len, remaining))
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to read iovec data: %w", err)
+			}
+			data = append(data, b...)
+		}
+	}
+
+	var control []byte
+	if controlLen > 0 {
+		control, err = h.readProcMem(pid, controlPtr, controlLen)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read msg_control: %w", err)
+		}
+	}
+	return data, control, nil
+}
+
+// decodeMsghdrPayload decodes msg_iov, msg_iovlen, msg_control and msg_controllen of struct msghdr.
+func decodeMsghdrPayload(buf []byte, ptrSize int, order binary.ByteOrder) (uint64, uint64, uint64, uint64, error) {
+	// struct msghdr {
+	//   void         *msg_name;
+	//   socklen_t     msg_namelen; // padded to the pointer size
+	//   struct iovec *msg_iov;
+	//   size_t        msg_iovlen;
+	//   void         *msg_control;
+	//   size_t        msg_controllen;
+	//   ...
+	// }
+	if len(buf) != ptrSize*6 {
+		return 0, 0, 0, 0, fmt.Errorf("unexpected msghdr length %d", len(buf))
+	}
+	fields := make([]uint64, 4)
+	for i := range fields {
+		fields[i] = decodePointer(buf[ptrSize*(i+2):], ptrSize, order)
+	}
+	return fields[0], fields[1], fields[2], fields[3], nil
+}
+
+type iovec struct {
+	base uint64
+	len  uint64
+}
+
+// decodeIovecs decodes the array of struct iovec.
+func decodeIovecs(buf []byte, ptrSize int, order binary.ByteOrder) ([]iovec, error) {
+	if len(buf)%(ptrSize*2) != 0 {
+		return nil, fmt.Errorf("unexpected iovec length %d", len(buf))
+	}
+	iovs := make([]iovec, 0, len(buf)/(ptrSize*2))
+	for off := 0; off < len(buf); off += ptrSize * 2 {
+		iovs = append(iovs, iovec{
+			base: decodePointer(buf[off:], ptrSize, order),
+			len:  decodePointer(buf[off+ptrSize:], ptrSize, order),
+		})
+	}
+	return iovs, nil
+}
+
+// writeSockaddrToProcess writes the address to addrPtr and its length to addrlenPtr like getpeername(2).
+// The address is truncated when the buffer supplied by the process is too small.
+func (h *notifHandler) writeSockaddrToProcess(pid int, addrPtr uint64, addrlenPtr uint64, sa *sockaddr) error {
+	buf, err := sa.toBytes()
+	if err != nil {
+		return fmt.Errorf("failed to serialize address %s: %w", sa, err)
+	}
+
+	bufLen, err := h.readProcMem(pid, addrlenPtr, 4)
+	if err != nil {
+		return fmt.Errorf("failed to read address length: %w", err)
+	}
+	if len(bufLen) != 4 {
+		return fmt.Errorf("unexpected address length size %d", len(bufLen))
+	}
+	addrLen := binary.NativeEndian.Uint32(bufLen)
+
+	writeLen := len(buf)
+	if uint32(writeLen) > addrLen {
+		writeLen = int(addrLen)
+	}
+	if writeLen > 0 {
+		err = h.writeProcMem(pid, addrPtr, buf[:writeLen])
+		if err != nil {
+			return fmt.Errorf("failed to write address: %w", err)
+		}
+	}
+
+	binary.NativeEndian.PutUint32(bufLen, uint32(len(buf)))
+	err = h.writeProcMem(pid, addrlenPtr, bufLen)
+	if err != nil {
+		return fmt.Errorf("failed to write address length %d: %w", len(buf), err)
+	}
+
+	return nil
+}
+
+func (h *notifHandler) setContainerAddrs(ifs []com.Interface) {
+	containerAddrs := []net.IP{}
+	for _, intf := range ifs {
+		if intf.IsLoopback {
+			continue
+		}
+		for _, addr := range intf.Addresses {
+			containerAddrs = append(containerAddrs, addr.IP)
+		}
+	}
+	h.containerAddrsMu.Lock()
+	defer h.containerAddrsMu.Unlock()
+	h.containerAddrs = containerAddrs
+	h.containerAddrsLastUpdateUnix = time.Now().Unix()
+}
+
+// getContainerAddrs returns the addresses of the container's interfaces except loopback.
+func (h *notifHandler) getContainerAddrs() []net.IP {
+	h.updateContainerAddrs()
+	h.containerAddrsMu.RLock()
+	defer h.containerAddrsMu.RUnlock()
+	return h.containerAddrs
+}
+
+// getContainerInterface returns the container's interface for the destination address.
+func (h *notifHandler) getContainerInterface(destAddr string) (containerInterface, bool) {
+	h.containerAddrsMu.RLock()
+	defer h.containerAddrsMu.RUnlock()
+	contIf, ok := h.containerInterfaces[destAddr]
+	return contIf, ok
+}
+
+// updateContainerAddrs retrieves the container's addresses when they are not retrieved by the background task.
+func (h *notifHandler) updateContainerAddrs() {
+	h.containerAddrsMu.Lock()
+	if len(h.containerAddrs) > 0 || h.containerAddrsLastUpdateUnix+10 > time.Now().Unix() {
+		h.containerAddrsMu.Unlock()
+		return
+	}
+	// not to retry too frequently even if failed
+	h.containerAddrsLastUpdateUnix = time.Now().Unix()
+	h.containerAddrsMu.Unlock()
+	h.retrieveContainerAddrs()
+}
+
+// refreshContainerAddrs retrieves the container's addresses again when an address is not found in them.
+// They are not retrieved again within a second.
+func (h *notifHandler) refreshContainerAddrs() {
+	h.containerAddrsMu.Lock()
+	if h.containerAddrsLastUpdateUnix+1 > time.Now().Unix() {
+		h.containerAddrsMu.Unlock()
+		return
+	}
+	h.containerAddrsLastUpdateUnix = time.Now().Unix()
+	h.containerAddrsMu.Unlock()
+	h.retrieveContainerAddrs()
+}
+
+func (h *notifHandler) retrieveContainerAddrs() {
+	addrs, err := iproute2.GetAddressesInNetNS(gocontext.TODO(), h.state.Pid)
+	if err != nil {
+		logrus.WithError(err).Warn("failed to get addresses")
+		return
+	}
+	ifs, err := iproute2AddressesToComInterfaces(addrs)
+	if err != nil {
+		logrus.WithError(err).Warn("failed to convert addresses")
+		return
+	}
+	h.setContainerAddrs(ifs)
+}
+
+// containerAddress returns the container's address for the socket domain.
+func (h *notifHandler) containerAddress(sockDomain int) net.IP {
+	var v4 net.IP
+	for _, ip := range h.getContainerAddrs() {
+		if ip4 := ip.To4(); ip4 != nil {
+			if v4 == nil {
+				v4 = ip4
+			}
+			if sockDomain == syscall.AF_INET {
+				return ip4
+			}
+		} else if sockDomain == syscall.AF_INET6 {
+			return ip
+		}
+	}
+	if v4 != nil && sockDomain == syscall.AF_INET6 {
+		// IPv4-mapped IPv6 address
+		return v4.To16()
+	}
+	return v4
+}
+
+// lookupC2CPeer returns the address of the container which initiated the connection from peer.
+// nil is returned when the connection is not from other bypassed container.
+func (h *notifHandler) lookupC2CPeer(peer *sockaddr) *sockaddr {
+	if h.comClient == nil || !peer.IP.IsLoopback() {
+		return nil
+	}
+
+	hostAddr := net.JoinHostPort(peer.IP.String(), strconv.Itoa(peer.Port))
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := h.comClient.GetConnection(ctx, hostAddr)
+	if err != nil {
+		logrus.WithError(err).Debugf("connection %s is not registered", hostAddr)
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(conn.ContainerAddress)
+	if err != nil {
+		logrus.WithError(err).Warnf("invalid container address %q", conn.ContainerAddress)
+		return nil
+	}
+	virtPeer := &sockaddr{
+		IP: net.ParseIP(host),
+	}
+	virtPeer.Port, err = strconv.Atoi(port)
+	if err != nil || virtPeer.IP == nil {
+		logrus.Warnf("invalid container address %q", conn.ContainerAddress)
+		return nil
+	}
+	virtPeer.Family = peer.Family
+	switch peer.Family {
+	case syscall.AF_INET:
+		virtPeer.IP = virtPeer.IP.To4()
+		if virtPeer.IP == nil {
+			return nil
+		}
+	case syscall.AF_INET6:
+		virtPeer.IP = virtPeer.IP.To16()
+	}
+
+	return virtPeer
+}
+
+// hasC2CConnections returns true when connections from other bypassed containers to the listener are registered.
+func (h *notifHandler) hasC2CConnections(listenfd int) bool {
+	usa, err := unix.Getsockname(listenfd)
+	if err != nil {
+		return false
+	}
+	local, err := newSockaddrFromUnix(usa)
+	if err != nil {
+		return false
+	}
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 2*time.Second)
+	defer cancel()
+	conns, err := h.comClient.ListConnections(ctx, local.Port)
+	if err != nil {
+		logrus.WithError(err).Debugf("failed to list connections to port %d", local.Port)
+		return false
+	}
+	return len(conns) > 0
+}
+
+// isHostSocket returns true when the socket belongs to the network namespace of bypass4netns.
+func isHostSocket(sockfd int) bool {
+	nsfd, err := unix.IoctlRetInt(sockfd, unix.SIOCGSKNS)
+	if err != nil {
+		return false
+	}
+	defer unix.Close(nsfd)
+
+	var sockNS, selfNS unix.Stat_t
+	if err := unix.Fstat(nsfd, &sockNS); err != nil {
+		return false
+	}
+	if err := unix.Stat("/proc/self/ns/net", &selfNS); err != nil {
+		return false
+	}
+	return sockNS.Dev == selfNS.Dev && sockNS.Ino == selfNS.Ino
+}
+
+// getProcess returns the registered process.
+func (h *notifHandler) getProcess(pid int) (*processStatus, bool) {
+	h.processesMu.Lock()
+	defer h.processesMu.Unlock()
+	proc, ok := h.processes[pid]
+	return proc, ok
+}
+
+// maxInheritDepth limits the number of ancestors searched for the sockets inherited with fork(2).
+const maxInheritDepth = 8
+
+// registerProcess registers the process.
+// The process forked from a registered process inherits the status of the sockets shared with the ancestor
+// from the snapshot taken when the ancestor called fork(2).
+func (h *notifHandler) registerProcess(pid int) *processStatus {
+	logger := logrus.WithFields(logrus.Fields{"pid": pid})
+	proc := newProcessStatus()
+
+	ppid := pid
+	for i := 0; i < maxInheritDepth; i++ {
+		var err error
+		ppid, err = getParentPid(ppid)
+		if err != nil {
+			logger.WithError(err).Debug("failed to get parent pid")
+			break
+		}
+		if ppid <= 1 {
+			break
+		}
+		if parent, ok := h.getProcess(ppid); ok {
+			// the parent can be handled concurrently by another worker.
+			// the lock is always taken from the child to the ancestor, so it does not deadlock.
+			parent.mu.Lock()
+			if parent.forkSnapshot != nil {
+				h.inheritSockets(pid, proc, ppid, parent.forkSnapshot)
+			} else {
+				// fork(2) is not notified when the profile restricts clone(2) with conditions (e.g. the default profile of Docker).
+				h.inheritSockets(pid, proc, ppid, parent.sockets)
+			}
+			parent.mu.Unlock()
+			break
+		}
+	}
+
+	// the process is published after its sockets are inherited.
+	// another thread of the process can be registered concurrently.
+	h.processesMu.Lock()
+	if registered, ok := h.processes[pid]; ok {
+		h.processesMu.Unlock()
+		released := map[*socketStatus]bool{}
+		for _, sock := range proc.sockets {
+			if !released[sock] {
+				released[sock] = true
+				h.releaseSocket(sock)
+			}
+		}
+		return registered
+	}
+	h.processes[pid] = proc
+	h.processesMu.Unlock()
+
+	logger.Debugf("process is registered (inherited sockets=%d)", len(proc.sockets))
+	return proc
+}
+
+// inheritSockets copies the status of the sockets which the process shares with the ancestor.
+// Sockets closed by exec(2) or replaced after fork(2) are not inherited.
+func (h *notifHandler) inheritSockets(pid int, proc *processStatus, ppid int, sockets map[int]*socketStatus) {
+	cloned := map[*socketStatus]*socketStatus{}
+	for fd, sock := range sockets {
+		if sock.state == NotBypassable {
+			continue
+		}
+		logger := logrus.WithFields(logrus.Fields{"pid": pid, "ppid": ppid, "sockfd": fd})
+		ino, err := fileInodeInProcess(pid, fd)
+		if err != nil || ino != sock.ino {
+			continue
+		}
+		c, ok := cloned[sock]
+		if !ok {
+			c, err = sock.cloneForProcess(pid, fd)
+			if err != nil {
+				logger.WithError(err).Warn("failed to inherit socket")
+				continue
+			}
+			cloned[sock] = c
+			h.trackInode(c)
+			if c.reuseportGroup != nil {
+				h.reuseportMu.Lock()
+				c.reuseportGroup.members[c] = struct{}{}
+				h.reuseportMu.Unlock()
+			}
+		}
+		c.fds[fd] = sock.fds[fd]
+		proc.sockets[fd] = c
+		logger.Infof("socket is inherited (state=%s)", c.state)
+	}
+}
+
+// handleSysFork takes the snapshot of the sockets before the process is forked.
+// The child inherits the status at the time of fork(2), not the one changed by the parent later.
+func (h *notifHandler) handleSysFork(pid int, ctx *context, syscallName string) {
+	flags, err := h.cloneFlags(pid, ctx, syscallName)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to get the flags of %s pid %d", syscallName, pid)
+		return
+	}
+	// threads share the sockets with the process
+	if flags&unix.CLONE_THREAD != 0 {
+		return
+	}
+	// the child of the process not registered yet inherits the sockets from the ancestor's snapshot
+	proc, ok := h.getProcess(pid)
+	if !ok {
+		return
+	}
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+
+	snapshot := map[int]*socketStatus{}
+	cloned := map[*socketStatus]*socketStatus{}
+	for fd, sock := range proc.sockets {
+		if sock.state == NotBypassable {
+			continue
+		}
+		c, ok := cloned[sock]
+		if !ok {
+			c, err = sock.cloneForProcess(pid, fd)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{"pid": pid, "sockfd": fd}).WithError(err).Warn("failed to take the snapshot of socket")
+				continue
+			}
+			cloned[sock] = c
+		}
+		c.fds[fd] = sock.fds[fd]
+		snapshot[fd] = c
+	}
+	proc.releaseForkSnapshot()
+	proc.forkSnapshot = snapshot
+	logrus.WithFields(logrus.Fields{"pid": pid}).Debugf("snapshot of sockets is taken for %s (sockets=%d)", syscallName, len(snapshot))
+}
+
+// cloneFlags returns the flags of clone(2) and clone3(2). 0 is returned for fork(2) and vfork(2).
+func (h *notifHandler) cloneFlags(pid int, ctx *context, syscallName string) (uint64, error) {
+	switch syscallName {
+	case "clone":
+		return ctx.req.Data.Args[0], nil
+	case "clone3":
+		// struct clone_args starts with __aligned_u64 flags
+		buf, err := h.readProcMem(pid, ctx.req.Data.Args[0], 8)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read clone_args: %w", err)
+		}
+		if len(buf) != 8 {
+			return 0, fmt.Errorf("unexpected clone_args length %d", len(buf))
+		}
+		return binary.NativeEndian.Uint64(buf), nil
+	}
+	return 0, nil
+}
+
 func (h *notifHandler) registerSocket(pid int, sockfd int, syscallName string) (*socketStatus, error) {
 	logger := logrus.WithFields(logrus.Fields{"pid": pid, "sockfd": sockfd, "syscall": syscallName})
-	proc, ok := h.processes[pid]
+	proc, ok := h.getProcess(pid)
 	if !ok {
-		proc = newProcessStatus()
-		h.processes[pid] = proc
-		logger.Debug("process is registered")
+		proc = h.registerProcess(pid)
 	}
 
 	sock, ok := proc.sockets[sockfd]
@@ -414,12 +1061,46 @@ func (h *notifHandler) registerSocket(pid int, sockfd int, syscallName string) (
 		return sock, nil
 	}
 
-	// If the pid is thread, its process can have corresponding socket
-	procInfo, ok := h.pidInfos[int(pid)]
-	if ok && procInfo.pidType == THREAD {
-		return nil, fmt.Errorf("unexpected procInfo")
+	// non IP fds are not bypassable. they are classified without retrieving the fd.
+	protoName, err := socketProtoName(pid, sockfd)
+	sockDomain, sockType, isIP := protoNameToSocketArgs(protoName)
+	if errors.Is(err, errNotSocket) || (err == nil && !isIP) {
+		sock = newSocketStatus(pid, sockfd, 0, 0, 0, h.ignoreBind)
+		sock.state = NotBypassable
+		proc.sockets[sockfd] = sock
+		logger.Debugf("non IP fd is registered (protocol=%q)", protoName)
+		return sock, nil
+	}
+
+	// the fd can be duplicated from the registered socket with dup(2) or fcntl(F_DUPFD)
+	if dupSock := h.findDuplicatedSocket(pid, proc, sockfd); dupSock != nil {
+		cloexec, err := isCloexec(pid, sockfd)
+		if err != nil {
+			logger.WithError(err).Warn("failed to get close-on-exec flag")
+		}
+		dupSock.fds[sockfd] = cloexec
+		proc.sockets[sockfd] = dupSock
+		logger.Infof("socket is registered as duplicate of sockfd %d (state=%s)", dupSock.sockfd, dupSock.state)
+		return dupSock, nil
+	}
+
+	// the socket created with socket(2) after the process is tracked
+	// the socket registered in other processes (e.g. received with SCM_RIGHTS) is not the pending one.
+	if isIP {
+		ino, err := fileInodeInProcess(pid, sockfd)
+		if err == nil && !h.isInodeTracked(ino) {
+			if args, ok := proc.popPendingSocket(sockDomain, sockType, protoNameToProtocol(protoName)); ok {
+				return h.registerPendingSocket(pid, proc, sockfd, args, ino), nil
+			}
+		}
+		if !h.socketNotified.Load() {
+			h.socketNotNotifiedOnce.Do(func() {
+				logrus.Infof("socket(2) of container %s is not notified, probably because the seccomp profile has conditional rules for it. new sockets are retrieved from the processes", util.ShrinkID(h.state.State.ID))
+			})
+		}
 	}
 
+	// fds inherited from before tracking started, or received from other processes
 	sockFdHost, err := h.getFdInProcess(int(pid), sockfd)
 	if err != nil {
 		return nil, err
@@ -428,6 +1109,13 @@ func (h *notifHandler) registerSocket(pid int, sockfd int, syscallName string) (
 
 	sockDomain, sockType, sockProtocol, err := getSocketArgs(sockFdHost)
 	sock = newSocketStatus(pid, sockfd, sockDomain, sockType, sockProtocol, h.ignoreBind)
+	if ino, err := fileInode(sockFdHost); err == nil {
+		sock.ino = ino
+		h.trackInode(sock)
+	}
+	if cloexec, err := isCloexec(pid, sockfd); err == nil {
+		sock.fds[sockfd] = cloexec
+	}
 	if err != nil {
 		// non-socket fd is not bypassable
 		sock.state = NotBypassable
@@ -437,16 +1125,29 @@ func (h *notifHandler) registerSocket(pid int, sockfd int, syscallName string) (
 			// non IP sockets are not handled.
 			sock.state = NotBypassable
 			logger.Debugf("socket domain=0x%x", sockDomain)
-		} else if sockType&syscall.SOCK_STREAM == 0 {
-			// only accepting TCP socket
+		} else if t := sockType & sockTypeMask; t != syscall.SOCK_STREAM && t != syscall.SOCK_DGRAM {
+			// only accepting TCP and UDP socket
 			sock.state = NotBypassable
 			logger.Debugf("socket type=0x%x", sockType)
+		} else if sock.isDatagram() && !h.notifySendmsg {
+			sock.state = NotBypassable
+			logger.Debug("datagram socket is not bypassed because sendmsg(2) is not notified")
 		} else {
 			// only newly created socket is allowed.
-			_, err := syscall.Getpeername(sockFdHost)
+			peer, err := unix.Getpeername(sockFdHost)
 			if err == nil {
 				logger.Infof("socket is already connected. socket is created via accept or forked")
 				sock.state = NotBypassable
+				// connections accepted by bypassed listeners from other bypassed containers
+				if h.comClient != nil && isHostSocket(sockFdHost) {
+					if peerAddr, err := newSockaddrFromUnix(peer); err == nil {
+						if virtPeer := h.lookupC2CPeer(peerAddr); virtPeer != nil {
+							logger.Infof("peer address %s is virtualized to %s", peerAddr, virtPeer)
+							sock.state = Bypassed
+							sock.addr = virtPeer
+						}
+					}
+				}
 			}
 		}
 	}
@@ -461,27 +1162,232 @@ func (h *notifHandler) registerSocket(pid int, sockfd int, syscallName string) (
 	return sock, nil
 }
 
+// findDuplicatedSocket returns the registered socket which refers to the same open file description as sockfd.
+// Sockets not bypassable are not checked.
+func (h *notifHandler) findDuplicatedSocket(pid int, proc *processStatus, sockfd int) *socketStatus {
+	checked := map[*socketStatus]bool{}
+	for _, sock := range proc.sockets {
+		if sock.state == NotBypassable || checked[sock] {
+			continue
+		}
+		checked[sock] = true
+		same, err := isSameFile(pid, sock.sockfd, pid, sockfd)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"pid": pid, "sockfd": sockfd}).WithError(err).Debug("failed to compare fds")
+			continue
+		}
+		if same {
+			return sock
+		}
+	}
+	return nil
+}
+
+func (h *notifHandler) addSocket(pid int, sockfd int, sock *socketStatus, cloexec bool) {
+	proc, ok := h.getProcess(pid)
+	if !ok {
+		proc = h.registerProcess(pid)
+	}
+	if old, ok := proc.sockets[sockfd]; ok && old != sock {
+		h.removeSocket(pid, sockfd)
+	}
+	sock.fds[sockfd] = cloexec
+	proc.sockets[sockfd] = sock
+}
+
+// releaseSocket releases resources related to the socket.
+func (h *notifHandler) releaseSocket(sock *socketStatus) {
+	sock.close()
+	h.untrackInode(sock)
+	h.leaveReuseportGroup(sock)
+	if sock.c2cHostAddr != "" && h.comClient != nil {
+		ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 2*time.Second)
+		err := h.comClient.DeleteConnection(ctx, sock.c2cHostAddr)
+		cancel()
+		if err != nil {
+			sock.logger.WithError(err).Warnf("failed to delete connection %s", sock.c2cHostAddr)
+		}
+		sock.c2cHostAddr = ""
+	}
+}
+
+// trackInode counts the inode of the registered socket.
+// Sockets are handled by the workers of the processes concurrently, so the inodes are counted separately.
+func (h *notifHandler) trackInode(sock *socketStatus) {
+	if sock.ino == 0 || sock.inoTracked {
+		return
+	}
+	sock.inoTracked = true
+	h.socketInodesMu.Lock()
+	h.socketInodes[sock.ino]++
+	h.socketInodesMu.Unlock()
+}
+
+// untrackInode uncounts the inode of the released socket.
+func (h *notifHandler) untrackInode(sock *socketStatus) {
+	if !sock.inoTracked {
+		return
+	}
+	sock.inoTracked = false
+	h.socketInodesMu.Lock()
+	defer h.socketInodesMu.Unlock()
+	if h.socketInodes[sock.ino]--; h.socketInodes[sock.ino] <= 0 {
+		delete(h.socketInodes, sock.ino)
+	}
+}
+
+// isInodeTracked checks whether the socket of the inode is registered in any process.
+func (h *notifHandler) isInodeTracked(ino uint64) bool {
+	h.socketInodesMu.Lock()
+	defer h.socketInodesMu.Unlock()
+	return h.socketInodes[ino] > 0
+}
+
 func (h *notifHandler) getSocket(pid int, sockfd int) *socketStatus {
-	proc, ok := h.processes[pid]
+	proc, ok := h.getProcess(pid)
+	if !ok {
+		return nil
+	}
+	sock, ok := proc.sockets[sockfd]
 	if !ok {
 		return nil
 	}
-	sock := proc.sockets[sockfd]
+
+	// the close-on-exec fd can be closed by execve(2) and reused by the new program.
+	if _, ok := proc.unverifiedFds[sockfd]; ok {
+		delete(proc.unverifiedFds, sockfd)
+		ino, err := fileInodeInProcess(pid, sockfd)
+		if err != nil || ino != sock.ino {
+			logrus.WithFields(logrus.Fields{"pid": pid, "sockfd": sockfd}).Debug("socket was closed by execve")
+			h.removeSocket(pid, sockfd)
+			return nil
+		}
+	}
 	return sock
 }
 
 func (h *notifHandler) removeSocket(pid int, sockfd int) {
 	defer logrus.WithFields(logrus.Fields{"pid": pid, "sockfd": sockfd}).Debugf("socket is removed")
-	proc, ok := h.processes[pid]
+	proc, ok := h.getProcess(pid)
 	if !ok {
 		return
 	}
-	delete(proc.sockets, sockfd)
+	sock, ok := proc.sockets[sockfd]
+	if !ok {
+		return
+	}
+	delete(proc.sockets, sockfd)
+	delete(proc.unverifiedFds, sockfd)
+	delete(sock.fds, sockfd)
+	if len(sock.fds) == 0 {
+		h.releaseSocket(sock)
+		return
+	}
+
+	// the socket is still referred from the duplicated fds.
+	if sock.sockfd == sockfd {
+		for fd := range sock.fds {
+			sock.sockfd = fd
+			break
+		}
+		sock.logger = logrus.WithFields(logrus.Fields{"pid": pid, "sockfd": sock.sockfd})
+	}
+}
+
+// handleSysExecve marks the close-on-exec fds to be verified.
+// execve(2) can fail and the fds are not removed here.
+func (h *notifHandler) handleSysExecve(pid int) {
+	// the memory is replaced with the new program and the cached memfd pins the old one.
+	// it is opened again when execve(2) fails.
+	h.closeMem(pid)
+
+	proc, ok := h.getProcess(pid)
+	if !ok {
+		return
+	}
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	for fd, sock := range proc.sockets {
+		if sock.fds[fd] {
+			proc.unverifiedFds[fd] = struct{}{}
+		}
+	}
+	logrus.WithFields(logrus.Fields{"pid": pid}).Debugf("execve is called (close-on-exec fds=%d)", len(proc.unverifiedFds))
+}
+
+// handleSysCloseRange handles close_range(2).
+func (h *notifHandler) handleSysCloseRange(pid int, ctx *context) {
+	// int close_range(unsigned int first, unsigned int last, unsigned int flags)
+	first := uint32(ctx.req.Data.Args[0])
+	last := uint32(ctx.req.Data.Args[1])
+	flags := ctx.req.Data.Args[2]
+	proc, ok := h.getProcess(pid)
+	if !ok || first > last {
+		return
+	}
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+
+	for fd, sock := range proc.sockets {
+		if uint32(fd) < first || uint32(fd) > last {
+			continue
+		}
+		if flags&unix.CLOSE_RANGE_CLOEXEC != 0 {
+			sock.fds[fd] = true
+			continue
+		}
+		h.removeSocket(pid, fd)
+	}
+	logrus.WithFields(logrus.Fields{"pid": pid}).Debugf("close_range first=%d last=%d flags=0x%x", first, last, flags)
+}
+
+// handleSysDup handles dup2(2) and dup3(2).
+// newfd is closed implicitly and shares the socket status with oldfd.
+// fds duplicated with dup(2) or fcntl(F_DUPFD) are found when they are used.
+func (h *notifHandler) handleSysDup(pid int, ctx *context, syscallName string) {
+	oldfd := int(ctx.req.Data.Args[0])
+	newfd := int(ctx.req.Data.Args[1])
+	if oldfd == newfd {
+		return
+	}
+
+	h.removeSocket(pid, newfd)
+	sock := h.getSocket(pid, oldfd)
+	if sock == nil || sock.state == NotBypassable {
+		return
+	}
+
+	cloexec := false
+	if syscallName == "dup3" {
+		cloexec = ctx.req.Data.Args[2]&unix.O_CLOEXEC != 0
+	}
+	h.addSocket(pid, newfd, sock, cloexec)
+	sock.logger.Infof("socket is duplicated to fd %d", newfd)
+}
+
+// handleIOUring applies the io_uring policy to io_uring_setup(2) and io_uring_register(2).
+func (h *notifHandler) handleIOUring(ctx *context, pid int, syscallName string) {
+	logger := logrus.WithFields(logrus.Fields{"pid": pid, "syscall": syscallName})
+	switch h.ioUringPolicy {
+	case IOUringPolicyDeny:
+		logger.Info("io_uring is denied")
+		ctx.resp.Error = -int32(syscall.EPERM)
+		ctx.resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+	case IOUringPolicyAllow:
+		logger.Debug("io_uring is allowed")
+	default:
+		if syscallName == "io_uring_setup" {
+			logger.Warn("io_uring is used. socket operations via io_uring are not bypassed nor restricted by bypass4netns")
+		} else {
+			logger.Debug("io_uring is used")
+		}
+	}
 }
 
 // handleReq handles seccomp notif requests and configures responses.
 func (h *notifHandler) handleReq(ctx *context) {
-	syscallName, err := ctx.req.Data.Syscall.GetName()
+	// compat syscalls (e.g. i386 on x86_64) have different numbers from the native ones
+	syscallName, err := ctx.req.Data.Syscall.GetNameByArch(ctx.req.Data.Arch)
 	if err != nil {
 		logrus.Errorf("Error decoding syscall %v(): %s", ctx.req.Data.Syscall, err)
 		// TODO: error handle
@@ -491,6 +1397,30 @@ func (h *notifHandler) handleReq(ctx *context) {
 
 	ctx.resp.Flags |= SeccompUserNotifFlagContinue
 
+	// socket syscalls are multiplexed with socketcall(2) on some 32-bit architectures (e.g. i386)
+	if syscallName == "socketcall" {
+		syscallName, err = h.demuxSocketcall(ctx)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to demultiplex socketcall pid %d", ctx.req.Pid)
+			return
+		}
+		logrus.Tracef("socketcall is demultiplexed to %q, args %+v", syscallName, ctx.req.Data.Args)
+	}
+
+	// the profile generated by an older version can notify the syscalls no longer handled (e.g. exit_group(2)).
+	if _, ok := handledSyscalls[syscallName]; !ok {
+		logrus.Debugf("syscall %q is not handled", syscallName)
+		return
+	}
+	// fcntl64(2) takes the same arguments as fcntl(2) for the commands handled.
+	if syscallName == "fcntl64" {
+		syscallName = "fcntl"
+	}
+	// fcntl(2) is handled only for F_SETFD and F_SETFL. fds duplicated with F_DUPFD are detected when they are used.
+	if syscallName == "fcntl" && ctx.req.Data.Args[1] != unix.F_SETFD && ctx.req.Data.Args[1] != unix.F_SETFL {
+		return
+	}
+
 	// ensure pid is registered in notifHandler.pidInfos
 	pidInfo, err := h.getPidFdInfo(int(ctx.req.Pid))
 	if err != nil {
@@ -505,24 +1435,39 @@ func (h *notifHandler) handleReq(ctx *context) {
 		logrus.Debugf("pid %d is thread. use process's tgid %d as pid", ctx.req.Pid, pid)
 	}
 
-	// cleanup sockets when the process exit.
-	if syscallName == "_exit" || syscallName == "exit_group" {
-		if pidInfo, ok := h.pidInfos[int(ctx.req.Pid)]; ok {
-			syscall.Close(int(pidInfo.pidfd))
-			delete(h.pidInfos, int(ctx.req.Pid))
-		}
-		if pidInfo.pidType == THREAD {
-			logrus.WithFields(logrus.Fields{"pid": ctx.req.Pid, "tgid": pid}).Infof("thread is removed")
-		}
+	// io_uring syscalls do not take socket fds
+	if syscallName == "io_uring_setup" || syscallName == "io_uring_register" {
+		h.handleIOUring(ctx, pid, syscallName)
+		return
+	}
 
-		if pidInfo.pidType == PROCESS {
-			delete(h.processes, pid)
-			if memfd, ok := h.memfds[pid]; ok {
-				syscall.Close(memfd)
-				delete(h.memfds, pid)
-			}
-			logrus.WithFields(logrus.Fields{"pid": pid}).Infof("process is removed")
-		}
+	// these syscalls do not take a socket fd as the first argument
+	switch syscallName {
+	case "execve", "execveat":
+		h.handleSysExecve(pid)
+		return
+	case "close_range":
+		h.handleSysCloseRange(pid, ctx)
+		return
+	case "fork", "vfork", "clone", "clone3":
+		h.handleSysFork(pid, ctx, syscallName)
+		return
+	}
+
+	h.prefetchMultinode(pid, syscallName, ctx)
+
+	// processes forked from a registered process inherit its sockets.
+	proc, ok := h.getProcess(pid)
+	if !ok {
+		proc = h.registerProcess(pid)
+	}
+	// the threads of the process are handled by different workers,
+	// and the sockets can be read by another worker when they are inherited.
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+
+	if syscallName == "socket" {
+		h.handleSysSocket(pid, proc, ctx)
 		return
 	}
 
@@ -533,6 +1478,11 @@ func (h *notifHandler) handleReq(ctx *context) {
 		return
 	}
 
+	if syscallName == "dup2" || syscallName == "dup3" {
+		h.handleSysDup(pid, ctx, syscallName)
+		return
+	}
+
 	sock := h.getSocket(pid, sockfd)
 	if sock == nil {
 		sock, err = h.registerSocket(pid, sockfd, syscallName)
@@ -542,6 +1492,11 @@ func (h *notifHandler) handleReq(ctx *context) {
 		}
 	}
 
+	// close-on-exec flag is per fd and is tracked regardless of the socket state.
+	if syscallName == "fcntl" && ctx.req.Data.Args[1] == unix.F_SETFD {
+		sock.fds[sockfd] = ctx.req.Data.Args[2]&unix.FD_CLOEXEC != 0
+	}
+
 	switch sock.state {
 	case NotBypassable:
 		// sometimes close(2) is not called for the fd.
@@ -560,8 +1515,23 @@ func (h *notifHandler) handleReq(ctx *context) {
 
 		// when sock.state == NotBypassed, continue
 	case Bypassed:
-		if syscallName == "getpeername" {
+		switch syscallName {
+		case "getpeername":
 			sock.handleSysGetpeername(h, ctx)
+			return
+		case "getsockname":
+			sock.handleSysGetsockname(h, ctx)
+			return
+		case "accept":
+			sock.handleSysAccept(h, ctx, 0)
+			return
+		case "accept4":
+			sock.handleSysAccept(h, ctx, int(ctx.req.Data.Args[3]))
+			return
+		}
+		// destinations of datagram sockets are checked for each call.
+		if sock.isDatagram() && (syscallName == "connect" || syscallName == "sendto" || syscallName == "sendmsg") {
+			break
 		}
 		return
 	default:
@@ -576,8 +1546,12 @@ func (h *notifHandler) handleReq(ctx *context) {
 		sock.handleSysSetsockopt(pid, h, ctx)
 	case "fcntl":
 		sock.handleSysFcntl(ctx)
-	case "getpeername":
-		// already handled
+	case "sendto":
+		sock.handleSysSendto(h, ctx)
+	case "sendmsg":
+		sock.handleSysSendmsg(h, ctx)
+	case "getpeername", "getsockname", "accept", "accept4":
+		// only handled for bypassed sockets
 	default:
 		logrus.Errorf("Unknown syscall %q", syscallName)
 		// TODO: error handle
@@ -586,55 +1560,306 @@ func (h *notifHandler) handleReq(ctx *context) {
 
 }
 
-// notifHandler handles seccomp notifications and response to them.
-func (h *notifHandler) handle() {
-	defer unix.Close(int(h.fd))
-	if h.nonBypassableAutoUpdate {
-		go func() {
-			if nbErr := h.nonBypassable.WatchNS(gocontext.TODO(), h.state.Pid); nbErr != nil {
-				logrus.WithError(nbErr).Fatalf("failed to watch NS (PID=%d)", h.state.Pid)
+// handledSyscalls are the syscalls handled by handleReq. The other syscalls are continued as is.
+var handledSyscalls = map[string]struct{}{
+	"bind": {}, "close": {}, "connect": {}, "setsockopt": {}, "fcntl": {}, "fcntl64": {}, "getpeername": {}, "sendto": {}, "sendmsg": {},
+	"accept": {}, "accept4": {}, "getsockname": {}, "dup2": {}, "dup3": {}, "execve": {}, "execveat": {}, "close_range": {},
+	"io_uring_setup": {}, "io_uring_register": {}, "socket": {}, "fork": {}, "vfork": {}, "clone": {}, "clone3": {},
+}
+
+// notifHandler handles seccomp notifications and response to them until the container exits.
+// It returns true when the handler is stopped by stop(). The resources are kept to resume or hand over the handler then.
+func (h *notifHandler) handle() bool {
+	stopped := false
+	defer func() {
+		// the responses sent asynchronously use the seccomp fd
+		h.deferred.Wait()
+		if stopped {
+			// stopfd is reset after the pending accept(2) are continued
+			if _, err := unix.Read(h.stopfd, make([]byte, 8)); err != nil {
+				logrus.WithError(err).Warn("failed to reset stopfd")
 			}
-		}()
+			return
+		}
+		h.teardown()
+		unix.Close(int(h.fd))
+	}()
+
+	// the exit of the init process stops the container
+	initPidfd := -1
+	if h.initProcess {
+		pidfd, err := unix.PidfdOpen(h.state.Pid, 0)
+		switch {
+		case err == nil:
+			initPidfd = pidfd
+			defer unix.Close(initPidfd)
+		case errors.Is(err, unix.ESRCH):
+			logrus.Infof("container %s already exited", util.ShrinkID(h.state.State.ID))
+			return false
+		default:
+			logrus.WithError(err).Warnf("failed to open pidfd of pid %d. the exit of the container is detected by the seccomp fd", h.state.Pid)
+		}
+	}
+
+	h.pool = newNotifWorkerPool(h.notifWorkers)
+	defer h.pool.close()
+
+	exitWatcher, err := newExitWatcher(h.handleProcessExit)
+	if err != nil {
+		logrus.WithError(err).Warn("failed to start exit watcher. resources of exited processes are not released")
+	} else {
+		h.exitWatcher = exitWatcher
+		defer exitWatcher.close()
+		go exitWatcher.run()
+		// the processes taken over from the previous bypass4netns
+		h.pidMu.Lock()
+		for tgid, pidfd := range h.pidfds {
+			h.watchExit(tgid, pidfd)
+		}
+		h.pidMu.Unlock()
 	}
 
 	for {
+		res, err := h.waitNotif(initPidfd)
+		if err != nil {
+			logrus.WithError(err).Error("failed to wait for notifications")
+			return false
+		}
+		switch res {
+		case notifExited:
+			logrus.Infof("container %s exited", util.ShrinkID(h.state.State.ID))
+			return false
+		case notifStopped:
+			logrus.Infof("handler of container %s is stopped for handover", util.ShrinkID(h.state.State.ID))
+			stopped = true
+			return true
+		}
 		req, err := libseccomp.NotifReceive(h.fd)
 		if err != nil {
-			logrus.Errorf("Error in NotifReceive(): %s", err)
+			// the notification is no longer valid because the process was killed
+			if !errors.Is(err, unix.ENOENT) {
+				logrus.Errorf("Error in NotifReceive(): %s", err)
+			}
 			continue
 		}
 
-		ctx := context{
-			notifFd: h.fd,
-			req:     req,
-			resp: &libseccomp.ScmpNotifResp{
-				ID:    req.ID,
-				Error: 0,
-				Val:   0,
-				Flags: libseccomp.NotifRespFlagContinue,
-			},
-		}
+		// the requests of the same thread are handled in order.
+		// the threads are handled concurrently not to wait for the other threads blocked in the requests.
+		h.pool.dispatch(int(req.Pid), func() {
+			h.handleNotif(req)
+		})
+	}
+}
 
-		// TOCTOU check
-		if err := libseccomp.NotifIDValid(h.fd, req.ID); err != nil {
-			logrus.Errorf("TOCTOU check failed: req.ID is no longer valid: %s", err)
-			continue
+type notifWaitResult int
+
+const (
+	// notifReceived means that a notification is pending
+	notifReceived notifWaitResult = iota
+	// notifExited means that no process uses the seccomp filter or the init process exited
+	notifExited
+	// notifStopped means that the handler is stopped for the handover
+	notifStopped
+)
+
+// waitNotif waits for a notification, the exit of the container or stop().
+func (h *notifHandler) waitNotif(initPidfd int) (notifWaitResult, error) {
+	fds := []unix.PollFd{{Fd: int32(h.fd), Events: unix.POLLIN}}
+	initIdx, stopIdx := -1, -1
+	if initPidfd >= 0 {
+		initIdx = len(fds)
+		fds = append(fds, unix.PollFd{Fd: int32(initPidfd), Events: unix.POLLIN})
+	}
+	if h.stopfd >= 0 {
+		stopIdx = len(fds)
+		fds = append(fds, unix.PollFd{Fd: int32(h.stopfd), Events: unix.POLLIN})
+	}
+	for {
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return notifExited, err
+		}
+		if stopIdx >= 0 && fds[stopIdx].Revents != 0 {
+			return notifStopped, nil
+		}
+		if fds[0].Revents&(unix.POLLHUP|unix.POLLERR|unix.POLLNVAL) != 0 {
+			return notifExited, nil
 		}
+		if initIdx >= 0 && fds[initIdx].Revents != 0 {
+			return notifExited, nil
+		}
+		if fds[0].Revents&unix.POLLIN != 0 {
+			return notifReceived, nil
+		}
+	}
+}
 
-		h.handleReq(&ctx)
+// stop stops handle() for the handover and waits for the pending responses.
+// The stopped handler waits for resume(). It returns false when the handler cannot be stopped or already finished.
+func (h *notifHandler) stop() bool {
+	h.stopMu.Lock()
+	if h.stopfd < 0 {
+		h.stopMu.Unlock()
+		return false
+	}
+	_, err := unix.Write(h.stopfd, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+	h.stopMu.Unlock()
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to stop handler of container %s", util.ShrinkID(h.state.State.ID))
+		return false
+	}
+	select {
+	case <-h.stopped:
+		return true
+	case <-h.done:
+		return false
+	}
+}
 
-		if err = libseccomp.NotifRespond(h.fd, ctx.resp); err != nil {
-			logrus.Errorf("Error in notification response: %s", err)
-			continue
+// resume restarts the stopped handler. When handedOver is true, the handler is finished without releasing
+// the resources of the container because the new bypass4netns handles it.
+func (h *notifHandler) resume(handedOver bool) {
+	h.resumed <- handedOver
+}
+
+// finish closes stopfd and done after the handler finished.
+func (h *notifHandler) finish() {
+	h.stopMu.Lock()
+	if h.stopfd >= 0 {
+		unix.Close(h.stopfd)
+		h.stopfd = -1
+	}
+	h.stopMu.Unlock()
+	close(h.done)
+}
+
+// goTask runs the background task until the handler is torn down.
+func (h *notifHandler) goTask(task func()) {
+	h.tasks.Add(1)
+	go func() {
+		defer h.tasks.Done()
+		task()
+	}()
+}
+
+// teardown stops the background tasks and releases the resources of the processes.
+func (h *notifHandler) teardown() {
+	h.cancel()
+	h.tasks.Wait()
+
+	h.processesMu.Lock()
+	tgids := []int{}
+	for tgid := range h.processes {
+		tgids = append(tgids, tgid)
+	}
+	h.processesMu.Unlock()
+	for _, tgid := range tgids {
+		h.removeProcess(tgid)
+	}
+
+	h.pidMu.Lock()
+	defer h.pidMu.Unlock()
+	for pid, memfd := range h.memfds {
+		syscall.Close(memfd)
+		delete(h.memfds, pid)
+	}
+	for tgid, pidfd := range h.pidfds {
+		syscall.Close(pidfd)
+		delete(h.pidfds, tgid)
+	}
+	h.pidInfos = map[int]pidInfo{}
+	logrus.Infof("handler of container %s is stopped", util.ShrinkID(h.state.State.ID))
+}
+
+// release removes the registrations of the container from bypass4netnsd and etcd
+// when the handler is the last one of the container.
+func (h *notifHandler) release(last bool) {
+	id := h.state.State.ID
+	if last && h.comClient != nil {
+		ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 2*time.Second)
+		if err := h.comClient.DeleteInterface(ctx, id); err != nil {
+			logrus.WithError(err).Warnf("failed to delete interfaces of container %s", util.ShrinkID(id))
+		}
+		cancel()
+	}
+	if h.multinode.etcdClient == nil {
+		return
+	}
+	if last && h.multinodeLease != clientv3.NoLease {
+		ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 2*time.Second)
+		if _, err := h.multinode.etcdClient.Revoke(ctx, h.multinodeLease); err != nil {
+			logrus.WithError(err).Warnf("failed to revoke lease of container %s", util.ShrinkID(id))
 		}
+		cancel()
+	}
+	if err := h.multinode.etcdClient.Close(); err != nil {
+		logrus.WithError(err).Warn("failed to close etcd client")
+	}
+}
+
+// handleNotif handles the notification and responds to it.
+func (h *notifHandler) handleNotif(req *libseccomp.ScmpNotifReq) {
+	ctx := context{
+		notifFd: h.fd,
+		req:     req,
+		resp: &libseccomp.ScmpNotifResp{
+			ID:    req.ID,
+			Error: 0,
+			Val:   0,
+			Flags: libseccomp.NotifRespFlagContinue,
+		},
+	}
+
+	// TOCTOU check
+	if err := libseccomp.NotifIDValid(h.fd, req.ID); err != nil {
+		logrus.Errorf("TOCTOU check failed: req.ID is no longer valid: %s", err)
+		h.dropExitedThread(int(req.Pid))
+		return
+	}
+
+	h.handleReq(&ctx)
+	if ctx.deferResponse {
+		return
+	}
+
+	if err := libseccomp.NotifRespond(h.fd, ctx.resp); err != nil {
+		logrus.Errorf("Error in notification response: %s", err)
 	}
 }
 
 type ForwardPortMapping struct {
+	// ParentIP is the host address to bind. nil means the wildcard address.
+	ParentIP  net.IP
 	HostPort  int
 	ChildPort int
 }
 
+// IOUringPolicy decides how io_uring is handled.
+// Socket operations submitted via io_uring are not notified and cannot be bypassed nor restricted.
+type IOUringPolicy string
+
+const (
+	// IOUringPolicyWarn allows io_uring with warnings
+	IOUringPolicyWarn IOUringPolicy = "warn"
+	// IOUringPolicyDeny denies io_uring_setup(2) and io_uring_register(2) with EPERM
+	IOUringPolicyDeny IOUringPolicy = "deny"
+	// IOUringPolicyAllow allows io_uring silently
+	IOUringPolicyAllow IOUringPolicy = "allow"
+)
+
+// BindAddressPolicy decides how the addresses bound in the container are translated on the host.
+type BindAddressPolicy string
+
+const (
+	// BindAddressPolicyWildcard bypasses binds to the wildcard address and the container's interface addresses.
+	// They are bound to ForwardPortMapping.ParentIP or the wildcard address on the host.
+	BindAddressPolicyWildcard BindAddressPolicy = "wildcard"
+	// BindAddressPolicyStrict bypasses only binds to the wildcard address.
+	BindAddressPolicyStrict BindAddressPolicy = "strict"
+)
+
 type Handler struct {
 	socketPath               string
 	comSocketPath            string
@@ -646,8 +1871,30 @@ type Handler struct {
 	// key is child port
 	forwardingPorts map[int]ForwardPortMapping
 
-	ignoreBind bool
-	ip         string
+	ignoreBind          bool
+	bindAddressPolicy   BindAddressPolicy
+	connectInSupervisor bool
+	connectFallback     bool
+	ioUringPolicy       IOUringPolicy
+	notifWorkers        int
+	ip                  string
+
+	containers *containerRegistry
+
+	// listener receives the seccomp fds. It is taken over from the previous bypass4netns with TakeOver.
+	listener net.Listener
+	// restored are the handlers taken over
+	restored []restoredHandler
+	// acceptMu is held while the seccomp fd is received and the handler is started
+	acceptMu   sync.Mutex
+	handedOver bool
+	// c2cConfig and multinodeConfig are given to StartHandle
+	c2cConfig       *C2CConnectionHandleConfig
+	multinodeConfig *MultinodeConfig
+	// added are the containers added with AddContainer. key is the container ID.
+	added map[string]*addedContainer
+	// handoverDone is closed when the containers are handed over
+	handoverDone chan struct{}
 }
 
 // NewHandler creates new seccomp notif handler
@@ -659,13 +1906,69 @@ func NewHandler(socketPath, comSocketPath, tracerAgentLogPath string, ignoreBind
 		ignoredSubnets:     []net.IPNet{},
 		forwardingPorts:    map[int]ForwardPortMapping{},
 		readyFd:            -1,
+		containers:         newContainerRegistry(),
+		added:              map[string]*addedContainer{},
+		handoverDone:       make(chan struct{}),
 		ignoreBind:         ignoreBind,
+		bindAddressPolicy:  BindAddressPolicyWildcard,
+		ioUringPolicy:      IOUringPolicyWarn,
+		notifWorkers:       runtime.NumCPU(),
 		ip:                 ip,
 	}
 
 	return &handler
 }
 
+// ListContainers returns the status of the containers handled by bypass4netns.
+func (h *Handler) ListContainers() []api.ContainerStatus {
+	return h.containers.list()
+}
+
+// SetConnectInSupervisor configures bypass4netns to perform connect(2) of bypassed sockets by itself
+// instead of rewriting the destination in the process's memory.
+func (h *Handler) SetConnectInSupervisor(enable bool) {
+	h.connectInSupervisor = enable
+}
+
+// SetConnectFallback configures bypass4netns to connect on the host before replacing the socket.
+// When the connection on the host fails, the socket in the container is left untouched.
+// This implies SetConnectInSupervisor for stream sockets.
+func (h *Handler) SetConnectFallback(enable bool) {
+	h.connectFallback = enable
+}
+
+// SetNotifWorkers configures the number of workers handling the notifications concurrently.
+// The notifications from the same process are handled in order by one worker.
+func (h *Handler) SetNotifWorkers(n int) error {
+	if n < 1 {
+		return fmt.Errorf("the number of notification workers must be positive: %d", n)
+	}
+	h.notifWorkers = n
+	return nil
+}
+
+// SetIOUringPolicy configures how io_uring is handled.
+func (h *Handler) SetIOUringPolicy(policy IOUringPolicy) error {
+	switch policy {
+	case IOUringPolicyWarn, IOUringPolicyDeny, IOUringPolicyAllow:
+	default:
+		return fmt.Errorf("unknown io_uring policy %q", policy)
+	}
+	h.ioUringPolicy = policy
+	return nil
+}
+
+// SetBindAddressPolicy configures how the bind addresses are translated.
+func (h *Handler) SetBindAddressPolicy(policy BindAddressPolicy) error {
+	switch policy {
+	case BindAddressPolicyWildcard, BindAddressPolicyStrict:
+	default:
+		return fmt.Errorf("unknown bind address policy %q", policy)
+	}
+	h.bindAddressPolicy = policy
+	return nil
+}
+
 // SetIgnoreSubnets configures subnets to ignore in bypass4netns.
 func (h *Handler) SetIgnoredSubnets(subnets []net.IPNet, autoUpdate bool) {
 	h.ignoredSubnets = subnets
@@ -674,17 +1977,7 @@ func (h *Handler) SetIgnoredSubnets(subnets []net.IPNet, autoUpdate bool) {
 
 // SetForwardingPort checks and configures port forwarding
 func (h *Handler) SetForwardingPort(mapping ForwardPortMapping) error {
-	for _, fwd := range h.forwardingPorts {
-		if fwd.HostPort == mapping.HostPort {
-			return fmt.Errorf("host port %d is already forwarded", fwd.HostPort)
-		}
-		if fwd.ChildPort == mapping.ChildPort {
-			return fmt.Errorf("container port %d is already forwarded", fwd.ChildPort)
-		}
-	}
-
-	h.forwardingPorts[mapping.ChildPort] = mapping
-	return nil
+	return addForwardingPort(h.forwardingPorts, mapping)
 }
 
 // SetReadyFd configure ready notification file descriptor
@@ -720,21 +2013,88 @@ type notifHandler struct {
 	forwardingPorts map[int]ForwardPortMapping
 
 	// key is pid
-	processes map[int]*processStatus
+	processes   map[int]*processStatus
+	processesMu sync.Mutex
+
+	// number of the registered sockets of each inode to match the sockets created with socket(2)
+	socketInodes   map[uint64]int
+	socketInodesMu sync.Mutex
+	// socketNotified is true after socket(2) is notified once
+	socketNotified        atomic.Bool
+	socketNotNotifiedOnce sync.Once
+
+	// reuseport groups of the published ports
+	reuseportGroups map[reuseportGroupKey]*reuseportGroup
+	reuseportMu     sync.Mutex
 
 	// key is destination address e.g. "192.168.1.1:1000"
 	containerInterfaces map[string]containerInterface
-	c2cConnections      *C2CConnectionHandleConfig
-	multinode           *MultinodeConfig
+	// addresses of the container's interfaces except loopback
+	containerAddrs               []net.IP
+	containerAddrsLastUpdateUnix int64
+	// containerAddrsMu guards containerInterfaces, containerAddrs and containerAddrsLastUpdateUnix
+	containerAddrsMu sync.RWMutex
+	// comClient is available when c2c connections are handled
+	comClient      *com.ComClient
+	c2cConnections *C2CConnectionHandleConfig
+	multinode      *MultinodeConfig
 
 	// cache /proc/<pid>/mem's fd to reduce latency. key is pid, value is fd
 	memfds map[int]int
 
-	// cache pidfd to reduce latency. key is pid.
+	// cache thread group of pids. key is pid.
 	pidInfos map[int]pidInfo
+	// cache pidfd to reduce latency. key is tgid. pidfd is shared by the threads.
+	pidfds map[int]int
+	// pidMu guards memfds, pidInfos and pidfds
+	pidMu sync.Mutex
+	// exitWatcher releases the resources of the exited processes
+	exitWatcher *exitWatcher
+
+	pool *notifWorkerPool
+
+	// initProcess is true when the handler is for the container's init process
+	initProcess bool
+	// ctx is canceled when the container exited to stop the background tasks
+	ctx    gocontext.Context
+	cancel gocontext.CancelFunc
+	tasks  sync.WaitGroup
+	// multinodeLease is the etcd lease of the addresses registered by the multinode task
+	multinodeLease clientv3.LeaseID
+	// multinodeCache caches the addresses looked up in etcd. key is the container address.
+	multinodeCache   map[string]multinodeCacheEntry
+	multinodeCacheMu sync.Mutex
+	// stopfd is the eventfd to stop handle() for the handover. It is -1 after the handler finished.
+	stopfd int
+	stopMu sync.Mutex
+	// stopped receives when handle() is stopped and resumed receives the result of the handover
+	stopped chan struct{}
+	resumed chan bool
+	// done is closed when the handler finished
+	done chan struct{}
+	// deferred tracks the responses sent asynchronously
+	deferred sync.WaitGroup
+	// listenerLocks serializes accept(2) in bypass4netns not to block on the listener shared with the process.
+	// key is the inode of the listener.
+	listenerLocks   map[uint64]*listenerLock
+	listenerLocksMu sync.Mutex
+
+	ignoreBind          bool
+	bindAddressPolicy   BindAddressPolicy
+	connectInSupervisor bool
+	connectFallback     bool
+	// number of connections fallen back to the container's network
+	connectFallbacks uint64
+	// notifySendmsg is true when every sendmsg(2) is notified. datagram sockets are bypassed only with it.
+	notifySendmsg bool
+	ioUringPolicy IOUringPolicy
+	notifWorkers  int
+	ip            string
+}
 
-	ignoreBind bool
-	ip         string
+type listenerLock struct {
+	mu   sync.Mutex
+	refs int
 }
 
 type containerInterface struct {
@@ -756,135 +2116,248 @@ type pidInfo struct {
 	tgid    int
 }
 
-func (h *Handler) newNotifHandler(fd uintptr, state *specs.ContainerProcessState) *notifHandler {
+func (h *Handler) newNotifHandler(fd uintptr, state *specs.ContainerProcessState, config *containerConfig) *notifHandler {
 	notifHandler := notifHandler{
-		fd:              libseccomp.ScmpFd(fd),
-		state:           state,
-		forwardingPorts: map[int]ForwardPortMapping{},
-		processes:       map[int]*processStatus{},
-		memfds:          map[int]int{},
-		pidInfos:        map[int]pidInfo{},
-		ignoreBind:      h.ignoreBind,
+		fd:                  libseccomp.ScmpFd(fd),
+		state:               state,
+		forwardingPorts:     map[int]ForwardPortMapping{},
+		processes:           map[int]*processStatus{},
+		socketInodes:        map[uint64]int{},
+		listenerLocks:       map[uint64]*listenerLock{},
+		multinodeCache:      map[string]multinodeCacheEntry{},
+		reuseportGroups:     map[reuseportGroupKey]*reuseportGroup{},
+		memfds:              map[int]int{},
+		pidInfos:            map[int]pidInfo{},
+		pidfds:              map[int]int{},
+		ignoreBind:          h.ignoreBind,
+		bindAddressPolicy:   h.bindAddressPolicy,
+		connectInSupervisor: h.connectInSupervisor,
+		connectFallback:     h.connectFallback,
+		ioUringPolicy:       h.ioUringPolicy,
+		notifWorkers:        h.notifWorkers,
+		notifySendmsg:       config.notifySendmsg,
+	}
+	if config.ignoreBind != nil {
+		notifHandler.ignoreBind = *config.ignoreBind
+	}
+	ignoredSubnets, ignoredSubnetsAutoUpdate := h.ignoredSubnets, h.ignoredSubnetsAutoUpdate
+	if config.ignoredSubnets != nil {
+		ignoredSubnets, ignoredSubnetsAutoUpdate = config.ignoredSubnets, config.ignoredSubnetsAutoUpdate
+	}
+	notifHandler.ctx, notifHandler.cancel = gocontext.WithCancel(gocontext.Background())
+	stopfd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		logrus.WithError(err).Warn("failed to create eventfd. the handler cannot be handed over")
+		stopfd = -1
 	}
-	notifHandler.nonBypassable = nonbypassable.New(h.ignoredSubnets)
-	notifHandler.nonBypassableAutoUpdate = h.ignoredSubnetsAutoUpdate
+	notifHandler.stopfd = stopfd
+	notifHandler.stopped = make(chan struct{})
+	notifHandler.resumed = make(chan bool, 1)
+	notifHandler.done = make(chan struct{})
+	notifHandler.nonBypassable = nonbypassable.New(ignoredSubnets)
+	notifHandler.nonBypassableAutoUpdate = ignoredSubnetsAutoUpdate
 
+	forwardingPorts := h.forwardingPorts
+	if config.forwardingPorts != nil {
+		forwardingPorts = config.forwardingPorts
+	}
 	// Deep copy of map
-	for key, value := range h.forwardingPorts {
+	for key, value := range forwardingPorts {
 		notifHandler.forwardingPorts[key] = value
 	}
 
 	return &notifHandler
 }
 
-// StartHandle starts seccomp notif handler
+// StartHandle starts seccomp notif handler.
+// It returns when the containers are handed over with ServeHandover.
 func (h *Handler) StartHandle(c2cConfig *C2CConnectionHandleConfig, multinodeConfig *MultinodeConfig) {
 	logrus.Info("Waiting for seccomp file descriptors")
-	l, err := net.Listen("unix", h.socketPath)
-	if err != nil {
-		logrus.Fatalf("Cannot listen: %v", err)
+	l := h.listener
+	if l == nil {
+		var err error
+		l, err = net.Listen("unix", h.socketPath)
+		if err != nil {
+			logrus.Fatalf("Cannot listen: %v", err)
+		}
 	}
+	h.acceptMu.Lock()
+	h.listener = l
+	h.c2cConfig, h.multinodeConfig = c2cConfig, multinodeConfig
+	h.acceptMu.Unlock()
 	defer l.Close()
 
 	if h.readyFd >= 0 {
 		logrus.Infof("notify ready fd=%d", h.readyFd)
-		_, err = syscall.Write(h.readyFd, []byte{1})
+		_, err := syscall.Write(h.readyFd, []byte{1})
 		if err != nil {
 			logrus.Fatalf("failed to notify fd=%d", h.readyFd)
 		}
 		syscall.Close(h.readyFd)
 	}
 
-	// prepare tracer agent
-	var tracerAgent *tracer.Tracer = nil
+	h.acceptMu.Lock()
+	for _, r := range h.restored {
+		logrus.Infof("took over container %s (pid=%d, processes=%d)", util.ShrinkID(r.handler.state.State.ID), r.handler.state.Pid, len(r.handler.processes))
+		h.startNotifHandler(r.handler, r.config, c2cConfig, multinodeConfig)
+	}
+	h.restored = nil
+	h.acceptMu.Unlock()
+
+	h.accept(l)
+	<-h.handoverDone
+}
 
+// accept receives the seccomp fds from the listener until it is closed.
+func (h *Handler) accept(l net.Listener) {
 	for {
 		conn, err := l.Accept()
 		logrus.Info("accept connection")
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			logrus.Errorf("Cannot accept connection: %s", err)
 			continue
 		}
-		socket, err := conn.(*net.UnixConn).File()
-		conn.Close()
-		if err != nil {
-			logrus.Errorf("Cannot get socket: %v", err)
-			continue
+		h.acceptMu.Lock()
+		if h.handedOver {
+			logrus.Error("seccomp fd received during the handover is dropped")
+			conn.Close()
+		} else {
+			h.handleConnection(conn, h.c2cConfig, h.multinodeConfig)
+		}
+		h.acceptMu.Unlock()
+	}
+}
+
+// handleConnection receives the seccomp fd and starts handling it.
+func (h *Handler) handleConnection(conn net.Conn, c2cConfig *C2CConnectionHandleConfig, multinodeConfig *MultinodeConfig) {
+	socket, err := conn.(*net.UnixConn).File()
+	conn.Close()
+	if err != nil {
+		logrus.Errorf("Cannot get socket: %v", err)
+		return
+	}
+	newFd, state, err := handleNewMessage(int(socket.Fd()))
+	socket.Close()
+	if err != nil {
+		logrus.Errorf("Error receiving seccomp file descriptor: %v", err)
+		return
+	}
+
+	logrus.Infof("Received new seccomp fd: %v", newFd)
+	config, err := parseContainerConfig(state.Metadata, state.State.Annotations)
+	if err != nil {
+		// the container must not run with the ports or the subnets not configured as specified
+		logrus.WithError(err).Errorf("invalid configuration of container %s", state.State.ID)
+		failContainer(newFd, state)
+		return
+	}
+	if added, ok := h.added[state.State.ID]; ok {
+		config.withDefaults(added.config)
+	}
+	h.startNotifHandler(h.newNotifHandler(newFd, state, config), config, c2cConfig, multinodeConfig)
+}
+
+// failContainer kills the process of the container and closes its seccomp fd without handling it.
+func failContainer(fd uintptr, state *specs.ContainerProcessState) {
+	defer syscall.Close(int(fd))
+	// the pidfd is used not to kill the other process reusing the pid
+	pidfd, err := unix.PidfdOpen(state.Pid, 0)
+	if err == nil {
+		defer unix.Close(pidfd)
+		err = unix.PidfdSendSignal(pidfd, unix.SIGKILL, nil, 0)
+	}
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to kill the process %d of container %s", state.Pid, state.State.ID)
+		return
+	}
+	logrus.Warnf("container %s is killed", state.State.ID)
+}
+
+// startNotifHandler registers the handler to the container and starts handling after the background tasks are ready.
+func (h *Handler) startNotifHandler(notifHandler *notifHandler, config *containerConfig, c2cConfig *C2CConnectionHandleConfig, multinodeConfig *MultinodeConfig) {
+	var err error
+	state := notifHandler.state
+	notifHandler.ip = h.ip
+	logrus.Infof("%s is added to handle", notifHandler.ip)
+	notifHandler.c2cConnections, notifHandler.multinode = config.backgroundConfigs(c2cConfig, multinodeConfig)
+	if notifHandler.multinode.Enable {
+		notifHandler.multinode.etcdClientConfig = clientv3.Config{
+			Endpoints: []string{notifHandler.multinode.EtcdAddress},
 		}
-		newFd, state, err := handleNewMessage(int(socket.Fd()))
-		socket.Close()
+		notifHandler.multinode.etcdClient, err = clientv3.New(notifHandler.multinode.etcdClientConfig)
 		if err != nil {
-			logrus.Errorf("Error receiving seccomp file descriptor: %v", err)
-			continue
+			logrus.WithError(err).Fatal("failed to create etcd client")
 		}
+	}
 
-		logrus.Infof("Received new seccomp fd: %v", newFd)
-		notifHandler := h.newNotifHandler(newFd, state)
-		notifHandler.ip = h.ip
-		logrus.Infof("%s is added to handle", notifHandler.ip)
-		notifHandler.c2cConnections = c2cConfig
-		notifHandler.multinode = multinodeConfig
-		if notifHandler.multinode.Enable {
-			notifHandler.multinode.etcdClientConfig = clientv3.Config{
-				Endpoints: []string{notifHandler.multinode.EtcdAddress},
-			}
-			notifHandler.multinode.etcdClient, err = clientv3.New(notifHandler.multinode.etcdClientConfig)
-			if err != nil {
-				logrus.WithError(err).Fatal("failed to create etcd client")
+	cont, isNew := h.containers.register(notifHandler)
+	notifHandler.initProcess = isNew
+	if !isNew {
+		logrus.Infof("container %s sent another seccomp fd", util.ShrinkID(cont.id))
+	}
+
+	// the tracer agent is shared by the processes in the container
+	if notifHandler.c2cConnections.Enable && notifHandler.c2cConnections.TracerEnable && !notifHandler.multinode.Enable {
+		if cont.tracer == nil {
+			if err := cont.startTracer(tracerLogPath(h.tracerAgentLogPath, cont.id), state.Pid, notifHandler.forwardingPorts); err != nil {
+				logrus.WithError(err).Errorf("failed to start tracer for container %s. connections to other containers are not checked", util.ShrinkID(cont.id))
+				notifHandler.c2cConnections.TracerEnable = false
 			}
 		}
+	} else {
+		logrus.Infof("tracer is disabled")
+	}
 
-		// not to run multiple tracerAgent.
-		// TODO: prepare only one tracerAgent in Handler
-		if c2cConfig.TracerEnable && !multinodeConfig.Enable && tracerAgent == nil {
-			tracerAgent = tracer.NewTracer(h.tracerAgentLogPath)
-			err = tracerAgent.StartTracer(gocontext.TODO(), state.Pid)
-			if err != nil {
-				logrus.WithError(err).Fatalf("failed to start tracer")
-			}
-			fwdPorts := []int{}
-			for _, v := range notifHandler.forwardingPorts {
-				fwdPorts = append(fwdPorts, v.ChildPort)
-			}
-			err = tracerAgent.RegisterForwardPorts(fwdPorts)
-			if err != nil {
-				logrus.WithError(err).Fatalf("failed to register port")
+	if notifHandler.nonBypassableAutoUpdate {
+		notifHandler.goTask(func() {
+			if nbErr := notifHandler.nonBypassable.WatchNS(notifHandler.ctx, state.Pid); nbErr != nil {
+				logrus.WithError(nbErr).Fatalf("failed to watch NS (PID=%d)", state.Pid)
 			}
-			logrus.WithField("fwdPorts", fwdPorts).Info("registered ports to tracer agent")
-
-			// check tracer agent is ready
-			for _, v := range fwdPorts {
-				dst := fmt.Sprintf("127.0.0.1:%d", v)
-				addr, err := tracerAgent.ConnectToAddress([]string{dst})
-				if err != nil {
-					logrus.WithError(err).Warnf("failed to connect to %s", dst)
-					continue
-				}
-				if len(addr) != 1 || addr[0] != dst {
-					logrus.Fatalf("failed to connect to %s", dst)
-					continue
-				}
-				logrus.Debugf("successfully connected to %s", dst)
-			}
-			logrus.Infof("tracer is ready")
-		} else {
-			logrus.Infof("tracer is disabled")
-		}
+		})
+	}
 
-		// TODO: these goroutines shoud be launched only once.
-		ready := make(chan bool, 10)
-		if notifHandler.multinode.Enable {
-			go notifHandler.startBackgroundMultinodeTask(ready)
-		} else if notifHandler.c2cConnections.Enable {
-			go notifHandler.startBackgroundC2CConnectionHandleTask(ready, h.comSocketPath, tracerAgent)
-		} else {
-			ready <- true
-		}
+	// TODO: these goroutines shoud be launched only once.
+	ready := make(chan bool, 10)
+	if notifHandler.multinode.Enable {
+		notifHandler.goTask(func() { notifHandler.startBackgroundMultinodeTask(ready) })
+	} else if notifHandler.c2cConnections.Enable {
+		tracerAgent := cont.tracer
+		notifHandler.goTask(func() { notifHandler.startBackgroundC2CConnectionHandleTask(ready, h.comSocketPath, tracerAgent) })
+	} else {
+		ready <- true
+	}
+
+	// wait for background tasks becoming ready
+	<-ready
+	logrus.Info("background task is ready. start to handle")
+	go h.serve(notifHandler, cont)
+}
 
-		// wait for background tasks becoming ready
-		<-ready
-		logrus.Info("background task is ready. start to handle")
-		go notifHandler.handle()
+// serve handles the notifications until the container exits.
+// The container is removed when the last handler of it is stopped.
+func (h *Handler) serve(notifHandler *notifHandler, cont *container) {
+	for notifHandler.handle() {
+		notifHandler.stopped <- struct{}{}
+		if <-notifHandler.resumed {
+			// the container is handled by the new bypass4netns
+			notifHandler.cancel()
+			notifHandler.tasks.Wait()
+			notifHandler.release(false)
+			notifHandler.closeHandedOverFds()
+			notifHandler.finish()
+			return
+		}
+		logrus.Infof("handler of container %s is resumed", util.ShrinkID(cont.id))
+	}
+	notifHandler.finish()
+	last := h.containers.unregister(notifHandler)
+	notifHandler.release(last)
+	if last {
+		cont.stopTracer()
+		logrus.Infof("container %s is removed", util.ShrinkID(cont.id))
 	}
 }
 
@@ -895,15 +2368,16 @@ func (h *notifHandler) startBackgroundC2CConnectionHandleTask(ready chan bool, c
 	if err != nil {
 		logrus.Fatalf("failed to create ComClient: %q", err)
 	}
-	err = comClient.Ping(gocontext.TODO())
+	err = comClient.Ping(h.ctx)
 	if err != nil {
 		logrus.Fatalf("failed to connect to bypass4netnsd: %q", err)
 	}
 	logrus.Infof("Successfully connected to bypass4netnsd")
+	h.comClient = comClient
 	ifLastUpdateUnix := int64(0)
 	for {
 		if ifLastUpdateUnix+10 < time.Now().Unix() {
-			addrs, err := iproute2.GetAddressesInNetNS(gocontext.TODO(), h.state.Pid)
+			addrs, err := iproute2.GetAddressesInNetNS(h.ctx, h.state.Pid)
 			if err != nil {
 				logrus.WithError(err).Errorf("failed to get addresses")
 				return
@@ -921,8 +2395,9 @@ func (h *notifHandler) startBackgroundC2CConnectionHandleTask(ready chan bool, c
 			for _, v := range h.forwardingPorts {
 				containerIfs.ForwardingPorts[v.ChildPort] = v.HostPort
 			}
+			h.setContainerAddrs(ifs)
 			logrus.Debugf("Interfaces = %v", containerIfs)
-			_, err = comClient.PostInterface(gocontext.TODO(), containerIfs)
+			_, err = comClient.PostInterface(h.ctx, containerIfs)
 			if err != nil {
 				logrus.WithError(err).Errorf("failed to post interfaces")
 			} else {
@@ -930,7 +2405,7 @@ func (h *notifHandler) startBackgroundC2CConnectionHandleTask(ready chan bool, c
 				ifLastUpdateUnix = time.Now().Unix()
 			}
 		}
-		containerInterfaces, err := comClient.ListInterfaces(gocontext.TODO())
+		containerInterfaces, err := comClient.ListInterfaces(h.ctx)
 		if err != nil {
 			logrus.WithError(err).Warn("failed to list container interfaces")
 		}
@@ -943,11 +2418,11 @@ func (h *notifHandler) startBackgroundC2CConnectionHandleTask(ready chan bool, c
 						continue
 					}
 					for _, addr := range intf.Addresses {
-						// ignore ipv6 address
-						if addr.IP.To4() == nil {
+						// link-local addresses cannot be identified without the zone
+						if addr.IP.IsLinkLocalUnicast() {
 							continue
 						}
-						dstAddr := fmt.Sprintf("%s:%d", addr.IP, contPort)
+						dstAddr := net.JoinHostPort(addr.IP.String(), strconv.Itoa(contPort))
 						contIf, ok := h.containerInterfaces[dstAddr]
 						if ok && contIf.lastCheckedUnix+10 > time.Now().Unix() {
 							containerIf[dstAddr] = contIf
@@ -970,12 +2445,14 @@ func (h *notifHandler) startBackgroundC2CConnectionHandleTask(ready chan bool, c
 							hostPort:        hostPort,
 							lastCheckedUnix: time.Now().Unix(),
 						}
-						logrus.Infof("%s -> 127.0.0.1:%d is registered", dstAddr, hostPort)
+						logrus.Infof("%s -> loopback:%d is registered", dstAddr, hostPort)
 					}
 				}
 			}
 		}
+		h.containerAddrsMu.Lock()
 		h.containerInterfaces = containerIf
+		h.containerAddrsMu.Unlock()
 
 		// once the interfaces are registered, it is ready to handle connections
 		if !initDone {
@@ -983,7 +2460,11 @@ func (h *notifHandler) startBackgroundC2CConnectionHandleTask(ready chan bool, c
 			ready <- true
 		}
 
-		time.Sleep(1 * time.Second)
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-time.After(1 * time.Second):
+		}
 	}
 }
 
@@ -1015,39 +2496,124 @@ func iproute2AddressesToComInterfaces(addrs iproute2.Addresses) ([]com.Interface
 	return comIntfs, nil
 }
 
+// multinodeCacheTTL is the lifetime of the addresses looked up in etcd.
+// The addresses are registered with the lease of 15 seconds and refreshed every 10 seconds.
+const multinodeCacheTTL = 5 * time.Second
+
+// maxMultinodeCache limits the cached addresses before the expired ones are removed.
+const maxMultinodeCache = 1024
+
+type multinodeCacheEntry struct {
+	values []string
+	expiry time.Time
+}
+
+// lookupMultinode returns the host addresses registered in etcd for the container address.
+// The results are cached for multinodeCacheTTL.
+func (h *notifHandler) lookupMultinode(containerAddr string) ([]string, error) {
+	now := time.Now()
+	h.multinodeCacheMu.Lock()
+	entry, ok := h.multinodeCache[containerAddr]
+	h.multinodeCacheMu.Unlock()
+	if ok && now.Before(entry.expiry) {
+		return entry.values, nil
+	}
+
+	ctx, cancel := gocontext.WithTimeout(h.ctx, 2*time.Second)
+	res, err := h.multinode.etcdClient.Get(ctx, ETCD_MULTINODE_PREFIX+containerAddr)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	values := []string{}
+	for _, kv := range res.Kvs {
+		values = append(values, string(kv.Value))
+	}
+
+	h.multinodeCacheMu.Lock()
+	defer h.multinodeCacheMu.Unlock()
+	if len(h.multinodeCache) >= maxMultinodeCache {
+		for k, e := range h.multinodeCache {
+			if !now.Before(e.expiry) {
+				delete(h.multinodeCache, k)
+			}
+		}
+	}
+	h.multinodeCache[containerAddr] = multinodeCacheEntry{values: values, expiry: now.Add(multinodeCacheTTL)}
+	return values, nil
+}
+
+// prefetchMultinode looks up the destination of connect(2), sendto(2) or sendmsg(2) in etcd
+// before the process is locked, so that the other threads of the process are not blocked by etcd.
+func (h *notifHandler) prefetchMultinode(pid int, syscallName string, ctx *context) {
+	if !h.multinode.Enable {
+		return
+	}
+	args := ctx.req.Data.Args
+	var addrPtr, addrLen uint64
+	switch syscallName {
+	case "connect":
+		addrPtr, addrLen = args[1], args[2]
+	case "sendto":
+		addrPtr, addrLen = args[4], args[5]
+	case "sendmsg":
+		var err error
+		addrPtr, addrLen, err = h.readMsghdrName(pid, args[1], pointerSize(ctx.req.Data.Arch))
+		if err != nil {
+			return
+		}
+	default:
+		return
+	}
+	if addrPtr == 0 || addrLen == 0 {
+		return
+	}
+	destAddr, err := h.readSockaddrFromProcess(pid, addrPtr, addrLen)
+	if err != nil || !destAddr.IP.IsPrivate() {
+		return
+	}
+	if _, err := h.lookupMultinode(destAddr.String()); err != nil {
+		logrus.WithError(err).Debugf("failed to look up %s", destAddr)
+	}
+}
+
 func (h *notifHandler) startBackgroundMultinodeTask(ready chan bool) {
 	initDone := false
 	ifLastUpdateUnix := int64(0)
 	for {
 		if ifLastUpdateUnix+10 < time.Now().Unix() {
-			ifs, err := iproute2.GetAddressesInNetNS(gocontext.TODO(), h.state.Pid)
+			ifs, err := iproute2.GetAddressesInNetNS(h.ctx, h.state.Pid)
 			if err != nil {
 				logrus.WithError(err).Errorf("failed to get addresses")
 				return
 			}
+			// the entries are moved to the new lease and removed when the lease expires or is revoked.
+			ctx, cancel := gocontext.WithTimeout(h.ctx, 2*time.Second)
+			lease, err := h.multinode.etcdClient.Grant(ctx, 15)
+			cancel()
+			if err != nil {
+				logrus.WithError(err).Errorf("failed to grant lease to register addresses")
+				ifs = nil
+			} else {
+				h.multinodeLease = lease.ID
+			}
 			for _, intf := range ifs {
 				// ignore non-ethernet interface
 				if intf.LinkType != "ether" {
 					continue
 				}
 				for _, addr := range intf.AddrInfos {
-					// ignore non-IPv4 address
-					if addr.Family != "inet" {
+					// ignore non-IP address and link-local address which cannot be identified without the zone
+					if addr.Family != "inet" && addr.Family != "inet6" {
+						continue
+					}
+					if ip := net.ParseIP(addr.Local); ip == nil || ip.IsLinkLocalUnicast() {
 						continue
 					}
 					for _, v := range h.forwardingPorts {
-						containerAddr := fmt.Sprintf("%s:%d", addr.Local, v.ChildPort)
-						hostAddr := fmt.Sprintf("%s:%d", h.multinode.HostAddress, v.HostPort)
-						// Remove entries with timeout
-						// TODO: Remove related entries when exiting.
-						ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 2*time.Second)
-						lease, err := h.multinode.etcdClient.Grant(ctx, 15)
-						cancel()
-						if err != nil {
-							logrus.WithError(err).Errorf("failed to grant lease to register %s -> %s", containerAddr, hostAddr)
-							continue
-						}
-						ctx, cancel = gocontext.WithTimeout(gocontext.Background(), 2*time.Second)
+						containerAddr := net.JoinHostPort(addr.Local, strconv.Itoa(v.ChildPort))
+						hostAddr := net.JoinHostPort(h.multinode.HostAddress, strconv.Itoa(v.HostPort))
+						ctx, cancel := gocontext.WithTimeout(h.ctx, 2*time.Second)
 						_, err = h.multinode.etcdClient.Put(ctx, ETCD_MULTINODE_PREFIX+containerAddr, hostAddr,
 							clientv3.WithLease(lease.ID))
 						cancel()
@@ -1068,6 +2634,10 @@ func (h *notifHandler) startBackgroundMultinodeTask(ready chan bool) {
 			}
 		}
 
-		time.Sleep(1 * time.Second)
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-time.After(1 * time.Second):
+		}
 	}
 }
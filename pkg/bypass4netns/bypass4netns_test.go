@@ -0,0 +1,281 @@
+package bypass4netns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	libseccomp "github.com/seccomp/libseccomp-golang"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestCloseStateFds(t *testing.T) {
+	var p [2]int
+	assert.Equal(t, nil, unix.Pipe2(p[:], unix.O_CLOEXEC))
+	closeStateFds(p[:])
+	// the received fds are closed, not the fds numbered by their indices
+	for _, fd := range p {
+		_, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+		assert.Equal(t, unix.EBADF, err)
+	}
+}
+
+func TestWaitNotif(t *testing.T) {
+	// a pipe is polled like a seccomp fd. POLLHUP means no process uses the filter.
+	var p [2]int
+	assert.Equal(t, nil, unix.Pipe2(p[:], unix.O_CLOEXEC))
+	defer unix.Close(p[0])
+	h := newTestNotifHandler(t, "container", 100, &containerConfig{})
+	h.fd = libseccomp.ScmpFd(p[0])
+
+	_, err := unix.Write(p[1], []byte{0})
+	assert.Equal(t, nil, err)
+	res, err := h.waitNotif(-1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, notifReceived, res)
+
+	_, err = unix.Read(p[0], make([]byte, 1))
+	assert.Equal(t, nil, err)
+	unix.Close(p[1])
+	res, err = h.waitNotif(-1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, notifExited, res)
+}
+
+func TestWaitNotifInitExit(t *testing.T) {
+	var p [2]int
+	assert.Equal(t, nil, unix.Pipe2(p[:], unix.O_CLOEXEC))
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+	h := newTestNotifHandler(t, "container", 100, &containerConfig{})
+	h.fd = libseccomp.ScmpFd(p[0])
+
+	cmd := exec.Command("sleep", "10")
+	assert.Equal(t, nil, cmd.Start())
+	pidfd, err := unix.PidfdOpen(cmd.Process.Pid, 0)
+	if errors.Is(err, unix.ENOSYS) {
+		cmd.Process.Kill()
+		t.Skip("pidfd_open is not supported")
+	}
+	assert.Equal(t, nil, err)
+	defer unix.Close(pidfd)
+
+	result := make(chan notifWaitResult, 1)
+	go func() {
+		res, err := h.waitNotif(pidfd)
+		assert.Equal(t, nil, err)
+		result <- res
+	}()
+	assert.Equal(t, nil, cmd.Process.Kill())
+	select {
+	case res := <-result:
+		assert.Equal(t, notifExited, res)
+	case <-time.After(5 * time.Second):
+		t.Fatal("exit of the init process is not detected")
+	}
+	cmd.Wait()
+}
+
+func TestStopResume(t *testing.T) {
+	var p [2]int
+	assert.Equal(t, nil, unix.Pipe2(p[:], unix.O_CLOEXEC))
+	defer unix.Close(p[1])
+	h := newTestNotifHandler(t, "container", 100, &containerConfig{})
+	// p[0] is closed by the handler handed over
+	h.fd = libseccomp.ScmpFd(p[0])
+	handler := NewHandler("", "", "", false, "")
+	cont, _ := handler.containers.register(h)
+	go handler.serve(h, cont)
+
+	assert.True(t, h.stop())
+	h.resume(false)
+	// the resumed handler can be stopped again
+	assert.True(t, h.stop())
+	h.resume(true)
+	<-h.done
+	assert.Equal(t, -1, h.stopfd)
+	assert.False(t, h.stop())
+	// the container is left for the new bypass4netns
+	assert.Equal(t, 1, len(handler.ListContainers()))
+	_, err := unix.FcntlInt(uintptr(p[0]), unix.F_GETFD, 0)
+	assert.Equal(t, unix.EBADF, err)
+}
+
+// firstMapping returns the start address of the first mapping of the process, i.e. its executable.
+func firstMapping(t *testing.T, pid int) uint64 {
+	maps, err := os.ReadFile(fmt.Sprintf("/proc/%d/maps", pid))
+	assert.Equal(t, nil, err)
+	start, _, _ := strings.Cut(string(maps), "-")
+	addr, err := strconv.ParseUint(start, 16, 64)
+	assert.Equal(t, nil, err)
+	return addr
+}
+
+func TestHandleSysExecveMem(t *testing.T) {
+	h := newTestNotifHandler(t, "container", 100, &containerConfig{})
+	cmd := exec.Command("sh", "-c", "read line; exec sleep 10")
+	stdin, err := cmd.StdinPipe()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, cmd.Start())
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+
+	buf, err := h.readProcMem(pid, firstMapping(t, pid), 4)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte("\x7fELF"), buf)
+	assert.Equal(t, 1, len(h.memfds))
+
+	h.handleSysExecve(pid)
+	assert.Equal(t, 0, len(h.memfds))
+	_, err = stdin.Write([]byte("\n"))
+	assert.Equal(t, nil, err)
+	assert.Eventually(t, func() bool {
+		comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+		return err == nil && string(comm) == "sleep\n"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the memory of the new program is read
+	buf, err = h.readProcMem(pid, firstMapping(t, pid), 4)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte("\x7fELF"), buf)
+}
+
+func TestDropExitedThread(t *testing.T) {
+	h := newTestNotifHandler(t, "container", 100, &containerConfig{})
+	pid := os.Getpid()
+	tid := unix.Gettid()
+	h.pidInfos[tid] = pidInfo{pidType: THREAD, tgid: pid, pidfd: -1}
+	// no thread has the tid in the thread group of the test process
+	h.pidInfos[1<<22+1] = pidInfo{pidType: THREAD, tgid: pid, pidfd: -1}
+
+	// the cached entries are returned as they are
+	info, err := h.getPidFdInfo(1<<22 + 1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, pid, info.tgid)
+
+	h.dropExitedThread(tid)
+	h.dropExitedThread(1<<22 + 1)
+	_, ok := h.pidInfos[tid]
+	assert.Equal(t, true, ok)
+	_, ok = h.pidInfos[1<<22+1]
+	assert.Equal(t, false, ok)
+}
+
+func TestReadMsghdrPayload(t *testing.T) {
+	h := newTestNotifHandler(t, "container", 100, &containerConfig{})
+	first := []byte("hello, ")
+	second := []byte("world")
+	control := []byte("control")
+	iovs := []unix.Iovec{{Base: &first[0]}, {Base: &second[0]}}
+	iovs[0].SetLen(len(first))
+	iovs[1].SetLen(len(second))
+	// msg is allocated in the heap not to be moved with the stack while it is read
+	msg := &unix.Msghdr{Iov: &iovs[0], Control: &control[0]}
+	t.Cleanup(func() { runtime.KeepAlive(msg) })
+	msg.SetIovlen(len(iovs))
+	msg.SetControllen(len(control))
+
+	data, oob, err := h.readMsghdrPayload(os.Getpid(), uint64(uintptr(unsafe.Pointer(msg))), int(unsafe.Sizeof(uintptr(0))), 64)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte("hello, world"), data)
+	assert.Equal(t, control, oob)
+
+	// the data is truncated
+	data, _, err = h.readMsghdrPayload(os.Getpid(), uint64(uintptr(unsafe.Pointer(msg))), int(unsafe.Sizeof(uintptr(0))), 9)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte("hello, wo"), data)
+}
+
+func TestForkSnapshot(t *testing.T) {
+	h := newTestNotifHandler(t, "container", 100, &containerConfig{})
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	assert.Equal(t, nil, err)
+	f := os.NewFile(uintptr(fd), "socket")
+	defer f.Close()
+	ino, err := fileInode(fd)
+	assert.Equal(t, nil, err)
+
+	pid := os.Getpid()
+	proc := h.registerProcess(pid)
+	defer h.removeProcess(pid)
+	sock := newSocketStatus(pid, fd, unix.AF_INET, unix.SOCK_STREAM, 0, false)
+	sock.ino = ino
+	sock.fds[fd] = false
+	proc.sockets[fd] = sock
+
+	// clone(2) for threads does not take the snapshot
+	ctx := &context{req: &libseccomp.ScmpNotifReq{Data: libseccomp.ScmpNotifData{Args: []uint64{unix.CLONE_VM | unix.CLONE_THREAD}}}}
+	h.handleSysFork(pid, ctx, "clone")
+	assert.Equal(t, true, proc.forkSnapshot == nil)
+
+	h.handleSysFork(pid, &context{req: &libseccomp.ScmpNotifReq{}}, "fork")
+	assert.Equal(t, 1, len(proc.forkSnapshot))
+	// the option set after fork(2) is not inherited
+	sock.socketOptions = append(sock.socketOptions, socketOption{level: unix.SOL_SOCKET, optname: unix.SO_KEEPALIVE})
+
+	cmd := exec.Command("sleep", "10")
+	cmd.ExtraFiles = make([]*os.File, fd-2)
+	cmd.ExtraFiles[fd-3] = f
+	assert.Equal(t, nil, cmd.Start())
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	child := h.registerProcess(cmd.Process.Pid)
+	defer h.removeProcess(cmd.Process.Pid)
+	inherited, ok := child.sockets[fd]
+	assert.Equal(t, true, ok)
+	assert.Equal(t, cmd.Process.Pid, inherited.pid)
+	assert.Equal(t, 0, len(inherited.socketOptions))
+}
+
+func TestFailContainer(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	assert.Equal(t, nil, cmd.Start())
+	fd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	assert.Equal(t, nil, err)
+
+	failContainer(uintptr(fd), &specs.ContainerProcessState{Pid: cmd.Process.Pid, State: specs.State{ID: "container"}})
+	err = cmd.Wait()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, syscall.SIGKILL, cmd.ProcessState.Sys().(syscall.WaitStatus).Signal())
+	// the seccomp fd is closed
+	_, err = unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+	assert.Equal(t, unix.EBADF, err)
+}
+
+func TestTeardown(t *testing.T) {
+	h := newTestNotifHandler(t, "container", 100, &containerConfig{})
+	memfd, err := unix.Open("/dev/null", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	assert.Equal(t, nil, err)
+	h.memfds[100] = memfd
+	h.processes[100] = &processStatus{sockets: map[int]*socketStatus{}}
+
+	stopped := false
+	h.goTask(func() {
+		<-h.ctx.Done()
+		stopped = true
+	})
+
+	h.teardown()
+	assert.True(t, stopped)
+	assert.Equal(t, 0, len(h.processes))
+	assert.Equal(t, 0, len(h.memfds))
+	// the fd is closed
+	_, err = unix.FcntlInt(uintptr(memfd), unix.F_GETFD, 0)
+	assert.Equal(t, unix.EBADF, err)
+}
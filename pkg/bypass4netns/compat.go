@@ -0,0 +1,107 @@
+package bypass4netns
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	libseccomp "github.com/seccomp/libseccomp-golang"
+)
+
+// pointerSize returns the size of pointers and longs in the ABI of the architecture.
+// 32-bit binaries on 64-bit hosts (e.g. i386 and x32 on x86_64) use the compat ABI.
+func pointerSize(arch libseccomp.ScmpArch) int {
+	switch arch {
+	case libseccomp.ArchX86, libseccomp.ArchX32, libseccomp.ArchARM,
+		libseccomp.ArchMIPS, libseccomp.ArchMIPSEL, libseccomp.ArchMIPS64N32, libseccomp.ArchMIPSEL64N32,
+		libseccomp.ArchPPC, libseccomp.ArchS390, libseccomp.ArchPARISC:
+		return 4
+	default:
+		return 8
+	}
+}
+
+// socketcallCall is the call of socketcall(2) in linux/net.h.
+type socketcallCall struct {
+	name  string
+	nargs int
+}
+
+// socketcallCalls are indexed by the call number (SYS_SOCKET=1, SYS_BIND=2, ...).
+// send(2) is sendto(2) without the destination. recv(2) is recvfrom(2) without the source.
+var socketcallCalls = []socketcallCall{
+	{},
+	{"socket", 3},
+	{"bind", 3},
+	{"connect", 3},
+	{"listen", 2},
+	{"accept", 3},
+	{"getsockname", 3},
+	{"getpeername", 3},
+	{"socketpair", 4},
+	{"sendto", 4},   // SYS_SEND
+	{"recvfrom", 4}, // SYS_RECV
+	{"sendto", 6},
+	{"recvfrom", 6},
+	{"shutdown", 2},
+	{"setsockopt", 5},
+	{"getsockopt", 5},
+	{"sendmsg", 3},
+	{"recvmsg", 3},
+	{"accept4", 4},
+	{"recvmmsg", 5},
+	{"sendmmsg", 4},
+}
+
+// socketcallArgsSize returns the size of the arguments of the call in the process memory.
+func socketcallArgsSize(call uint64, ptrSize int) (int, error) {
+	if call == 0 || call >= uint64(len(socketcallCalls)) {
+		return 0, fmt.Errorf("unknown socketcall %d", call)
+	}
+	return socketcallCalls[call].nargs * ptrSize, nil
+}
+
+// decodePointer decodes a pointer or size_t value of the process's architecture.
+func decodePointer(buf []byte, ptrSize int, order binary.ByteOrder) uint64 {
+	if ptrSize == 4 {
+		return uint64(order.Uint32(buf[0:4]))
+	}
+	return order.Uint64(buf[0:8])
+}
+
+// decodeSocketcall decodes the arguments of socketcall(2) read from the process memory.
+// The arguments missing in buf (e.g. the destination of SYS_SEND) are zero.
+func decodeSocketcall(call uint64, buf []byte, ptrSize int, order binary.ByteOrder) (string, []uint64, error) {
+	size, err := socketcallArgsSize(call, ptrSize)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(buf) < size {
+		return "", nil, fmt.Errorf("socketcall arguments are too short: %d bytes", len(buf))
+	}
+	args := make([]uint64, 6)
+	for i := 0; i < size/ptrSize; i++ {
+		args[i] = decodePointer(buf[i*ptrSize:], ptrSize, order)
+	}
+	return socketcallCalls[call].name, args, nil
+}
+
+// demuxSocketcall replaces socketcall(2) in the request with the multiplexed syscall.
+// int socketcall(int call, unsigned long *args)
+func (h *notifHandler) demuxSocketcall(ctx *context) (string, error) {
+	call := ctx.req.Data.Args[0]
+	ptrSize := pointerSize(ctx.req.Data.Arch)
+	size, err := socketcallArgsSize(call, ptrSize)
+	if err != nil {
+		return "", err
+	}
+	buf, err := h.readProcMem(int(ctx.req.Pid), ctx.req.Data.Args[1], uint64(size))
+	if err != nil {
+		return "", fmt.Errorf("failed to read socketcall arguments: %w", err)
+	}
+	name, args, err := decodeSocketcall(call, buf, ptrSize, binary.NativeEndian)
+	if err != nil {
+		return "", err
+	}
+	ctx.req.Data.Args = args
+	return name, nil
+}
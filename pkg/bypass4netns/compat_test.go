@@ -0,0 +1,117 @@
+package bypass4netns
+
+import (
+	"encoding/binary"
+	"testing"
+
+	libseccomp "github.com/seccomp/libseccomp-golang"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPointerSize(t *testing.T) {
+	assert.Equal(t, 8, pointerSize(libseccomp.ArchAMD64))
+	assert.Equal(t, 8, pointerSize(libseccomp.ArchARM64))
+	assert.Equal(t, 4, pointerSize(libseccomp.ArchX86))
+	assert.Equal(t, 4, pointerSize(libseccomp.ArchARM))
+}
+
+func TestDecodeSocketcall(t *testing.T) {
+	// connect(3, 0x1000, 16)
+	buf32le := []byte{3, 0, 0, 0, 0, 0x10, 0, 0, 16, 0, 0, 0}
+	name, args, err := decodeSocketcall(3, buf32le, 4, binary.LittleEndian)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "connect", name)
+	assert.Equal(t, []uint64{3, 0x1000, 16, 0, 0, 0}, args)
+
+	buf32be := []byte{0, 0, 0, 3, 0, 0, 0x10, 0, 0, 0, 0, 16}
+	name, args, err = decodeSocketcall(3, buf32be, 4, binary.BigEndian)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "connect", name)
+	assert.Equal(t, []uint64{3, 0x1000, 16, 0, 0, 0}, args)
+
+	buf64le := make([]byte, 24)
+	binary.LittleEndian.PutUint64(buf64le[0:], 3)
+	binary.LittleEndian.PutUint64(buf64le[8:], 0x1000)
+	binary.LittleEndian.PutUint64(buf64le[16:], 16)
+	name, args, err = decodeSocketcall(2, buf64le, 8, binary.LittleEndian)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "bind", name)
+	assert.Equal(t, []uint64{3, 0x1000, 16, 0, 0, 0}, args)
+
+	// SYS_SEND is sendto(2) without the destination
+	bufSend := []byte{3, 0, 0, 0, 0, 0x10, 0, 0, 5, 0, 0, 0, 0, 0, 0, 0}
+	name, args, err = decodeSocketcall(9, bufSend, 4, binary.LittleEndian)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "sendto", name)
+	assert.Equal(t, []uint64{3, 0x1000, 5, 0, 0, 0}, args)
+
+	_, _, err = decodeSocketcall(0, buf32le, 4, binary.LittleEndian)
+	assert.NotEqual(t, nil, err)
+	_, _, err = decodeSocketcall(21, buf32le, 4, binary.LittleEndian)
+	assert.NotEqual(t, nil, err)
+	_, _, err = decodeSocketcall(3, buf32le[:8], 4, binary.LittleEndian)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDecodeMsghdrName(t *testing.T) {
+	ptr, length, err := decodeMsghdrName([]byte{0, 0x10, 0, 0, 16, 0, 0, 0}, 4, binary.LittleEndian)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(0x1000), ptr)
+	assert.Equal(t, uint64(16), length)
+
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint64(buf[0:], 0x7fff0000)
+	binary.BigEndian.PutUint32(buf[8:], 28)
+	ptr, length, err = decodeMsghdrName(buf, 8, binary.BigEndian)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(0x7fff0000), ptr)
+	assert.Equal(t, uint64(28), length)
+
+	_, _, err = decodeMsghdrName(buf, 4, binary.BigEndian)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDecodeMsghdrPayload(t *testing.T) {
+	buf := make([]byte, 24)
+	binary.LittleEndian.PutUint32(buf[8:], 0x1000)
+	binary.LittleEndian.PutUint32(buf[12:], 2)
+	binary.LittleEndian.PutUint32(buf[16:], 0x2000)
+	binary.LittleEndian.PutUint32(buf[20:], 20)
+	iovPtr, iovLen, controlPtr, controlLen, err := decodeMsghdrPayload(buf, 4, binary.LittleEndian)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(0x1000), iovPtr)
+	assert.Equal(t, uint64(2), iovLen)
+	assert.Equal(t, uint64(0x2000), controlPtr)
+	assert.Equal(t, uint64(20), controlLen)
+
+	buf = make([]byte, 48)
+	binary.BigEndian.PutUint64(buf[16:], 0x7fff0000)
+	binary.BigEndian.PutUint64(buf[24:], 1)
+	iovPtr, iovLen, controlPtr, controlLen, err = decodeMsghdrPayload(buf, 8, binary.BigEndian)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(0x7fff0000), iovPtr)
+	assert.Equal(t, uint64(1), iovLen)
+	assert.Equal(t, uint64(0), controlPtr)
+	assert.Equal(t, uint64(0), controlLen)
+
+	_, _, _, _, err = decodeMsghdrPayload(buf, 4, binary.BigEndian)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDecodeIovecs(t *testing.T) {
+	buf := make([]byte, 32)
+	binary.LittleEndian.PutUint64(buf[0:], 0x1000)
+	binary.LittleEndian.PutUint64(buf[8:], 5)
+	binary.LittleEndian.PutUint64(buf[16:], 0x2000)
+	binary.LittleEndian.PutUint64(buf[24:], 7)
+	iovs, err := decodeIovecs(buf, 8, binary.LittleEndian)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []iovec{{base: 0x1000, len: 5}, {base: 0x2000, len: 7}}, iovs)
+
+	iovs, err = decodeIovecs(buf[:16], 4, binary.LittleEndian)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []iovec{{base: 0x1000, len: 0}, {base: 5, len: 0}}, iovs)
+
+	_, err = decodeIovecs(buf[:12], 8, binary.LittleEndian)
+	assert.NotEqual(t, nil, err)
+}
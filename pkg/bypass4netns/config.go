@@ -0,0 +1,349 @@
+package bypass4netns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/sirupsen/logrus"
+)
+
+// Annotations in the OCI state configuring the container.
+// They override the listener metadata and the command line flags.
+const (
+	// AnnotationNerdctlPorts is the ports published by nerdctl, in JSON.
+	// It is ignored when AnnotationPublish is set.
+	AnnotationNerdctlPorts = "nerdctl/ports"
+	// AnnotationPublish is a comma separated list of "[parentIP:]hostPort:childPort".
+	AnnotationPublish = "bypass4netns/publish"
+	// AnnotationIgnore is a comma separated list of the subnets to ignore, or "auto".
+	AnnotationIgnore = "bypass4netns/ignore"
+	// AnnotationHandleC2CConnections is "true" or "false".
+	AnnotationHandleC2CConnections = "bypass4netns/handle-c2c-connections"
+	// AnnotationMultinode is "true" or "false".
+	AnnotationMultinode = "bypass4netns/multinode"
+	// AnnotationNotifySendmsg is "true" when the seccomp profile notifies every sendmsg(2).
+	// It is set in the listener metadata by oci.TranslateSeccompProfileWithOptions and ignored in the annotations,
+	// because it must match the seccomp profile.
+	AnnotationNotifySendmsg = "bypass4netns/notify-sendmsg"
+)
+
+// annotationPrefix is stripped from the annotations to get the keys in the listener metadata.
+const annotationPrefix = "bypass4netns/"
+
+// containerConfig is the configuration of a container.
+// The fields not configured are nil and the defaults of Handler are used.
+type containerConfig struct {
+	// key is child port
+	forwardingPorts          map[int]ForwardPortMapping
+	ignoredSubnets           []net.IPNet
+	ignoredSubnetsAutoUpdate bool
+	handleC2CConnections     *bool
+	multinode                *bool
+	ignoreBind               *bool
+	notifySendmsg            bool
+}
+
+// nerdctlPortMapping is an element of AnnotationNerdctlPorts.
+type nerdctlPortMapping struct {
+	HostPort      int32
+	ContainerPort int32
+	Protocol      string
+	HostIP        string
+}
+
+// parseContainerConfig parses the listener metadata and the annotations in the OCI state.
+// The listener metadata is a semicolon separated list of "key=value" like
+// "publish=8080:80,8443:443;ignore=127.0.0.0/8,auto". The keys are the annotations without "bypass4netns/".
+func parseContainerConfig(metadata string, annotations map[string]string) (*containerConfig, error) {
+	values := map[string]string{}
+	for _, kv := range strings.Split(metadata, ";") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid listener metadata %q", kv)
+		}
+		values[annotationPrefix+k] = v
+	}
+	for k, v := range annotations {
+		if k == AnnotationNotifySendmsg {
+			logrus.Warnf("annotation %q is ignored. it is set in the listener metadata of the seccomp profile", k)
+			continue
+		}
+		if strings.HasPrefix(k, annotationPrefix) || k == AnnotationNerdctlPorts {
+			values[k] = v
+		}
+	}
+
+	config := &containerConfig{}
+	for k, v := range values {
+		var err error
+		switch k {
+		case AnnotationNerdctlPorts:
+			if _, ok := values[AnnotationPublish]; ok {
+				continue
+			}
+			config.forwardingPorts, err = parseNerdctlPorts(v)
+		case AnnotationPublish:
+			config.forwardingPorts, err = parseForwardPortMappings(v)
+		case AnnotationIgnore:
+			var subnets []string
+			if v != "" {
+				subnets = strings.Split(v, ",")
+			}
+			config.ignoredSubnets, config.ignoredSubnetsAutoUpdate, err = ParseIgnoredSubnets(subnets)
+		case AnnotationHandleC2CConnections:
+			config.handleC2CConnections, err = parseBoolPtr(v)
+		case AnnotationMultinode:
+			config.multinode, err = parseBoolPtr(v)
+		case AnnotationNotifySendmsg:
+			config.notifySendmsg, err = strconv.ParseBool(v)
+		default:
+			logrus.Warnf("unknown configuration %q is ignored", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", k, err)
+		}
+	}
+	return config, nil
+}
+
+func parseBoolPtr(s string) (*bool, error) {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// parseNerdctlPorts parses AnnotationNerdctlPorts.
+// The forwarded ports are not distinguished by the protocol, so the mappings of the protocols are merged.
+// The mapping of tcp is preferred when the mapping of the other protocol conflicts with it.
+func parseNerdctlPorts(s string) (map[int]ForwardPortMapping, error) {
+	var mappings []nerdctlPortMapping
+	if err := json.Unmarshal([]byte(s), &mappings); err != nil {
+		return nil, err
+	}
+	// key is the protocol
+	portsByProto := map[string]map[int]ForwardPortMapping{}
+	for _, m := range mappings {
+		mapping := ForwardPortMapping{
+			HostPort:  int(m.HostPort),
+			ChildPort: int(m.ContainerPort),
+		}
+		if m.HostIP != "" {
+			mapping.ParentIP = net.ParseIP(m.HostIP)
+			if mapping.ParentIP == nil {
+				return nil, fmt.Errorf("invalid host IP %q", m.HostIP)
+			}
+			if mapping.ParentIP.IsUnspecified() {
+				mapping.ParentIP = nil
+			}
+		}
+		proto := strings.ToLower(m.Protocol)
+		if proto == "" {
+			proto = "tcp"
+		}
+		if portsByProto[proto] == nil {
+			portsByProto[proto] = map[int]ForwardPortMapping{}
+		}
+		if err := addForwardingPort(portsByProto[proto], mapping); err != nil {
+			return nil, fmt.Errorf("%s: %w", proto, err)
+		}
+	}
+
+	ports := map[int]ForwardPortMapping{}
+	for _, mapping := range portsByProto["tcp"] {
+		ports[mapping.ChildPort] = mapping
+	}
+	protos := []string{}
+	for proto := range portsByProto {
+		if proto != "tcp" {
+			protos = append(protos, proto)
+		}
+	}
+	sort.Strings(protos)
+	for _, proto := range protos {
+		for _, mapping := range portsByProto[proto] {
+			if err := addForwardingPort(ports, mapping); err != nil {
+				logrus.WithError(err).Warnf("%s port mapping %d:%d is ignored", proto, mapping.HostPort, mapping.ChildPort)
+			}
+		}
+	}
+	return ports, nil
+}
+
+func parseForwardPortMappings(s string) (map[int]ForwardPortMapping, error) {
+	ports := map[int]ForwardPortMapping{}
+	if s == "" {
+		return ports, nil
+	}
+	for _, str := range strings.Split(s, ",") {
+		mapping, err := ParseForwardPortMapping(str)
+		if err != nil {
+			return nil, err
+		}
+		if err := addForwardingPort(ports, mapping); err != nil {
+			return nil, err
+		}
+	}
+	return ports, nil
+}
+
+// addForwardingPort adds the mapping unless the host port or the child port is already forwarded.
+func addForwardingPort(ports map[int]ForwardPortMapping, mapping ForwardPortMapping) error {
+	for _, fwd := range ports {
+		if fwd.HostPort == mapping.HostPort && fwd.ChildPort == mapping.ChildPort && fwd.ParentIP.Equal(mapping.ParentIP) {
+			return nil
+		}
+		if fwd.HostPort == mapping.HostPort {
+			return fmt.Errorf("host port %d is already forwarded", fwd.HostPort)
+		}
+		if fwd.ChildPort == mapping.ChildPort {
+			return fmt.Errorf("container port %d is already forwarded", fwd.ChildPort)
+		}
+	}
+	ports[mapping.ChildPort] = mapping
+	return nil
+}
+
+// ParseForwardPortMapping parses "[parentIP:]hostPort:childPort".
+func ParseForwardPortMapping(s string) (ForwardPortMapping, error) {
+	// the parent IP can be IPv6 address like "[::1]:8080:80"
+	var parentIP net.IP
+	portsStr := s
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		if j := strings.LastIndex(s[:i], ":"); j >= 0 {
+			ipStr := strings.TrimSuffix(strings.TrimPrefix(s[:j], "["), "]")
+			parentIP = net.ParseIP(ipStr)
+			if parentIP == nil {
+				return ForwardPortMapping{}, fmt.Errorf("invalid parent IP %s in '%s'", ipStr, s)
+			}
+			portsStr = s[j+1:]
+		}
+	}
+	ports := strings.Split(portsStr, ":")
+	if len(ports) != 2 {
+		return ForwardPortMapping{}, fmt.Errorf("invalid publish port format: '%s'", s)
+	}
+	hostPort, err := strconv.Atoi(ports[0])
+	if err != nil {
+		return ForwardPortMapping{}, fmt.Errorf("not interger %s in '%s'", ports[0], s)
+	}
+	childPort, err := strconv.Atoi(ports[1])
+	if err != nil {
+		return ForwardPortMapping{}, fmt.Errorf("not interger %s in '%s'", ports[1], s)
+	}
+	return ForwardPortMapping{
+		ParentIP:  parentIP,
+		HostPort:  hostPort,
+		ChildPort: childPort,
+	}, nil
+}
+
+// ParseIgnoredSubnets parses the CIDRs to ignore. "auto" enables the auto-update of the subnets.
+func ParseIgnoredSubnets(ss []string) ([]net.IPNet, bool, error) {
+	subnets := []net.IPNet{}
+	var auto bool
+	for _, s := range ss {
+		switch s {
+		case "auto":
+			if auto {
+				logrus.Warn("\"auto\" appeared multiple times in the subnets to ignore")
+			}
+			auto = true
+		default:
+			_, subnet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, false, fmt.Errorf("%s is not CIDR format", s)
+			}
+			subnets = append(subnets, *subnet)
+		}
+	}
+	return subnets, auto, nil
+}
+
+// specContainerConfig returns the configuration of the container added with the spec.
+func specContainerConfig(spec *api.BypassSpec) (*containerConfig, error) {
+	ignoreBind := spec.IgnoreBind
+	config := &containerConfig{
+		ignoreBind: &ignoreBind,
+	}
+	if len(spec.PortMapping) > 0 {
+		config.forwardingPorts = map[int]ForwardPortMapping{}
+		for _, p := range spec.PortMapping {
+			mapping := ForwardPortMapping{
+				HostPort:  p.ParentPort,
+				ChildPort: p.ChildPort,
+			}
+			if p.ParentIP != "" {
+				mapping.ParentIP = net.ParseIP(p.ParentIP)
+				if mapping.ParentIP == nil {
+					return nil, fmt.Errorf("invalid parent IP %q", p.ParentIP)
+				}
+				if mapping.ParentIP.IsUnspecified() {
+					mapping.ParentIP = nil
+				}
+			}
+			if err := addForwardingPort(config.forwardingPorts, mapping); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(spec.IgnoreSubnets) > 0 {
+		var err error
+		config.ignoredSubnets, config.ignoredSubnetsAutoUpdate, err = ParseIgnoredSubnets(spec.IgnoreSubnets)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// withDefaults sets the fields not configured to the ones of defaults.
+func (c *containerConfig) withDefaults(defaults *containerConfig) {
+	if c.forwardingPorts == nil {
+		c.forwardingPorts = defaults.forwardingPorts
+	}
+	if c.ignoredSubnets == nil {
+		c.ignoredSubnets, c.ignoredSubnetsAutoUpdate = defaults.ignoredSubnets, defaults.ignoredSubnetsAutoUpdate
+	}
+	if c.handleC2CConnections == nil {
+		c.handleC2CConnections = defaults.handleC2CConnections
+	}
+	if c.multinode == nil {
+		c.multinode = defaults.multinode
+	}
+	if c.ignoreBind == nil {
+		c.ignoreBind = defaults.ignoreBind
+	}
+}
+
+// backgroundConfigs returns the configurations of the c2c connections and the multinode communication of the container.
+// The configs are copied not to share the etcd client between the containers.
+func (c *containerConfig) backgroundConfigs(c2cConfig *C2CConnectionHandleConfig, multinodeConfig *MultinodeConfig) (*C2CConnectionHandleConfig, *MultinodeConfig) {
+	c2c := *c2cConfig
+	if c.handleC2CConnections != nil {
+		c2c.Enable = *c.handleC2CConnections
+	}
+	multinode := MultinodeConfig{
+		Enable:      multinodeConfig.Enable,
+		EtcdAddress: multinodeConfig.EtcdAddress,
+		HostAddress: multinodeConfig.HostAddress,
+	}
+	if c.multinode != nil {
+		multinode.Enable = *c.multinode
+	}
+	if multinode.Enable && (multinode.EtcdAddress == "" || multinode.HostAddress == "") {
+		logrus.Error("multinode communication is disabled because the etcd address or the host address is not specified")
+		multinode.Enable = false
+	}
+	return &c2c, &multinode
+}
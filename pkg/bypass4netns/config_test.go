@@ -0,0 +1,191 @@
+package bypass4netns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseForwardPortMapping(t *testing.T) {
+	mapping, err := ParseForwardPortMapping("8080:80")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ForwardPortMapping{HostPort: 8080, ChildPort: 80}, mapping)
+
+	mapping, err = ParseForwardPortMapping("127.0.0.1:8080:80")
+	assert.Equal(t, nil, err)
+	assert.True(t, mapping.ParentIP.Equal(net.ParseIP("127.0.0.1")))
+	assert.Equal(t, 8080, mapping.HostPort)
+
+	mapping, err = ParseForwardPortMapping("[::1]:8080:80")
+	assert.Equal(t, nil, err)
+	assert.True(t, mapping.ParentIP.Equal(net.IPv6loopback))
+	assert.Equal(t, 80, mapping.ChildPort)
+
+	for _, s := range []string{"80", "a:80", "8080:a", "foo:8080:80"} {
+		_, err = ParseForwardPortMapping(s)
+		assert.NotEqual(t, nil, err, s)
+	}
+}
+
+func TestParseContainerConfig(t *testing.T) {
+	config, err := parseContainerConfig("", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &containerConfig{}, config)
+
+	config, err = parseContainerConfig("publish=8080:80,8443:443; ignore=10.0.0.0/8,auto;handle-c2c-connections=true", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[int]ForwardPortMapping{
+		80:  {HostPort: 8080, ChildPort: 80},
+		443: {HostPort: 8443, ChildPort: 443},
+	}, config.forwardingPorts)
+	assert.Equal(t, 1, len(config.ignoredSubnets))
+	assert.Equal(t, "10.0.0.0/8", config.ignoredSubnets[0].String())
+	assert.True(t, config.ignoredSubnetsAutoUpdate)
+	assert.True(t, *config.handleC2CConnections)
+	assert.Nil(t, config.multinode)
+	assert.False(t, config.notifySendmsg)
+
+	config, err = parseContainerConfig("publish=8080:80;notify-sendmsg=true", nil)
+	assert.Equal(t, nil, err)
+	assert.True(t, config.notifySendmsg)
+
+	// notify-sendmsg must match the seccomp profile and is ignored in the annotations
+	config, err = parseContainerConfig("publish=8080:80", map[string]string{AnnotationNotifySendmsg: "true"})
+	assert.Equal(t, nil, err)
+	assert.False(t, config.notifySendmsg)
+	config, err = parseContainerConfig("notify-sendmsg=true", map[string]string{AnnotationNotifySendmsg: "false"})
+	assert.Equal(t, nil, err)
+	assert.True(t, config.notifySendmsg)
+
+	// annotations override the listener metadata
+	config, err = parseContainerConfig("publish=8080:80;multinode=true", map[string]string{
+		AnnotationPublish:   "9090:90",
+		AnnotationMultinode: "false",
+		AnnotationIgnore:    "",
+		"nerdctl/name":      "foo",
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[int]ForwardPortMapping{90: {HostPort: 9090, ChildPort: 90}}, config.forwardingPorts)
+	assert.False(t, *config.multinode)
+	assert.NotNil(t, config.ignoredSubnets)
+	assert.Equal(t, 0, len(config.ignoredSubnets))
+
+	for _, metadata := range []string{"publish", "publish=80", "ignore=10.0.0.0", "multinode=yes"} {
+		_, err = parseContainerConfig(metadata, nil)
+		assert.NotEqual(t, nil, err, metadata)
+	}
+	_, err = parseContainerConfig("", map[string]string{AnnotationPublish: "8080:80,8081:80"})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestParseContainerConfigNerdctlPorts(t *testing.T) {
+	ports := `[{"HostPort":8080,"ContainerPort":80,"Protocol":"tcp","HostIP":"0.0.0.0"},` +
+		`{"HostPort":8080,"ContainerPort":80,"Protocol":"udp","HostIP":"0.0.0.0"},` +
+		`{"HostPort":8443,"ContainerPort":443,"Protocol":"tcp","HostIP":"127.0.0.1"}]`
+	config, err := parseContainerConfig("", map[string]string{AnnotationNerdctlPorts: ports})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(config.forwardingPorts))
+	assert.Nil(t, config.forwardingPorts[80].ParentIP)
+	assert.Equal(t, 8080, config.forwardingPorts[80].HostPort)
+	assert.True(t, config.forwardingPorts[443].ParentIP.Equal(net.ParseIP("127.0.0.1")))
+
+	// bypass4netns/publish takes precedence
+	config, err = parseContainerConfig("publish=9090:90", map[string]string{AnnotationNerdctlPorts: ports})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[int]ForwardPortMapping{90: {HostPort: 9090, ChildPort: 90}}, config.forwardingPorts)
+
+	_, err = parseContainerConfig("", map[string]string{AnnotationNerdctlPorts: "8080:80"})
+	assert.NotEqual(t, nil, err)
+
+	// the conflicting udp mapping is ignored and tcp is preferred
+	ports = `[{"HostPort":8080,"ContainerPort":80,"Protocol":"udp","HostIP":"0.0.0.0"},` +
+		`{"HostPort":8081,"ContainerPort":80,"Protocol":"tcp","HostIP":"0.0.0.0"},` +
+		`{"HostPort":5353,"ContainerPort":53,"Protocol":"udp","HostIP":"127.0.0.1"}]`
+	config, err = parseContainerConfig("", map[string]string{AnnotationNerdctlPorts: ports})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(config.forwardingPorts))
+	assert.Equal(t, 8081, config.forwardingPorts[80].HostPort)
+	assert.Equal(t, 5353, config.forwardingPorts[53].HostPort)
+
+	// the conflicting mappings of the same protocol are invalid
+	ports = `[{"HostPort":8080,"ContainerPort":80,"Protocol":"tcp"},{"HostPort":8081,"ContainerPort":80,"Protocol":"tcp"}]`
+	_, err = parseContainerConfig("", map[string]string{AnnotationNerdctlPorts: ports})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestContainerConfigBackgroundConfigs(t *testing.T) {
+	c2cConfig := &C2CConnectionHandleConfig{Enable: false, TracerEnable: true}
+	multinodeConfig := &MultinodeConfig{Enable: false}
+
+	enable := true
+	config := &containerConfig{handleC2CConnections: &enable, multinode: &enable}
+	c2c, multinode := config.backgroundConfigs(c2cConfig, multinodeConfig)
+	assert.True(t, c2c.Enable)
+	assert.True(t, c2c.TracerEnable)
+	assert.False(t, c2cConfig.Enable)
+	// multinode needs the etcd address and the host address
+	assert.False(t, multinode.Enable)
+
+	multinodeConfig = &MultinodeConfig{Enable: false, EtcdAddress: "http://192.168.6.2:2379", HostAddress: "192.168.6.2"}
+	_, multinode = config.backgroundConfigs(c2cConfig, multinodeConfig)
+	assert.True(t, multinode.Enable)
+	assert.Equal(t, "192.168.6.2", multinode.HostAddress)
+	assert.False(t, multinodeConfig.Enable)
+}
+
+func TestSpecContainerConfig(t *testing.T) {
+	config, err := specContainerConfig(&api.BypassSpec{ID: "container"})
+	assert.Equal(t, nil, err)
+	assert.Nil(t, config.forwardingPorts)
+	assert.Nil(t, config.ignoredSubnets)
+	assert.False(t, *config.ignoreBind)
+
+	config, err = specContainerConfig(&api.BypassSpec{
+		ID: "container",
+		PortMapping: []api.PortSpec{
+			{ParentPort: 8080, ChildPort: 80},
+			{ParentIP: "127.0.0.1", ParentPort: 8443, ChildPort: 443},
+		},
+		IgnoreSubnets: []string{"10.0.0.0/8", "auto"},
+		IgnoreBind:    true,
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(config.forwardingPorts))
+	assert.Equal(t, 8080, config.forwardingPorts[80].HostPort)
+	assert.True(t, config.forwardingPorts[443].ParentIP.Equal(net.ParseIP("127.0.0.1")))
+	assert.Equal(t, 1, len(config.ignoredSubnets))
+	assert.True(t, config.ignoredSubnetsAutoUpdate)
+	assert.True(t, *config.ignoreBind)
+
+	for _, spec := range []api.BypassSpec{
+		{PortMapping: []api.PortSpec{{ParentIP: "foo", ParentPort: 8080, ChildPort: 80}}},
+		{PortMapping: []api.PortSpec{{ParentPort: 8080, ChildPort: 80}, {ParentPort: 8080, ChildPort: 81}}},
+		{IgnoreSubnets: []string{"foo"}},
+	} {
+		_, err = specContainerConfig(&spec)
+		assert.NotEqual(t, nil, err)
+	}
+}
+
+func TestContainerConfigWithDefaults(t *testing.T) {
+	enable := true
+	defaults, err := specContainerConfig(&api.BypassSpec{
+		PortMapping:   []api.PortSpec{{ParentPort: 8080, ChildPort: 80}},
+		IgnoreSubnets: []string{"10.0.0.0/8"},
+		IgnoreBind:    true,
+	})
+	assert.Equal(t, nil, err)
+	defaults.handleC2CConnections = &enable
+
+	// the annotations override the defaults
+	config, err := parseContainerConfig("publish=9090:90", nil)
+	assert.Equal(t, nil, err)
+	config.withDefaults(defaults)
+	assert.Equal(t, map[int]ForwardPortMapping{90: {HostPort: 9090, ChildPort: 90}}, config.forwardingPorts)
+	assert.Equal(t, defaults.ignoredSubnets, config.ignoredSubnets)
+	assert.True(t, *config.handleC2CConnections)
+	assert.Nil(t, config.multinode)
+	assert.True(t, *config.ignoreBind)
+}
@@ -0,0 +1,119 @@
+package bypass4netns
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// exitWatcher detects the exit of the processes by polling their pidfds.
+// pidfd becomes readable when all the threads of the process exited,
+// even if the process is killed without calling exit(2).
+type exitWatcher struct {
+	epfd   int
+	onExit func(tgid, pidfd int)
+	// stopfd is an eventfd to stop run
+	stopfd int
+	done   chan struct{}
+
+	mu sync.Mutex
+	// key is pidfd, value is tgid
+	tgids  map[int]int
+	closed bool
+}
+
+func newExitWatcher(onExit func(tgid, pidfd int)) (*exitWatcher, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create epoll: %w", err)
+	}
+	stopfd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		unix.Close(epfd)
+		return nil, fmt.Errorf("failed to create eventfd: %w", err)
+	}
+	event := unix.EpollEvent{
+		Events: unix.EPOLLIN,
+		Fd:     int32(stopfd),
+	}
+	if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, stopfd, &event); err != nil {
+		unix.Close(epfd)
+		unix.Close(stopfd)
+		return nil, fmt.Errorf("failed to watch eventfd: %w", err)
+	}
+	return &exitWatcher{
+		epfd:   epfd,
+		onExit: onExit,
+		stopfd: stopfd,
+		done:   make(chan struct{}),
+		tgids:  map[int]int{},
+	}, nil
+}
+
+// watch starts watching the exit of the process.
+// The pidfd is removed from the watcher when it is closed.
+func (w *exitWatcher) watch(tgid, pidfd int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	event := unix.EpollEvent{
+		Events: unix.EPOLLIN | unix.EPOLLONESHOT,
+		Fd:     int32(pidfd),
+	}
+	if err := unix.EpollCtl(w.epfd, unix.EPOLL_CTL_ADD, pidfd, &event); err != nil {
+		return fmt.Errorf("failed to watch pidfd %d of pid %d: %w", pidfd, tgid, err)
+	}
+	w.tgids[pidfd] = tgid
+	return nil
+}
+
+// run calls onExit for each exited process until the watcher is closed.
+func (w *exitWatcher) run() {
+	defer close(w.done)
+	events := make([]unix.EpollEvent, 64)
+	for {
+		n, err := unix.EpollWait(w.epfd, events, -1)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			if !errors.Is(err, unix.EBADF) {
+				logrus.WithError(err).Error("failed to wait for process exit")
+			}
+			return
+		}
+		for _, event := range events[:n] {
+			pidfd := int(event.Fd)
+			if pidfd == w.stopfd {
+				return
+			}
+			w.mu.Lock()
+			tgid, ok := w.tgids[pidfd]
+			delete(w.tgids, pidfd)
+			w.mu.Unlock()
+			if !ok {
+				continue
+			}
+			logrus.WithFields(logrus.Fields{"pid": tgid}).Debug("process exited")
+			w.onExit(tgid, pidfd)
+		}
+	}
+}
+
+// close stops run and waits for it to return. onExit is not called after close.
+func (w *exitWatcher) close() error {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	if _, err := unix.Write(w.stopfd, []byte{1, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+		return fmt.Errorf("failed to stop exit watcher: %w", err)
+	}
+	<-w.done
+	unix.Close(w.stopfd)
+	return unix.Close(w.epfd)
+}
@@ -0,0 +1,70 @@
+package bypass4netns
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestExitWatcher(t *testing.T) {
+	exited := make(chan [2]int, 1)
+	w, err := newExitWatcher(func(tgid, pidfd int) {
+		exited <- [2]int{tgid, pidfd}
+	})
+	assert.Equal(t, nil, err)
+	go w.run()
+	defer w.close()
+
+	cmd := exec.Command("sleep", "10")
+	assert.Equal(t, nil, cmd.Start())
+	pid := cmd.Process.Pid
+	pidfd, err := unix.PidfdOpen(pid, 0)
+	if errors.Is(err, unix.ENOSYS) {
+		cmd.Process.Kill()
+		t.Skip("pidfd_open is not supported")
+	}
+	assert.Equal(t, nil, err)
+	defer unix.Close(pidfd)
+	assert.Equal(t, nil, w.watch(pid, pidfd))
+
+	select {
+	case <-exited:
+		t.Fatal("process is not killed yet")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the process killed without calling exit(2) is also detected
+	assert.Equal(t, nil, cmd.Process.Kill())
+	select {
+	case e := <-exited:
+		assert.Equal(t, [2]int{pid, pidfd}, e)
+	case <-time.After(5 * time.Second):
+		t.Fatal("exit is not detected")
+	}
+	cmd.Wait()
+}
+
+func TestExitWatcherClose(t *testing.T) {
+	w, err := newExitWatcher(func(tgid, pidfd int) {
+		t.Fatal("onExit is called after close")
+	})
+	assert.Equal(t, nil, err)
+	go w.run()
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- w.close()
+	}()
+	select {
+	case err := <-closed:
+		assert.Equal(t, nil, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("close does not stop run")
+	}
+	// watch is ignored after close
+	assert.Equal(t, nil, w.watch(1, 100))
+}
@@ -0,0 +1,165 @@
+package bypass4netns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// KCMP_FILE in linux/kcmp.h
+const kcmpFile = 0
+
+// isSameFile checks whether the two fds refer to the same open file description.
+// fds duplicated with dup(2) or F_DUPFD, and fds inherited by fork(2) refer to the same open file description.
+func isSameFile(pid1, fd1, pid2, fd2 int) (bool, error) {
+	res, _, errno := unix.Syscall6(unix.SYS_KCMP, uintptr(pid1), uintptr(pid2), kcmpFile, uintptr(fd1), uintptr(fd2), 0)
+	if errno != 0 {
+		return false, fmt.Errorf("kcmp(KCMP_FILE) failed: %w", errno)
+	}
+	return res == 0, nil
+}
+
+// getFdFlags reads the file status flags and the close-on-exec flag of the fd from /proc/<pid>/fdinfo/<fd>.
+func getFdFlags(pid int, fd int) (uint64, error) {
+	fdinfo, err := os.ReadFile(fmt.Sprintf("/proc/%d/fdinfo/%d", pid, fd))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(fdinfo), "\n") {
+		if !strings.HasPrefix(line, "flags:") {
+			continue
+		}
+		flags, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "flags:")), 8, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected fdinfo %q: %w", line, err)
+		}
+		return flags, nil
+	}
+	return 0, fmt.Errorf("flags not found in fdinfo of pid=%d fd=%d", pid, fd)
+}
+
+// isCloexec reads the close-on-exec flag of the fd from /proc/<pid>/fdinfo/<fd>.
+func isCloexec(pid int, fd int) (bool, error) {
+	flags, err := getFdFlags(pid, fd)
+	if err != nil {
+		return false, err
+	}
+	return flags&unix.O_CLOEXEC != 0, nil
+}
+
+// readProcStatusInt reads the integer field (e.g. "PPid") from /proc/<pid>/status.
+func readProcStatusInt(pid int, field string) (int, error) {
+	st, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	prefix := field + ":"
+	for _, line := range strings.Split(string(st), "\n") {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		v, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, prefix)))
+		if err != nil {
+			return 0, fmt.Errorf("unexpected status %q: %w", line, err)
+		}
+		return v, nil
+	}
+	return 0, fmt.Errorf("%s not found in status of pid=%d", field, pid)
+}
+
+// getParentPid reads the parent's pid from /proc/<pid>/status.
+func getParentPid(pid int) (int, error) {
+	return readProcStatusInt(pid, "PPid")
+}
+
+// getTgid reads the thread group id from /proc/<pid>/status.
+func getTgid(pid int) (int, error) {
+	return readProcStatusInt(pid, "Tgid")
+}
+
+// threadExists checks whether the thread belongs to the thread group.
+// Thread ids can be reused by other processes after the thread exits.
+func threadExists(tgid, tid int) bool {
+	_, err := os.Stat(fmt.Sprintf("/proc/%d/task/%d", tgid, tid))
+	return err == nil
+}
+
+// fileInode returns the inode number of the file referred by the fd.
+func fileInode(fd int) (uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return 0, err
+	}
+	return st.Ino, nil
+}
+
+// fileInodeInProcess returns the inode number of the file referred by the fd in the process.
+func fileInodeInProcess(pid int, fd int) (uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(fmt.Sprintf("/proc/%d/fd/%d", pid, fd), &st); err != nil {
+		return 0, err
+	}
+	return st.Ino, nil
+}
+
+// errNotSocket is returned by socketProtoName when the fd is not a socket.
+var errNotSocket = errors.New("not a socket")
+
+// socketProtoName returns the protocol name of the socket in the process (e.g. "TCP", "UDPv6" and "UNIX-STREAM")
+// without retrieving the fd from the process.
+func socketProtoName(pid int, fd int) (string, error) {
+	path := fmt.Sprintf("/proc/%d/fd/%d", pid, fd)
+	link, err := os.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(link, "socket:[") {
+		return "", errNotSocket
+	}
+	buf := make([]byte, 64)
+	n, err := unix.Getxattr(path, "system.sockprotoname", buf)
+	if err != nil {
+		return "", fmt.Errorf("failed to get protocol name of the socket: %w", err)
+	}
+	return strings.TrimRight(string(buf[:n]), "\x00"), nil
+}
+
+// protoNameToProtocol returns the protocol of the IP socket from its protocol name. 0 is returned for unknown names.
+func protoNameToProtocol(name string) int {
+	switch strings.TrimSuffix(name, "v6") {
+	case "TCP":
+		return unix.IPPROTO_TCP
+	case "MPTCP":
+		return unix.IPPROTO_MPTCP
+	case "UDP":
+		return unix.IPPROTO_UDP
+	case "UDPLITE":
+		return unix.IPPROTO_UDPLITE
+	case "SCTP":
+		return unix.IPPROTO_SCTP
+	}
+	return 0
+}
+
+// protoNameToSocketArgs returns the domain and the type of the IP socket from its protocol name.
+// ok is false for non IP sockets. sockType is 0 when the protocol has several types (e.g. SCTP).
+func protoNameToSocketArgs(name string) (sockDomain int, sockType int, ok bool) {
+	sockDomain = unix.AF_INET
+	if strings.HasSuffix(name, "v6") {
+		sockDomain = unix.AF_INET6
+		name = strings.TrimSuffix(name, "v6")
+	}
+	switch name {
+	case "TCP", "MPTCP":
+		return sockDomain, unix.SOCK_STREAM, true
+	case "UDP", "UDPLITE":
+		return sockDomain, unix.SOCK_DGRAM, true
+	case "SCTP":
+		return sockDomain, 0, true
+	}
+	return 0, 0, false
+}
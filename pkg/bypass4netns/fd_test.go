@@ -0,0 +1,127 @@
+package bypass4netns
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestIsSameFile(t *testing.T) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	assert.Equal(t, nil, err)
+	defer unix.Close(fd)
+	dupFd, err := unix.Dup(fd)
+	assert.Equal(t, nil, err)
+	defer unix.Close(dupFd)
+	otherFd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	assert.Equal(t, nil, err)
+	defer unix.Close(otherFd)
+
+	pid := os.Getpid()
+	same, err := isSameFile(pid, fd, pid, dupFd)
+	if errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EPERM) {
+		t.Skipf("kcmp is not available: %s", err)
+	}
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, same)
+
+	same, err = isSameFile(pid, fd, pid, otherFd)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, same)
+}
+
+func TestIsCloexec(t *testing.T) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	assert.Equal(t, nil, err)
+	defer unix.Close(fd)
+	// dup(2) clears FD_CLOEXEC
+	dupFd, err := unix.Dup(fd)
+	assert.Equal(t, nil, err)
+	defer unix.Close(dupFd)
+
+	pid := os.Getpid()
+	cloexec, err := isCloexec(pid, fd)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, cloexec)
+
+	cloexec, err = isCloexec(pid, dupFd)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, cloexec)
+}
+
+func TestGetParentPid(t *testing.T) {
+	ppid, err := getParentPid(os.Getpid())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, os.Getppid(), ppid)
+}
+
+func TestFileInode(t *testing.T) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	assert.Equal(t, nil, err)
+	defer unix.Close(fd)
+	otherFd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	assert.Equal(t, nil, err)
+	defer unix.Close(otherFd)
+
+	ino, err := fileInode(fd)
+	assert.Equal(t, nil, err)
+	inoInProcess, err := fileInodeInProcess(os.Getpid(), fd)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ino, inoInProcess)
+
+	otherIno, err := fileInode(otherFd)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, ino, otherIno)
+}
+
+func TestGetTgid(t *testing.T) {
+	pid := os.Getpid()
+	tgid, err := getTgid(pid)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, pid, tgid)
+
+	tid := unix.Gettid()
+	tgid, err = getTgid(tid)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, pid, tgid)
+	assert.Equal(t, true, threadExists(pid, tid))
+}
+
+func TestSocketProtoName(t *testing.T) {
+	pid := os.Getpid()
+	for _, tc := range []struct {
+		domain     int
+		sockType   int
+		sockDomain int
+		isIP       bool
+	}{
+		{unix.AF_INET, unix.SOCK_STREAM, unix.AF_INET, true},
+		{unix.AF_INET6, unix.SOCK_DGRAM, unix.AF_INET6, true},
+		{unix.AF_UNIX, unix.SOCK_STREAM, 0, false},
+	} {
+		fd, err := unix.Socket(tc.domain, tc.sockType|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			t.Logf("socket(%d, %d) failed: %s", tc.domain, tc.sockType, err)
+			continue
+		}
+		name, err := socketProtoName(pid, fd)
+		unix.Close(fd)
+		assert.Equal(t, nil, err)
+		sockDomain, sockType, isIP := protoNameToSocketArgs(name)
+		assert.Equal(t, tc.isIP, isIP, name)
+		if isIP {
+			assert.Equal(t, tc.sockDomain, sockDomain, name)
+			assert.Equal(t, tc.sockType, sockType, name)
+		}
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "file")
+	assert.Equal(t, nil, err)
+	defer f.Close()
+	_, err = socketProtoName(pid, int(f.Fd()))
+	assert.ErrorIs(t, err, errNotSocket)
+}
@@ -0,0 +1,619 @@
+package bypass4netns
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// handoverVersion is incremented when the snapshot is changed incompatibly.
+const handoverVersion = 1
+
+// handoverTimeout limits the time to wait for the ack and the commit of the handover.
+// The containers are stopped while the handover.
+const handoverTimeout = 10 * time.Second
+
+const (
+	// handoverAck is sent by the new bypass4netns after the handlers are restored
+	handoverAck byte = 1
+	// handoverCommit is sent by the previous bypass4netns after the ack is received
+	handoverCommit byte = 2
+)
+
+// maxHandoverSnapshotLen limits the size of the snapshot received from the previous bypass4netns.
+const maxHandoverSnapshotLen = 64 << 20
+
+// handoverSnapshot is the state sent to the new bypass4netns taking over the containers.
+// The fds are sent after the snapshot one by one and referred by their indices.
+type handoverSnapshot struct {
+	Version int `json:"version"`
+	// Fds is the number of the fds. fds[0] is the listener of the seccomp fds.
+	Fds      int               `json:"fds"`
+	Handlers []handlerSnapshot `json:"handlers"`
+}
+
+type handlerSnapshot struct {
+	State                    specs.ContainerProcessState `json:"state"`
+	NotifFd                  int                         `json:"notifFd"`
+	ForwardingPorts          []ForwardPortMapping        `json:"forwardingPorts"`
+	IgnoredSubnets           []string                    `json:"ignoredSubnets"`
+	IgnoredSubnetsAutoUpdate bool                        `json:"ignoredSubnetsAutoUpdate"`
+	HandleC2CConnections     bool                        `json:"handleC2CConnections"`
+	Multinode                bool                        `json:"multinode"`
+	NotifySendmsg            bool                        `json:"notifySendmsg"`
+	IgnoreBind               *bool                       `json:"ignoreBind,omitempty"`
+	Processes                []processSnapshot           `json:"processes"`
+}
+
+type processSnapshot struct {
+	Tgid int `json:"tgid"`
+	// Pidfd is -1 when pidfd of the process is not opened
+	Pidfd          int              `json:"pidfd"`
+	Sockets        []socketSnapshot `json:"sockets"`
+	UnverifiedFds  []int            `json:"unverifiedFds"`
+	PendingSockets [][3]int         `json:"pendingSockets"`
+}
+
+type socketSnapshot struct {
+	State      socketState `json:"state"`
+	Pid        int         `json:"pid"`
+	Sockfd     int         `json:"sockfd"`
+	SockDomain int         `json:"sockDomain"`
+	SockType   int         `json:"sockType"`
+	SockProto  int         `json:"sockProto"`
+	Addr       *sockaddr   `json:"addr"`
+	// SocketOptions are [level, optname, optlen] and the values
+	SocketOptions      [][3]uint64 `json:"socketOptions"`
+	SocketOptionValues [][]byte    `json:"socketOptionValues"`
+	// FcntlOptions are [cmd, value]
+	FcntlOptions [][2]uint64 `json:"fcntlOptions"`
+	IgnoreBind   bool        `json:"ignoreBind"`
+	BypassedBind bool        `json:"bypassedBind"`
+	// ContainerSockfd and HostSockfd are -1 when they are not kept
+	ContainerSockfd int    `json:"containerSockfd"`
+	HostSockfd      int    `json:"hostSockfd"`
+	C2CHostAddr     string `json:"c2cHostAddr"`
+	// ReuseportChildPort is 0 when the socket is not in a reuseport group
+	ReuseportChildPort int          `json:"reuseportChildPort"`
+	ReuseportHostAddr  string       `json:"reuseportHostAddr"`
+	Ino                uint64       `json:"ino"`
+	Fds                map[int]bool `json:"fds"`
+}
+
+// handoverFds is the list of the fds to send.
+type handoverFds []int
+
+// add appends the fd and returns its index. -1 is not added.
+func (l *handoverFds) add(fd int) int {
+	if fd < 0 {
+		return -1
+	}
+	*l = append(*l, fd)
+	return len(*l) - 1
+}
+
+// snapshot returns the state of the stopped handler.
+func (h *notifHandler) snapshot(fds *handoverFds) handlerSnapshot {
+	snap := handlerSnapshot{
+		State:                    *h.state,
+		NotifFd:                  fds.add(int(h.fd)),
+		ForwardingPorts:          []ForwardPortMapping{},
+		IgnoredSubnets:           []string{},
+		IgnoredSubnetsAutoUpdate: h.nonBypassableAutoUpdate,
+		HandleC2CConnections:     h.c2cConnections.Enable,
+		Multinode:                h.multinode.Enable,
+		NotifySendmsg:            h.notifySendmsg,
+		IgnoreBind:               &h.ignoreBind,
+		Processes:                []processSnapshot{},
+	}
+	for _, fwd := range h.forwardingPorts {
+		snap.ForwardingPorts = append(snap.ForwardingPorts, fwd)
+	}
+	for _, subnet := range h.nonBypassable.StaticList() {
+		snap.IgnoredSubnets = append(snap.IgnoredSubnets, subnet.String())
+	}
+
+	for tgid, proc := range h.processes {
+		ps := processSnapshot{
+			Tgid:           tgid,
+			Pidfd:          -1,
+			Sockets:        []socketSnapshot{},
+			UnverifiedFds:  []int{},
+			PendingSockets: [][3]int{},
+		}
+		if pidfd, ok := h.pidfds[tgid]; ok {
+			ps.Pidfd = fds.add(pidfd)
+		}
+		for fd := range proc.unverifiedFds {
+			ps.UnverifiedFds = append(ps.UnverifiedFds, fd)
+		}
+		for _, args := range proc.pendingSockets {
+			ps.PendingSockets = append(ps.PendingSockets, [3]int{args.sockDomain, args.sockType, args.sockProto})
+		}
+		// fds duplicated with dup(2) share the socketStatus
+		seen := map[*socketStatus]struct{}{}
+		for _, sock := range proc.sockets {
+			if _, ok := seen[sock]; ok {
+				continue
+			}
+			seen[sock] = struct{}{}
+			ps.Sockets = append(ps.Sockets, sock.snapshot(fds))
+		}
+		snap.Processes = append(snap.Processes, ps)
+	}
+	return snap
+}
+
+func (ss *socketStatus) snapshot(fds *handoverFds) socketSnapshot {
+	snap := socketSnapshot{
+		State:              ss.state,
+		Pid:                ss.pid,
+		Sockfd:             ss.sockfd,
+		SockDomain:         ss.sockDomain,
+		SockType:           ss.sockType,
+		SockProto:          ss.sockProto,
+		Addr:               ss.addr,
+		SocketOptions:      [][3]uint64{},
+		SocketOptionValues: [][]byte{},
+		FcntlOptions:       [][2]uint64{},
+		IgnoreBind:         ss.ignoreBind,
+		BypassedBind:       ss.bypassedBind,
+		ContainerSockfd:    fds.add(ss.containerSockfd),
+		HostSockfd:         fds.add(ss.hostSockfd),
+		C2CHostAddr:        ss.c2cHostAddr,
+		Ino:                ss.ino,
+		Fds:                ss.fds,
+	}
+	for _, opt := range ss.socketOptions {
+		snap.SocketOptions = append(snap.SocketOptions, [3]uint64{opt.level, opt.optname, opt.optlen})
+		snap.SocketOptionValues = append(snap.SocketOptionValues, opt.optval)
+	}
+	for _, opt := range ss.fcntlOptions {
+		snap.FcntlOptions = append(snap.FcntlOptions, [2]uint64{opt.cmd, opt.value})
+	}
+	if ss.reuseportGroup != nil {
+		snap.ReuseportChildPort = ss.reuseportGroup.key.childPort
+		snap.ReuseportHostAddr = ss.reuseportGroup.hostAddr
+	}
+	return snap
+}
+
+// handoverConfig returns the configuration of the container in the snapshot.
+func (snap *handlerSnapshot) handoverConfig() (*containerConfig, error) {
+	config := &containerConfig{
+		forwardingPorts:          map[int]ForwardPortMapping{},
+		ignoredSubnetsAutoUpdate: snap.IgnoredSubnetsAutoUpdate,
+		handleC2CConnections:     &snap.HandleC2CConnections,
+		multinode:                &snap.Multinode,
+		ignoreBind:               snap.IgnoreBind,
+		notifySendmsg:            snap.NotifySendmsg,
+	}
+	for _, fwd := range snap.ForwardingPorts {
+		config.forwardingPorts[fwd.ChildPort] = fwd
+	}
+	var err error
+	config.ignoredSubnets, _, err = ParseIgnoredSubnets(snap.IgnoredSubnets)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// restore restores the processes and the sockets in the snapshot.
+// The fds are not closed on error.
+func (h *notifHandler) restore(snap *handlerSnapshot, fds []int) error {
+	getFd := func(i int) (int, error) {
+		if i < 0 {
+			return -1, nil
+		}
+		if i >= len(fds) {
+			return -1, fmt.Errorf("fd index %d is out of range", i)
+		}
+		return fds[i], nil
+	}
+
+	for _, ps := range snap.Processes {
+		proc := newProcessStatus()
+		for _, fd := range ps.UnverifiedFds {
+			proc.unverifiedFds[fd] = struct{}{}
+		}
+		for _, args := range ps.PendingSockets {
+			proc.pendingSockets = append(proc.pendingSockets, socketArgs{sockDomain: args[0], sockType: args[1], sockProto: args[2]})
+		}
+		for i := range ps.Sockets {
+			sock, err := h.restoreSocket(&ps.Sockets[i], getFd)
+			if err != nil {
+				return err
+			}
+			for fd := range sock.fds {
+				proc.sockets[fd] = sock
+			}
+		}
+		pidfd, err := getFd(ps.Pidfd)
+		if err != nil {
+			return err
+		}
+		if pidfd >= 0 {
+			h.pidfds[ps.Tgid] = pidfd
+			h.pidInfos[ps.Tgid] = pidInfo{pidType: PROCESS, pidfd: pidfd, tgid: ps.Tgid}
+		}
+		h.processes[ps.Tgid] = proc
+	}
+	return nil
+}
+
+func (h *notifHandler) restoreSocket(snap *socketSnapshot, getFd func(int) (int, error)) (*socketStatus, error) {
+	if len(snap.SocketOptions) != len(snap.SocketOptionValues) {
+		return nil, fmt.Errorf("socket options of pid %d sockfd %d are broken", snap.Pid, snap.Sockfd)
+	}
+	sock := newSocketStatus(snap.Pid, snap.Sockfd, snap.SockDomain, snap.SockType, snap.SockProto, snap.IgnoreBind)
+	sock.state = snap.State
+	sock.addr = snap.Addr
+	sock.bypassedBind = snap.BypassedBind
+	sock.c2cHostAddr = snap.C2CHostAddr
+	sock.ino = snap.Ino
+	h.trackInode(sock)
+	if len(snap.Fds) > 0 {
+		sock.fds = snap.Fds
+	}
+	for i, opt := range snap.SocketOptions {
+		sock.socketOptions = append(sock.socketOptions, socketOption{
+			level:   opt[0],
+			optname: opt[1],
+			optlen:  opt[2],
+			optval:  snap.SocketOptionValues[i],
+		})
+	}
+	for _, opt := range snap.FcntlOptions {
+		sock.fcntlOptions = append(sock.fcntlOptions, fcntlOption{cmd: opt[0], value: opt[1]})
+	}
+	var err error
+	if sock.containerSockfd, err = getFd(snap.ContainerSockfd); err != nil {
+		return nil, err
+	}
+	if sock.hostSockfd, err = getFd(snap.HostSockfd); err != nil {
+		return nil, err
+	}
+	if snap.ReuseportChildPort != 0 {
+		key := reuseportGroupKey{
+			sockType:  sock.sockType & sockTypeMask,
+			childPort: snap.ReuseportChildPort,
+		}
+		group, ok := h.reuseportGroups[key]
+		if !ok {
+			group = &reuseportGroup{
+				key:      key,
+				hostAddr: snap.ReuseportHostAddr,
+				members:  map[*socketStatus]struct{}{},
+			}
+			h.reuseportGroups[key] = group
+		}
+		group.members[sock] = struct{}{}
+		sock.reuseportGroup = group
+	}
+	return sock, nil
+}
+
+// closeHandedOverFds closes the fds of the handler sent to the new bypass4netns.
+func (h *notifHandler) closeHandedOverFds() {
+	for _, proc := range h.processes {
+		for _, sock := range proc.sockets {
+			sock.close()
+		}
+	}
+	for _, memfd := range h.memfds {
+		syscall.Close(memfd)
+	}
+	for _, pidfd := range h.pidfds {
+		syscall.Close(pidfd)
+	}
+	unix.Close(int(h.fd))
+}
+
+// sendHandover sends the length of the snapshot, the snapshot and the fds.
+// The fds are sent one by one with util.SendMsg.
+func sendHandover(conn net.Conn, snap *handoverSnapshot, fds []int) error {
+	snap.Fds = len(fds)
+	m, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 8, 8+len(m))
+	binary.BigEndian.PutUint64(buf, uint64(len(m)))
+	if _, err := conn.Write(append(buf, m...)); err != nil {
+		return fmt.Errorf("failed to send snapshot: %w", err)
+	}
+	for _, fd := range fds {
+		if err := util.SendMsg(conn, fd, []byte{0}); err != nil {
+			return fmt.Errorf("failed to send fd: %w", err)
+		}
+	}
+	return nil
+}
+
+// recvHandover receives the snapshot and the fds sent by sendHandover.
+func recvHandover(conn net.Conn) (*handoverSnapshot, []int, error) {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, nil, fmt.Errorf("failed to receive snapshot length: %w", err)
+	}
+	n := binary.BigEndian.Uint64(buf)
+	if n > maxHandoverSnapshotLen {
+		return nil, nil, fmt.Errorf("snapshot is too large: %d bytes", n)
+	}
+	buf = make([]byte, n)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, nil, fmt.Errorf("failed to receive snapshot: %w", err)
+	}
+	snap := &handoverSnapshot{}
+	if err := json.Unmarshal(buf, snap); err != nil {
+		return nil, nil, fmt.Errorf("cannot parse snapshot: %w", err)
+	}
+	if snap.Version != handoverVersion {
+		return nil, nil, fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+	fds := []int{}
+	for i := 0; i < snap.Fds; i++ {
+		fd, _, err := util.RecvMsg(conn)
+		if err != nil {
+			closeStateFds(fds)
+			return nil, nil, fmt.Errorf("failed to receive fd %d: %w", i, err)
+		}
+		fds = append(fds, fd)
+	}
+	return snap, fds, nil
+}
+
+// confirmHandover waits for the ack from the new bypass4netns and sends the commit.
+// The containers are handed over only when it succeeded. Otherwise the new bypass4netns discards them.
+func confirmHandover(conn net.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(handoverTimeout)); err != nil {
+		return err
+	}
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return fmt.Errorf("failed to receive ack: %w", err)
+	}
+	if buf[0] != handoverAck {
+		return fmt.Errorf("unexpected ack %d", buf[0])
+	}
+	if _, err := conn.Write([]byte{handoverCommit}); err != nil {
+		return fmt.Errorf("failed to send commit: %w", err)
+	}
+	return nil
+}
+
+// acceptHandover sends the ack to the previous bypass4netns and waits for the commit.
+func acceptHandover(conn net.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(handoverTimeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte{handoverAck}); err != nil {
+		return fmt.Errorf("failed to send ack: %w", err)
+	}
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return fmt.Errorf("failed to receive commit: %w", err)
+	}
+	if buf[0] != handoverCommit {
+		return fmt.Errorf("unexpected commit %d", buf[0])
+	}
+	return nil
+}
+
+// ServeHandover waits for a new bypass4netns to take over the containers with TakeOver.
+// It returns after the containers are handed over, and then StartHandle returns.
+// When the handover failed, the containers are resumed and the next one is waited for.
+func (h *Handler) ServeHandover(socketPath string) error {
+	if err := os.RemoveAll(socketPath); err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	// the new bypass4netns may serve handover on the same path
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	defer l.Close()
+	logrus.Infof("Waiting for handover on %s", socketPath)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		err = h.handover(conn)
+		conn.Close()
+		if err == nil {
+			return nil
+		}
+		logrus.WithError(err).Error("handover failed, the containers are resumed")
+	}
+}
+
+func (h *Handler) handover(conn net.Conn) error {
+	// no seccomp fd is received during the handover.
+	// the connections in the backlog are accepted by the new bypass4netns.
+	h.acceptMu.Lock()
+	defer h.acceptMu.Unlock()
+	l, ok := h.listener.(*net.UnixListener)
+	if !ok || h.handedOver {
+		return errors.New("seccomp fds are not handled")
+	}
+	// the new bypass4netns does not know the sockets and the configurations of the added containers
+	if len(h.added) > 0 {
+		return fmt.Errorf("%d added containers cannot be handed over", len(h.added))
+	}
+	rc, err := l.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to get listener: %w", err)
+	}
+	lfd := -1
+	if err := rc.Control(func(fd uintptr) { lfd = int(fd) }); err != nil {
+		return fmt.Errorf("failed to get listener: %w", err)
+	}
+
+	fds := handoverFds{}
+	fds.add(lfd)
+	snap := &handoverSnapshot{
+		Version:  handoverVersion,
+		Handlers: []handlerSnapshot{},
+	}
+	handlers := []*notifHandler{}
+	conts := []*container{}
+	for _, c := range h.containers.all() {
+		stopped := false
+		for _, nh := range c.handlers {
+			if !nh.stop() {
+				logrus.Warnf("handler of container %s (pid=%d) is not handed over", util.ShrinkID(c.id), nh.state.Pid)
+				continue
+			}
+			stopped = true
+			handlers = append(handlers, nh)
+			snap.Handlers = append(snap.Handlers, nh.snapshot(&fds))
+		}
+		if stopped {
+			conts = append(conts, c)
+		}
+	}
+	logrus.Infof("handing over %d handlers with %d fds", len(snap.Handlers), len(fds))
+	err = sendHandover(conn, snap, fds)
+	if err == nil {
+		err = confirmHandover(conn)
+	}
+	if err != nil {
+		for _, nh := range handlers {
+			nh.resume(false)
+		}
+		return err
+	}
+
+	for _, nh := range handlers {
+		nh.resume(true)
+	}
+	for _, nh := range handlers {
+		<-nh.done
+	}
+	// the container is not removed by serve() when any handler is handed over
+	for _, c := range conts {
+		c.stopTracer()
+	}
+	h.handedOver = true
+	// the socket file is used by the new bypass4netns
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	close(h.handoverDone)
+	logrus.Info("handover is done")
+	return nil
+}
+
+// restoredHandler is the handler taken over and the configuration of its container.
+type restoredHandler struct {
+	handler *notifHandler
+	config  *containerConfig
+}
+
+// restoreHandlers restores the listener and the handlers in the snapshot.
+// It fails when any handler cannot be restored so that the previous bypass4netns resumes all the containers.
+// The fds are closed on error.
+func (h *Handler) restoreHandlers(snap *handoverSnapshot, fds []int) (net.Listener, []restoredHandler, error) {
+	if len(fds) == 0 {
+		return nil, nil, errors.New("listener is not received")
+	}
+	lf := os.NewFile(uintptr(fds[0]), "listener")
+	l, err := net.FileListener(lf)
+	lf.Close()
+	if err != nil {
+		closeStateFds(fds[1:])
+		return nil, nil, fmt.Errorf("failed to restore listener: %w", err)
+	}
+
+	restored := []restoredHandler{}
+	failed := 0
+	for i := range snap.Handlers {
+		r, err := h.restoreHandler(&snap.Handlers[i], fds)
+		if err != nil {
+			logrus.WithError(err).Errorf("container %s (pid=%d) cannot be restored", util.ShrinkID(snap.Handlers[i].State.State.ID), snap.Handlers[i].State.Pid)
+			failed++
+			continue
+		}
+		restored = append(restored, r)
+	}
+	if failed > 0 {
+		for _, r := range restored {
+			r.handler.discard()
+		}
+		l.Close()
+		closeStateFds(fds[1:])
+		return nil, nil, fmt.Errorf("%d handlers cannot be restored", failed)
+	}
+	return l, restored, nil
+}
+
+func (h *Handler) restoreHandler(snap *handlerSnapshot, fds []int) (restoredHandler, error) {
+	if snap.NotifFd <= 0 || snap.NotifFd >= len(fds) {
+		return restoredHandler{}, fmt.Errorf("seccomp fd index %d is out of range", snap.NotifFd)
+	}
+	config, err := snap.handoverConfig()
+	if err != nil {
+		return restoredHandler{}, fmt.Errorf("invalid configuration: %w", err)
+	}
+	state := snap.State
+	nh := h.newNotifHandler(uintptr(fds[snap.NotifFd]), &state, config)
+	if err := nh.restore(snap, fds); err != nil {
+		nh.discard()
+		return restoredHandler{}, err
+	}
+	return restoredHandler{handler: nh, config: config}, nil
+}
+
+// discard releases the handler not started. The fds restored from the snapshot are closed by the caller.
+func (h *notifHandler) discard() {
+	h.cancel()
+	h.finish()
+}
+
+// TakeOver receives the containers from the previous bypass4netns serving handover on the socket.
+// They are handled when StartHandle is called.
+// The previous bypass4netns resumes the containers when it fails.
+func (h *Handler) TakeOver(socketPath string) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return h.takeOver(conn)
+}
+
+func (h *Handler) takeOver(conn net.Conn) error {
+	snap, fds, err := recvHandover(conn)
+	if err != nil {
+		return err
+	}
+	l, restored, err := h.restoreHandlers(snap, fds)
+	if err != nil {
+		return err
+	}
+	if err := acceptHandover(conn); err != nil {
+		for _, r := range restored {
+			r.handler.discard()
+		}
+		l.Close()
+		closeStateFds(fds[1:])
+		return err
+	}
+	h.listener = l
+	h.restored = restored
+	logrus.Infof("took over %d handlers with %d fds", len(restored), len(fds))
+	return nil
+}
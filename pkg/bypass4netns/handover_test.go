@@ -0,0 +1,255 @@
+package bypass4netns
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	libseccomp "github.com/seccomp/libseccomp-golang"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func newSocketpairConns(t *testing.T) (net.Conn, net.Conn) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	assert.Equal(t, nil, err)
+	conns := []net.Conn{}
+	for _, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(f)
+		f.Close()
+		assert.Equal(t, nil, err)
+		conns = append(conns, conn)
+	}
+	return conns[0], conns[1]
+}
+
+func TestSendRecvHandover(t *testing.T) {
+	sender, receiver := newSocketpairConns(t)
+	defer sender.Close()
+	defer receiver.Close()
+
+	var p [2]int
+	assert.Equal(t, nil, unix.Pipe2(p[:], unix.O_CLOEXEC))
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+
+	snap := &handoverSnapshot{
+		Version: handoverVersion,
+		Handlers: []handlerSnapshot{
+			{NotifFd: 1, IgnoredSubnets: []string{"127.0.0.0/8"}, Processes: []processSnapshot{}},
+		},
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- sendHandover(sender, snap, p[:])
+	}()
+	received, fds, err := recvHandover(receiver)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, <-errCh)
+	for _, fd := range fds {
+		defer unix.Close(fd)
+	}
+
+	assert.Equal(t, 2, received.Fds)
+	assert.Equal(t, snap.Handlers, received.Handlers)
+	assert.Equal(t, 2, len(fds))
+	for i := range fds {
+		expected, err := fileInode(p[i])
+		assert.Equal(t, nil, err)
+		actual, err := fileInode(fds[i])
+		assert.Equal(t, nil, err)
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func TestRecvHandoverVersion(t *testing.T) {
+	sender, receiver := newSocketpairConns(t)
+	defer sender.Close()
+	defer receiver.Close()
+
+	go sendHandover(sender, &handoverSnapshot{Version: handoverVersion + 1}, []int{})
+	_, _, err := recvHandover(receiver)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	h := newTestNotifHandler(t, "container", 100, &containerConfig{})
+	var p [2]int
+	assert.Equal(t, nil, unix.Pipe2(p[:], unix.O_CLOEXEC))
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+
+	sa, err := newSockaddrFromUnix(&unix.SockaddrInet4{Addr: [4]byte{192, 168, 0, 1}, Port: 80})
+	assert.Equal(t, nil, err)
+	sock := newSocketStatus(100, 3, syscall.AF_INET, syscall.SOCK_DGRAM, 0, false)
+	sock.state = Bypassed
+	sock.addr = sa
+	sock.hostSockfd = p[1]
+	sock.fds[4] = true
+	sock.socketOptions = append(sock.socketOptions, socketOption{level: unix.SOL_SOCKET, optname: unix.SO_REUSEPORT, optval: []byte{1, 0, 0, 0}, optlen: 4})
+	h.joinReuseportGroup(sock, ForwardPortMapping{HostPort: 8080, ChildPort: 80}, net.ParseIP("0.0.0.0"))
+	proc := newProcessStatus()
+	proc.sockets[3] = sock
+	proc.sockets[4] = sock
+	proc.unverifiedFds[5] = struct{}{}
+	proc.addPendingSocket(socketArgs{sockDomain: syscall.AF_INET6, sockType: syscall.SOCK_STREAM})
+	h.processes[100] = proc
+	h.pidfds[100] = p[0]
+
+	fds := handoverFds{}
+	snap := h.snapshot(&fds)
+	assert.Equal(t, []int{int(h.fd), p[0], p[1]}, []int(fds))
+	assert.Equal(t, []string{"127.0.0.0/8"}, snap.IgnoredSubnets)
+	assert.Equal(t, 1, len(snap.Processes))
+	// the fds duplicated with dup(2) share the socket
+	assert.Equal(t, 1, len(snap.Processes[0].Sockets))
+
+	config, err := snap.handoverConfig()
+	assert.Equal(t, nil, err)
+	restored := newTestNotifHandler(t, "container", 100, config)
+	assert.Equal(t, nil, restored.restore(&snap, fds))
+
+	restoredProc := restored.processes[100]
+	assert.Equal(t, proc.unverifiedFds, restoredProc.unverifiedFds)
+	assert.Equal(t, proc.pendingSockets, restoredProc.pendingSockets)
+	assert.Equal(t, 2, len(restoredProc.sockets))
+	restoredSock := restoredProc.sockets[3]
+	assert.Equal(t, restoredSock, restoredProc.sockets[4])
+	assert.Equal(t, Bypassed, restoredSock.state)
+	assert.Equal(t, "192.168.0.1:80", restoredSock.addr.String())
+	assert.Equal(t, sock.socketOptions, restoredSock.socketOptions)
+	assert.Equal(t, sock.fds, restoredSock.fds)
+	assert.Equal(t, -1, restoredSock.containerSockfd)
+	assert.Equal(t, p[1], restoredSock.hostSockfd)
+	assert.True(t, restoredSock.reuseport())
+	assert.Equal(t, "0.0.0.0:8080", restoredSock.reuseportGroup.hostAddr)
+	assert.Equal(t, 1, len(restored.reuseportGroups))
+	assert.Equal(t, p[0], restored.pidfds[100])
+	assert.Equal(t, pidInfo{pidType: PROCESS, pidfd: p[0], tgid: 100}, restored.pidInfos[100])
+}
+
+// newTestHandoverHandler returns the handler serving the container with a pipe as the seccomp fd.
+func newTestHandoverHandler(t *testing.T) (*Handler, *notifHandler, [2]int) {
+	dir := t.TempDir()
+	h := NewHandler(dir+"/seccomp.sock", "", "", false, "")
+	l, err := net.Listen("unix", h.socketPath)
+	assert.Equal(t, nil, err)
+	h.listener = l
+
+	var p [2]int
+	assert.Equal(t, nil, unix.Pipe2(p[:], unix.O_CLOEXEC))
+	nh := newTestNotifHandler(t, "container", 100, &containerConfig{})
+	nh.fd = libseccomp.ScmpFd(p[0])
+	cont, _ := h.containers.register(nh)
+	go h.serve(nh, cont)
+	return h, nh, p
+}
+
+func TestHandover(t *testing.T) {
+	prev, nh, p := newTestHandoverHandler(t)
+	defer unix.Close(p[1])
+	sender, receiver := newSocketpairConns(t)
+	defer sender.Close()
+	defer receiver.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- prev.handover(sender)
+	}()
+	h := NewHandler("", "", "", false, "")
+	assert.Equal(t, nil, h.takeOver(receiver))
+	assert.Equal(t, nil, <-errCh)
+	defer h.listener.Close()
+
+	<-prev.handoverDone
+	<-nh.done
+	// the previous handler closed its seccomp fd
+	_, err := unix.FcntlInt(uintptr(p[0]), unix.F_GETFD, 0)
+	assert.Equal(t, unix.EBADF, err)
+
+	assert.Equal(t, 1, len(h.restored))
+	restored := h.restored[0].handler
+	defer unix.Close(int(restored.fd))
+	defer restored.discard()
+	assert.Equal(t, "container", restored.state.State.ID)
+	expected, err := fileInode(p[1])
+	assert.Equal(t, nil, err)
+	actual, err := fileInode(int(restored.fd))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, expected, actual)
+
+	// the seccomp fds are received by the new bypass4netns
+	conn, err := net.Dial("unix", prev.socketPath)
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	accepted, err := h.listener.Accept()
+	assert.Equal(t, nil, err)
+	accepted.Close()
+}
+
+func TestHandoverAbort(t *testing.T) {
+	prev, nh, p := newTestHandoverHandler(t)
+	defer unix.Close(p[1])
+	sender, receiver := newSocketpairConns(t)
+	defer sender.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- prev.handover(sender)
+	}()
+	// the new bypass4netns exits without the ack
+	_, fds, err := recvHandover(receiver)
+	assert.Equal(t, nil, err)
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+	receiver.Close()
+	assert.NotEqual(t, nil, <-errCh)
+	assert.False(t, prev.handedOver)
+
+	// the handler is resumed and the seccomp fds are still received
+	_, err = unix.FcntlInt(uintptr(p[0]), unix.F_GETFD, 0)
+	assert.Equal(t, nil, err)
+	assert.True(t, nh.stop())
+	nh.resume(false)
+	conn, err := net.Dial("unix", prev.socketPath)
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	accepted, err := prev.listener.Accept()
+	assert.Equal(t, nil, err)
+	accepted.Close()
+}
+
+func TestRestoreHandlersError(t *testing.T) {
+	dir := t.TempDir()
+	l, err := net.Listen("unix", dir+"/seccomp.sock")
+	assert.Equal(t, nil, err)
+	defer l.Close()
+	lf, err := l.(*net.UnixListener).File()
+	assert.Equal(t, nil, err)
+	lfd, err := unix.Dup(int(lf.Fd()))
+	assert.Equal(t, nil, err)
+	lf.Close()
+	var p [2]int
+	assert.Equal(t, nil, unix.Pipe2(p[:], unix.O_CLOEXEC))
+
+	fds := []int{lfd, p[0], p[1]}
+	snap := &handoverSnapshot{
+		Version: handoverVersion,
+		Handlers: []handlerSnapshot{
+			{NotifFd: 1, Processes: []processSnapshot{}},
+			// the seccomp fd is missing
+			{NotifFd: 3, Processes: []processSnapshot{}},
+		},
+	}
+	h := NewHandler("", "", "", false, "")
+	_, _, err = h.restoreHandlers(snap, fds)
+	assert.NotEqual(t, nil, err)
+	// the received fds are closed
+	for _, fd := range fds {
+		_, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+		assert.Equal(t, unix.EBADF, err)
+	}
+}
@@ -46,6 +46,18 @@ func (x *NonBypassable) Contains(ip net.IP) bool {
 	return false
 }
 
+// List returns the non-bypassable CIDRs.
+func (x *NonBypassable) List() []net.IPNet {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return append(append([]net.IPNet{}, x.staticList...), x.dynamicList...)
+}
+
+// StaticList returns the non-bypassable CIDRs given to New.
+func (x *NonBypassable) StaticList() []net.IPNet {
+	return append([]net.IPNet{}, x.staticList...)
+}
+
 //func (x *NonBypassable) IsInterfaceIPAddress(ip net.IP) bool {
 //	x.mu.RLock()
 //	defer x.mu.RUnlock()
@@ -74,6 +86,7 @@ func (x *NonBypassable) Contains(ip net.IP) bool {
 //}
 
 // WatchNS watches the NS associated with the PID and updates the internal dynamic list on receiving SIGHUP.
+// It returns when ctx is done.
 func (x *NonBypassable) WatchNS(ctx context.Context, pid int) error {
 	selfExe, err := os.Executable()
 	if err != nil {
@@ -116,12 +129,21 @@ func (x *NonBypassable) WatchNS(ctx context.Context, pid int) error {
 	// https://pkg.go.dev/os/signal#Notify
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, unix.SIGHUP)
-	for sig := range sigCh {
-		if uSig, ok := sig.(unix.Signal); ok {
-			_ = unix.Kill(cmdPid, uSig)
+	defer signal.Stop(sigCh)
+	for {
+		select {
+		case <-ctx.Done():
+			// the NSAgent is killed by exec.CommandContext
+			_ = cmd.Wait()
+			// stop watchNS
+			w.Close()
+			return nil
+		case sig := <-sigCh:
+			if uSig, ok := sig.(unix.Signal); ok {
+				_ = unix.Kill(cmdPid, uSig)
+			}
 		}
 	}
-	return nil
 }
 
 func (x *NonBypassable) watchNS(r io.Reader) {
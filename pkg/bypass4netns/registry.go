@@ -0,0 +1,266 @@
+package bypass4netns
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/rootless-containers/bypass4netns/pkg/bypass4netns/tracer"
+	"github.com/rootless-containers/bypass4netns/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// container is a container handled by bypass4netns.
+// The processes started with "runc exec" send their own seccomp fds with the same container ID.
+type container struct {
+	id string
+	// handlers[0] is the handler of the container's init process
+	handlers []*notifHandler
+	// tracer is started for the first handler and shared by the handlers
+	tracer *tracer.Tracer
+}
+
+// containerRegistry holds the containers handled by bypass4netns. key is container ID.
+type containerRegistry struct {
+	containers map[string]*container
+	mu         sync.Mutex
+}
+
+func newContainerRegistry() *containerRegistry {
+	return &containerRegistry{
+		containers: map[string]*container{},
+	}
+}
+
+// register adds the handler to the container. It returns true when the container is new.
+func (r *containerRegistry) register(h *notifHandler) (*container, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := h.state.State.ID
+	c, ok := r.containers[id]
+	if !ok {
+		c = &container{id: id}
+		r.containers[id] = c
+	}
+	c.handlers = append(c.handlers, h)
+	return c, !ok
+}
+
+// unregister removes the handler from the container. It returns true when the container is removed.
+func (r *containerRegistry) unregister(h *notifHandler) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := h.state.State.ID
+	c, ok := r.containers[id]
+	if !ok {
+		return false
+	}
+	for i, v := range c.handlers {
+		if v == h {
+			c.handlers = append(c.handlers[:i], c.handlers[i+1:]...)
+			break
+		}
+	}
+	if len(c.handlers) > 0 {
+		return false
+	}
+	delete(r.containers, id)
+	return true
+}
+
+// all returns the copies of the containers. The handlers are in the order of registration.
+func (r *containerRegistry) all() []*container {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := []*container{}
+	for _, c := range r.containers {
+		copied := *c
+		copied.handlers = append([]*notifHandler{}, c.handlers...)
+		res = append(res, &copied)
+	}
+	return res
+}
+
+// list returns the status of the containers sorted by ID.
+func (r *containerRegistry) list() []api.ContainerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := []api.ContainerStatus{}
+	for _, c := range r.containers {
+		status := c.handlers[0].status()
+		// the processes started with "runc exec" are handled by the other handlers
+		for _, h := range c.handlers[1:] {
+			status.ConnectFallbacks += atomic.LoadUint64(&h.connectFallbacks)
+			status.ReuseportGroups = append(status.ReuseportGroups, h.reuseportStatus()...)
+		}
+		sortReuseportStatus(status.ReuseportGroups)
+		res = append(res, status)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// status returns the status of the container handled by h.
+func (h *notifHandler) status() api.ContainerStatus {
+	status := api.ContainerStatus{
+		ID:                   h.state.State.ID,
+		Pid:                  h.state.Pid,
+		PortMapping:          []api.PortSpec{},
+		IgnoreSubnets:        []string{},
+		HandleC2CConnections: h.c2cConnections.Enable,
+		Multinode:            h.multinode.Enable,
+		ConnectFallbacks:     atomic.LoadUint64(&h.connectFallbacks),
+		ReuseportGroups:      h.reuseportStatus(),
+	}
+	for _, fwd := range h.forwardingPorts {
+		port := api.PortSpec{
+			ParentPort: fwd.HostPort,
+			ChildPort:  fwd.ChildPort,
+		}
+		if fwd.ParentIP != nil {
+			port.ParentIP = fwd.ParentIP.String()
+		}
+		status.PortMapping = append(status.PortMapping, port)
+	}
+	sort.Slice(status.PortMapping, func(i, j int) bool { return status.PortMapping[i].ChildPort < status.PortMapping[j].ChildPort })
+	for _, subnet := range h.nonBypassable.List() {
+		status.IgnoreSubnets = append(status.IgnoreSubnets, subnet.String())
+	}
+	if h.nonBypassableAutoUpdate {
+		status.IgnoreSubnets = append(status.IgnoreSubnets, "auto")
+	}
+	return status
+}
+
+// tracerLogPath returns the log path of the tracer agent of the container, e.g. "bypass4netns-tracer-0123456789ab.log".
+func tracerLogPath(logPath, id string) string {
+	if logPath == "" {
+		return ""
+	}
+	ext := filepath.Ext(logPath)
+	return strings.TrimSuffix(logPath, ext) + "-" + util.ShrinkID(id) + ext
+}
+
+// startTracer starts the tracer agent in the network namespace of the container
+// and checks that it can connect to the forwarded ports.
+func (c *container) startTracer(logPath string, pid int, forwardingPorts map[int]ForwardPortMapping) error {
+	tracerAgent := tracer.NewTracer(logPath)
+	if err := tracerAgent.StartTracer(gocontext.TODO(), pid); err != nil {
+		return fmt.Errorf("failed to start tracer: %w", err)
+	}
+	if err := checkTracer(tracerAgent, forwardingPorts); err != nil {
+		_ = tracerAgent.StopTracer()
+		return err
+	}
+	logrus.Infof("tracer is ready")
+	c.tracer = tracerAgent
+	return nil
+}
+
+// checkTracer registers the forwarded ports to the tracer agent and checks that it can connect to them.
+func checkTracer(tracerAgent *tracer.Tracer, forwardingPorts map[int]ForwardPortMapping) error {
+	fwdPorts := []int{}
+	for _, v := range forwardingPorts {
+		fwdPorts = append(fwdPorts, v.ChildPort)
+	}
+	if err := tracerAgent.RegisterForwardPorts(fwdPorts); err != nil {
+		return fmt.Errorf("failed to register port: %w", err)
+	}
+	logrus.WithField("fwdPorts", fwdPorts).Info("registered ports to tracer agent")
+
+	// check tracer agent is ready
+	for _, v := range fwdPorts {
+		dst := fmt.Sprintf("127.0.0.1:%d", v)
+		addr, err := tracerAgent.ConnectToAddress([]string{dst})
+		if err != nil {
+			logrus.WithError(err).Warnf("failed to connect to %s", dst)
+			continue
+		}
+		if len(addr) != 1 || addr[0] != dst {
+			return fmt.Errorf("failed to connect to %s", dst)
+		}
+		logrus.Debugf("successfully connected to %s", dst)
+	}
+	return nil
+}
+
+// stopTracer stops the tracer agent of the container if it is running.
+func (c *container) stopTracer() {
+	if c.tracer == nil {
+		return
+	}
+	if err := c.tracer.StopTracer(); err != nil {
+		logrus.WithError(err).Warnf("failed to stop tracer for container %s", util.ShrinkID(c.id))
+	}
+	c.tracer = nil
+}
+
+// addedContainer is a container added with AddContainer.
+type addedContainer struct {
+	// config is the defaults of the container's configuration. The annotations override it.
+	config *containerConfig
+	// listener is nil when the seccomp fds are received on the socket of the handler
+	listener net.Listener
+}
+
+// AddContainer adds the container configured with the spec.
+// The seccomp fds of the container are received on spec.SocketPath as well as on the socket of the handler.
+// It fails until StartHandle starts receiving the seccomp fds.
+func (h *Handler) AddContainer(spec *api.BypassSpec) error {
+	if spec.ID == "" {
+		return errors.New("container ID is not specified")
+	}
+	config, err := specContainerConfig(spec)
+	if err != nil {
+		return fmt.Errorf("invalid spec of container %s: %w", spec.ID, err)
+	}
+
+	h.acceptMu.Lock()
+	defer h.acceptMu.Unlock()
+	if h.listener == nil || h.handedOver {
+		return errors.New("seccomp fds are not handled")
+	}
+	if _, ok := h.added[spec.ID]; ok {
+		return fmt.Errorf("container %s is already added", spec.ID)
+	}
+	added := &addedContainer{config: config}
+	if spec.SocketPath != "" && spec.SocketPath != h.socketPath {
+		// the socket file may be left by the bypass4netns killed
+		if err := os.Remove(spec.SocketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("cannot cleanup socket file: %w", err)
+		}
+		added.listener, err = net.Listen("unix", spec.SocketPath)
+		if err != nil {
+			return fmt.Errorf("cannot listen: %w", err)
+		}
+		go h.accept(added.listener)
+	}
+	h.added[spec.ID] = added
+	logrus.Infof("container %s is added", util.ShrinkID(spec.ID))
+	return nil
+}
+
+// RemoveContainer removes the container added with AddContainer.
+// The processes of the container already handled are still handled.
+func (h *Handler) RemoveContainer(id string) error {
+	h.acceptMu.Lock()
+	defer h.acceptMu.Unlock()
+	added, ok := h.added[id]
+	if !ok {
+		return fmt.Errorf("container %s is not added", id)
+	}
+	delete(h.added, id)
+	if added.listener != nil {
+		added.listener.Close()
+	}
+	logrus.Infof("container %s is removed", util.ShrinkID(id))
+	return nil
+}
@@ -0,0 +1,148 @@
+package bypass4netns
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestNotifHandler(t *testing.T, id string, pid int, config *containerConfig) *notifHandler {
+	h := NewHandler("", "", "", false, "")
+	_, subnet, err := net.ParseCIDR("127.0.0.0/8")
+	assert.Equal(t, nil, err)
+	h.SetIgnoredSubnets([]net.IPNet{*subnet}, false)
+	assert.Equal(t, nil, h.SetForwardingPort(ForwardPortMapping{HostPort: 8080, ChildPort: 80}))
+	state := &specs.ContainerProcessState{
+		Pid:   pid,
+		State: specs.State{ID: id},
+	}
+	nh := h.newNotifHandler(0, state, config)
+	nh.c2cConnections, nh.multinode = config.backgroundConfigs(&C2CConnectionHandleConfig{}, &MultinodeConfig{})
+	return nh
+}
+
+func TestContainerRegistry(t *testing.T) {
+	r := newContainerRegistry()
+	assert.Equal(t, []api.ContainerStatus{}, r.list())
+
+	enable := true
+	config := &containerConfig{
+		forwardingPorts: map[int]ForwardPortMapping{
+			443: {ParentIP: net.ParseIP("127.0.0.1"), HostPort: 8443, ChildPort: 443},
+			80:  {HostPort: 8081, ChildPort: 80},
+		},
+		ignoredSubnets:           []net.IPNet{},
+		ignoredSubnetsAutoUpdate: true,
+		handleC2CConnections:     &enable,
+	}
+	c, isNew := r.register(newTestNotifHandler(t, "container-b", 200, config))
+	assert.True(t, isNew)
+	assert.Equal(t, "container-b", c.id)
+	_, isNew = r.register(newTestNotifHandler(t, "container-a", 100, &containerConfig{}))
+	assert.True(t, isNew)
+	// processes started with "runc exec"
+	c2, isNew := r.register(newTestNotifHandler(t, "container-b", 300, &containerConfig{}))
+	assert.False(t, isNew)
+	assert.Equal(t, c, c2)
+	assert.Equal(t, 2, len(c.handlers))
+
+	// the reuseport groups of the processes started with "runc exec" are reported together
+	fwd := ForwardPortMapping{HostPort: 8081, ChildPort: 80}
+	c.handlers[0].joinReuseportGroup(newSocketStatus(200, 3, syscall.AF_INET, syscall.SOCK_STREAM, 0, false), fwd, net.IPv4zero)
+	c.handlers[0].joinReuseportGroup(newSocketStatus(200, 4, syscall.AF_INET, syscall.SOCK_STREAM, 0, false), fwd, net.IPv4zero)
+	c.handlers[1].joinReuseportGroup(newSocketStatus(300, 3, syscall.AF_INET, syscall.SOCK_DGRAM, 0, false), fwd, net.IPv4zero)
+
+	assert.Equal(t, []api.ContainerStatus{
+		{
+			ID:              "container-a",
+			Pid:             100,
+			PortMapping:     []api.PortSpec{{ParentPort: 8080, ChildPort: 80}},
+			IgnoreSubnets:   []string{"127.0.0.0/8"},
+			ReuseportGroups: []api.ReuseportGroup{},
+		},
+		{
+			ID:  "container-b",
+			Pid: 200,
+			PortMapping: []api.PortSpec{
+				{ParentPort: 8081, ChildPort: 80},
+				{ParentIP: "127.0.0.1", ParentPort: 8443, ChildPort: 443},
+			},
+			IgnoreSubnets:        []string{"auto"},
+			HandleC2CConnections: true,
+			ReuseportGroups: []api.ReuseportGroup{
+				{Proto: "tcp", ChildPort: 80, HostAddress: "0.0.0.0:8081", Members: 2},
+				{Proto: "udp", ChildPort: 80, HostAddress: "0.0.0.0:8081", Members: 1},
+			},
+		},
+	}, r.list())
+}
+
+func TestTracerLogPath(t *testing.T) {
+	assert.Equal(t, "", tracerLogPath("", "0123456789abcdef"))
+	assert.Equal(t, "/tmp/b4ns-tracer-0123456789ab.log", tracerLogPath("/tmp/b4ns-tracer.log", "0123456789abcdef"))
+	assert.Equal(t, "/tmp/b4ns-tracer-foo", tracerLogPath("/tmp/b4ns-tracer", "foo"))
+}
+
+func TestContainerRegistryUnregister(t *testing.T) {
+	r := newContainerRegistry()
+	initHandler := newTestNotifHandler(t, "container", 100, &containerConfig{})
+	execHandler := newTestNotifHandler(t, "container", 200, &containerConfig{})
+	r.register(initHandler)
+	r.register(execHandler)
+
+	assert.False(t, r.unregister(execHandler))
+	assert.Equal(t, 1, len(r.list()))
+	// the container is removed with the last handler
+	assert.True(t, r.unregister(initHandler))
+	assert.Equal(t, 0, len(r.list()))
+	assert.False(t, r.unregister(initHandler))
+}
+
+func TestContainerRegistryConnectFallbacks(t *testing.T) {
+	r := newContainerRegistry()
+	initHandler := newTestNotifHandler(t, "container", 100, &containerConfig{})
+	execHandler := newTestNotifHandler(t, "container", 200, &containerConfig{})
+	r.register(initHandler)
+	r.register(execHandler)
+	initHandler.connectFallbacks = 2
+	execHandler.connectFallbacks = 1
+
+	// the fallbacks of the processes started with "runc exec" are counted
+	assert.Equal(t, uint64(3), r.list()[0].ConnectFallbacks)
+}
+
+func TestAddContainer(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHandler(dir+"/seccomp.sock", "", "", false, "")
+	spec := &api.BypassSpec{ID: "container", SocketPath: dir + "/container.sock"}
+	// the seccomp fds are not received yet
+	assert.NotEqual(t, nil, h.AddContainer(spec))
+
+	l, err := net.Listen("unix", h.socketPath)
+	assert.Equal(t, nil, err)
+	defer l.Close()
+	h.listener = l
+	assert.NotEqual(t, nil, h.AddContainer(&api.BypassSpec{}))
+	assert.Equal(t, nil, h.AddContainer(spec))
+	assert.NotEqual(t, nil, h.AddContainer(spec))
+	// the container without its own socket uses the socket of the handler
+	assert.Equal(t, nil, h.AddContainer(&api.BypassSpec{ID: "container2"}))
+	assert.Nil(t, h.added["container2"].listener)
+
+	_, err = os.Stat(spec.SocketPath)
+	assert.Equal(t, nil, err)
+	// the added containers are not handed over
+	assert.NotEqual(t, nil, h.handover(nil))
+
+	assert.Equal(t, nil, h.RemoveContainer("container"))
+	assert.NotEqual(t, nil, h.RemoveContainer("container"))
+	_, err = os.Stat(spec.SocketPath)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, nil, h.RemoveContainer("container2"))
+	assert.Equal(t, 0, len(h.added))
+}
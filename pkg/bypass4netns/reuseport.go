@@ -0,0 +1,107 @@
+package bypass4netns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/rootless-containers/bypass4netns/pkg/api"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+type reuseportGroupKey struct {
+	sockType  int
+	childPort int
+}
+
+// reuseportGroup is the set of the host sockets bound to the same published port with SO_REUSEPORT.
+type reuseportGroup struct {
+	key      reuseportGroupKey
+	hostAddr string
+	members  map[*socketStatus]struct{}
+}
+
+// reuseport returns true when SO_REUSEPORT is enabled on the socket in the container.
+func (ss *socketStatus) reuseport() bool {
+	enabled := false
+	for _, opt := range ss.socketOptions {
+		if opt.level != unix.SOL_SOCKET || opt.optname != unix.SO_REUSEPORT || len(opt.optval) < 4 {
+			continue
+		}
+		// the last one is effective
+		enabled = binary.NativeEndian.Uint32(opt.optval) != 0
+	}
+	return enabled
+}
+
+// joinReuseportGroup adds the socket bound on the host to the reuseport group of the child port.
+func (h *notifHandler) joinReuseportGroup(sock *socketStatus, fwdPort ForwardPortMapping, hostIP net.IP) {
+	key := reuseportGroupKey{
+		sockType:  sock.sockType & sockTypeMask,
+		childPort: fwdPort.ChildPort,
+	}
+	h.reuseportMu.Lock()
+	defer h.reuseportMu.Unlock()
+	group, ok := h.reuseportGroups[key]
+	if !ok {
+		group = &reuseportGroup{
+			key:      key,
+			hostAddr: net.JoinHostPort(hostIP.String(), fmt.Sprint(fwdPort.HostPort)),
+			members:  map[*socketStatus]struct{}{},
+		}
+		h.reuseportGroups[key] = group
+	}
+	group.members[sock] = struct{}{}
+	sock.reuseportGroup = group
+	logrus.WithFields(logrus.Fields{"pid": sock.pid, "sockfd": sock.sockfd}).Infof("reuseport group for container port %d is bound to %s on the host (members=%d)", key.childPort, group.hostAddr, len(group.members))
+}
+
+// leaveReuseportGroup removes the socket from its reuseport group.
+func (h *notifHandler) leaveReuseportGroup(sock *socketStatus) {
+	h.reuseportMu.Lock()
+	defer h.reuseportMu.Unlock()
+	group := sock.reuseportGroup
+	if group == nil {
+		return
+	}
+	sock.reuseportGroup = nil
+	delete(group.members, sock)
+	if len(group.members) == 0 {
+		delete(h.reuseportGroups, group.key)
+		logrus.Infof("reuseport group for container port %d on %s is removed", group.key.childPort, group.hostAddr)
+		return
+	}
+	logrus.Debugf("reuseport group for container port %d on %s has %d members", group.key.childPort, group.hostAddr, len(group.members))
+}
+
+// reuseportStatus returns the status of the reuseport groups sorted by the child port.
+func (h *notifHandler) reuseportStatus() []api.ReuseportGroup {
+	h.reuseportMu.Lock()
+	defer h.reuseportMu.Unlock()
+	res := []api.ReuseportGroup{}
+	for key, group := range h.reuseportGroups {
+		proto := "tcp"
+		if key.sockType == unix.SOCK_DGRAM {
+			proto = "udp"
+		}
+		res = append(res, api.ReuseportGroup{
+			Proto:       proto,
+			ChildPort:   key.childPort,
+			HostAddress: group.hostAddr,
+			Members:     len(group.members),
+		})
+	}
+	sortReuseportStatus(res)
+	return res
+}
+
+func sortReuseportStatus(groups []api.ReuseportGroup) {
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].ChildPort != groups[j].ChildPort {
+			return groups[i].ChildPort < groups[j].ChildPort
+		}
+		return groups[i].Proto < groups[j].Proto
+	})
+}
@@ -2,30 +2,22 @@ package bypass4netns
 
 import (
 	"fmt"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
 	libseccomp "github.com/seccomp/libseccomp-golang"
-	"github.com/vtolstov/go-ioctl"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 const (
 	SeccompAddFdFlagSetFd        = 1
+	SeccompAddFdFlagSend         = 2 // since Linux 5.14
 	SeccompUserNotifFlagContinue = 1
 	SeccompIocMagic              = '!'
 )
 
-func seccompIOW(nr, typ uintptr) uintptr {
-	return ioctl.IOW(uintptr(SeccompIocMagic), nr, typ)
-}
-
-// C.SECCOMP_IOCTL_NOTIF_ADDFD become error
-// Error Message: could not determine kind of name for C.SECCOMP_IOCTL_NOTIF_ADDFD
-// TODO: use C.SECCOMP_IOCTL_NOTIF_ADDFD or add equivalent variable to libseccomp-go
-func seccompIoctlNotifAddfd() uintptr {
-	return seccompIOW(3, uintptr(unsafe.Sizeof(seccompNotifAddFd{})))
-}
-
 type seccompNotifAddFd struct {
 	id         uint64
 	flags      uint32
@@ -34,11 +26,63 @@ type seccompNotifAddFd struct {
 	newfdFlags uint32
 }
 
-func (addfd *seccompNotifAddFd) ioctlNotifAddFd(notifFd libseccomp.ScmpFd) error {
-	ioctl_op := seccompIoctlNotifAddfd()
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(notifFd), ioctl_op, uintptr(unsafe.Pointer(addfd)))
+// addFdSendUnsupported is set when the kernel rejected SECCOMP_ADDFD_FLAG_SEND.
+var addFdSendUnsupported atomic.Bool
+
+func (addfd *seccompNotifAddFd) ioctl(notifFd libseccomp.ScmpFd) (int, syscall.Errno) {
+	// x/sys/unix defines SECCOMP_IOCTL_NOTIF_ADDFD for each architecture because _IOW is encoded differently on mips, powerpc and sparc.
+	newfd, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(notifFd), unix.SECCOMP_IOCTL_NOTIF_ADDFD, uintptr(unsafe.Pointer(addfd)))
+	return int(newfd), errno
+}
+
+// ioctlNotifAddFd installs the fd in the target process and returns the fd number in the target process.
+func (addfd *seccompNotifAddFd) ioctlNotifAddFd(notifFd libseccomp.ScmpFd) (int, error) {
+	newfd, errno := addfd.ioctl(notifFd)
 	if errno != 0 {
-		return fmt.Errorf("ioctl(SECCOMP_IOCTL_NOTIF_ADFD) failed: %s", errno)
+		return -1, fmt.Errorf("ioctl(SECCOMP_IOCTL_NOTIF_ADFD) failed: %s", errno)
+	}
+	return newfd, nil
+}
+
+// validate checks the arguments rejected with EINVAL by the kernel except the flags.
+func (addfd *seccompNotifAddFd) validate() error {
+	if addfd.flags&^uint32(SeccompAddFdFlagSetFd|SeccompAddFdFlagSend) != 0 {
+		return fmt.Errorf("unknown flags 0x%x", addfd.flags)
+	}
+	if addfd.newfdFlags&^uint32(unix.O_CLOEXEC) != 0 {
+		return fmt.Errorf("unknown newfd flags 0x%x", addfd.newfdFlags)
+	}
+	if addfd.newfd != 0 && addfd.flags&SeccompAddFdFlagSetFd == 0 {
+		return fmt.Errorf("newfd %d is set without SECCOMP_ADDFD_FLAG_SETFD", addfd.newfd)
 	}
 	return nil
 }
+
+// ioctlNotifAddFdSend installs the fd in the target process and responds to the notification
+// with the fd number as the return value of the syscall atomically.
+// sent is false without error when the kernel does not support SECCOMP_ADDFD_FLAG_SEND.
+// The fd is not installed in that case and ioctlNotifAddFd should be used instead.
+func (addfd *seccompNotifAddFd) ioctlNotifAddFdSend(notifFd libseccomp.ScmpFd) (newfd int, sent bool, err error) {
+	if addFdSendUnsupported.Load() {
+		return -1, false, nil
+	}
+	// the other arguments are checked first, so that EINVAL means the flag is not supported.
+	if err := addfd.validate(); err != nil {
+		return -1, false, fmt.Errorf("invalid SECCOMP_IOCTL_NOTIF_ADDFD arguments: %w", err)
+	}
+	send := *addfd
+	send.flags |= SeccompAddFdFlagSend
+	newfd, errno := send.ioctl(notifFd)
+	switch errno {
+	case 0:
+		return newfd, true, nil
+	case syscall.EINVAL:
+		// the arguments are validated, so only the unknown flag is rejected before the fd is installed.
+		if !addFdSendUnsupported.Swap(true) {
+			logrus.Info("SECCOMP_ADDFD_FLAG_SEND is not supported. falling back to respond separately")
+		}
+		return -1, false, nil
+	default:
+		return -1, false, fmt.Errorf("ioctl(SECCOMP_IOCTL_NOTIF_ADFD, SECCOMP_ADDFD_FLAG_SEND) failed: %s", errno)
+	}
+}
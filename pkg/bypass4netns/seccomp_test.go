@@ -0,0 +1,24 @@
+package bypass4netns
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeccompNotifAddFdValidate(t *testing.T) {
+	addfd := seccompNotifAddFd{id: 1, srcfd: 3, newfdFlags: syscall.O_CLOEXEC}
+	assert.Equal(t, nil, addfd.validate())
+
+	addfd.newfd = 5
+	assert.NotEqual(t, nil, addfd.validate())
+	addfd.flags = SeccompAddFdFlagSetFd
+	assert.Equal(t, nil, addfd.validate())
+
+	addfd.newfdFlags = syscall.O_NONBLOCK
+	assert.NotEqual(t, nil, addfd.validate())
+
+	addfd = seccompNotifAddFd{id: 1, srcfd: 3, flags: 4}
+	assert.NotEqual(t, nil, addfd.validate())
+}
@@ -1,11 +1,13 @@
 package bypass4netns
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strconv"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 type sockaddr struct {
@@ -16,88 +18,119 @@ type sockaddr struct {
 	ScopeID  uint32 // sin6_scope_id
 }
 
+// String returns the address in the same format as net.JoinHostPort (e.g. "[fd00::1]:80").
+// IPv4-mapped IPv6 addresses are formatted as IPv4 addresses.
 func (sa *sockaddr) String() string {
-	return fmt.Sprintf("%s:%d", sa.IP, sa.Port)
+	return net.JoinHostPort(sa.IP.String(), strconv.Itoa(sa.Port))
 }
 
+// newSockaddr parses struct sockaddr_in or struct sockaddr_in6 in the memory of the process on the host.
 func newSockaddr(buf []byte) (*sockaddr, error) {
+	return newSockaddrWithByteOrder(buf, binary.NativeEndian)
+}
+
+// newSockaddrWithByteOrder parses struct sockaddr_in or struct sockaddr_in6.
+// sin_family and sin6_scope_id are in the byte order of the host.
+// sin_port, sin6_port and sin6_flowinfo are in the network byte order.
+func newSockaddrWithByteOrder(buf []byte, order binary.ByteOrder) (*sockaddr, error) {
 	sa := &sockaddr{}
-	reader := bytes.NewReader(buf)
-	// TODO: support big endian hosts
-	endian := binary.LittleEndian
-	if err := binary.Read(reader, endian, &sa.RawSockaddr); err != nil {
-		return nil, fmt.Errorf("cannot cast byte array to RawSocksddr: %w", err)
+	if len(buf) < 2 {
+		return nil, fmt.Errorf("sockaddr is too short: %d bytes", len(buf))
 	}
+	sa.Family = order.Uint16(buf[0:2])
 	switch sa.Family {
 	case syscall.AF_INET:
-		addr4 := syscall.RawSockaddrInet4{}
-		if _, err := reader.Seek(0, 0); err != nil {
-			return nil, err
+		// struct sockaddr_in {
+		//   sa_family_t    sin_family; // offset 0
+		//   in_port_t      sin_port;   // offset 2
+		//   struct in_addr sin_addr;   // offset 4
+		// };
+		if len(buf) < syscall.SizeofSockaddrInet4 {
+			return nil, fmt.Errorf("sockaddr_in is too short: %d bytes", len(buf))
 		}
-		if err := binary.Read(reader, endian, &addr4); err != nil {
-			return nil, fmt.Errorf("cannot cast byte array to RawSockaddrInet4: %w", err)
-		}
-		sa.IP = make(net.IP, len(addr4.Addr))
-		copy(sa.IP, addr4.Addr[:])
-		p := make([]byte, 2)
-		binary.BigEndian.PutUint16(p, addr4.Port)
-		sa.Port = int(endian.Uint16(p))
+		sa.Port = int(binary.BigEndian.Uint16(buf[2:4]))
+		sa.IP = make(net.IP, net.IPv4len)
+		copy(sa.IP, buf[4:8])
 	case syscall.AF_INET6:
-		addr6 := syscall.RawSockaddrInet6{}
-		if _, err := reader.Seek(0, 0); err != nil {
-			return nil, err
-		}
-		if err := binary.Read(reader, endian, &addr6); err != nil {
-			return nil, fmt.Errorf("cannot cast byte array to RawSockaddrInet6: %w", err)
+		// struct sockaddr_in6 {
+		//   sa_family_t     sin6_family;   // offset 0
+		//   in_port_t       sin6_port;     // offset 2
+		//   uint32_t        sin6_flowinfo; // offset 4
+		//   struct in6_addr sin6_addr;     // offset 8
+		//   uint32_t        sin6_scope_id; // offset 24
+		// };
+		if len(buf) < syscall.SizeofSockaddrInet6 {
+			return nil, fmt.Errorf("sockaddr_in6 is too short: %d bytes", len(buf))
 		}
-		sa.IP = make(net.IP, len(addr6.Addr))
-		copy(sa.IP, addr6.Addr[:])
-		p := make([]byte, 2)
-		binary.BigEndian.PutUint16(p, addr6.Port)
-		sa.Port = int(endian.Uint16(p))
-		sa.Flowinfo = addr6.Flowinfo
-		sa.ScopeID = addr6.Scope_id
+		sa.Port = int(binary.BigEndian.Uint16(buf[2:4]))
+		sa.Flowinfo = binary.BigEndian.Uint32(buf[4:8])
+		sa.IP = make(net.IP, net.IPv6len)
+		copy(sa.IP, buf[8:24])
+		sa.ScopeID = order.Uint32(buf[24:28])
 	default:
 		return nil, fmt.Errorf("expected AF_INET or AF_INET6, got %d", sa.Family)
 	}
 	return sa, nil
 }
 
+// toBytes serializes the address to be written in the memory of the process on the host.
 func (sa *sockaddr) toBytes() ([]byte, error) {
-	res := bytes.Buffer{}
-	// TODO: support big endian hosts
-	endian := binary.LittleEndian
-
-	// ntohs
-	p := make([]byte, 2)
-	binary.BigEndian.PutUint16(p, uint16(sa.Port))
+	return sa.toBytesWithByteOrder(binary.NativeEndian)
+}
 
+// toBytesWithByteOrder serializes the address in the same layout as newSockaddrWithByteOrder.
+func (sa *sockaddr) toBytesWithByteOrder(order binary.ByteOrder) ([]byte, error) {
+	var buf []byte
 	switch sa.Family {
 	case syscall.AF_INET:
-		addr4 := syscall.RawSockaddrInet4{}
-		addr4.Family = syscall.AF_INET
-		copy(addr4.Addr[:], sa.IP.To4()[:])
-
-		addr4.Port = endian.Uint16(p)
-		err := binary.Write(&res, endian, addr4)
-		if err != nil {
-			return nil, err
-		}
+		buf = make([]byte, syscall.SizeofSockaddrInet4)
+		copy(buf[4:8], sa.IP.To4())
 	case syscall.AF_INET6:
-		addr6 := syscall.RawSockaddrInet6{}
-		addr6.Family = syscall.AF_INET6
-		copy(addr6.Addr[:], sa.IP.To16()[:])
-
-		addr6.Port = endian.Uint16(p)
-		addr6.Flowinfo = sa.Flowinfo
-		addr6.Scope_id = sa.ScopeID
-		err := binary.Write(&res, endian, addr6)
-		if err != nil {
-			return nil, err
-		}
+		buf = make([]byte, syscall.SizeofSockaddrInet6)
+		binary.BigEndian.PutUint32(buf[4:8], sa.Flowinfo)
+		copy(buf[8:24], sa.IP.To16())
+		order.PutUint32(buf[24:28], sa.ScopeID)
 	default:
 		return nil, fmt.Errorf("expected AF_INET or AF_INET6, got %d", sa.Family)
 	}
+	order.PutUint16(buf[0:2], sa.Family)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(sa.Port))
+	return buf, nil
+}
+
+// newSockaddrFromUnix converts unix.Sockaddr returned by syscalls on the host to sockaddr.
+func newSockaddrFromUnix(usa unix.Sockaddr) (*sockaddr, error) {
+	sa := &sockaddr{}
+	switch v := usa.(type) {
+	case *unix.SockaddrInet4:
+		sa.Family = syscall.AF_INET
+		sa.IP = make(net.IP, len(v.Addr))
+		copy(sa.IP, v.Addr[:])
+		sa.Port = v.Port
+	case *unix.SockaddrInet6:
+		sa.Family = syscall.AF_INET6
+		sa.IP = make(net.IP, len(v.Addr))
+		copy(sa.IP, v.Addr[:])
+		sa.Port = v.Port
+		sa.ScopeID = v.ZoneId
+	default:
+		return nil, fmt.Errorf("expected AF_INET or AF_INET6, got %T", usa)
+	}
+	return sa, nil
+}
 
-	return res.Bytes(), nil
+// toUnix converts sockaddr to unix.Sockaddr to be used in syscalls on the host.
+func (sa *sockaddr) toUnix() (unix.Sockaddr, error) {
+	switch sa.Family {
+	case syscall.AF_INET:
+		usa := &unix.SockaddrInet4{Port: sa.Port}
+		copy(usa.Addr[:], sa.IP.To4())
+		return usa, nil
+	case syscall.AF_INET6:
+		usa := &unix.SockaddrInet6{Port: sa.Port, ZoneId: sa.ScopeID}
+		copy(usa.Addr[:], sa.IP.To16())
+		return usa, nil
+	default:
+		return nil, fmt.Errorf("expected AF_INET or AF_INET6, got %d", sa.Family)
+	}
 }
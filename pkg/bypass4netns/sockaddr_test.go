@@ -1,11 +1,13 @@
 package bypass4netns
 
 import (
+	"encoding/binary"
 	"net"
 	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 )
 
 func TestSerializeDeserializeSockaddr4(t *testing.T) {
@@ -51,3 +53,79 @@ func TestSerializeDeserializeSockaddr6(t *testing.T) {
 	assert.Equal(t, sa.Flowinfo, uint32(0x12345678))
 	assert.Equal(t, sa.ScopeID, uint32(0x9abcdef0))
 }
+
+func TestSockaddrString(t *testing.T) {
+	sa := sockaddr{IP: net.ParseIP("192.168.1.100"), Port: 80}
+	sa.Family = syscall.AF_INET
+	assert.Equal(t, "192.168.1.100:80", sa.String())
+
+	sa = sockaddr{IP: net.ParseIP("fd00::1"), Port: 80}
+	sa.Family = syscall.AF_INET6
+	assert.Equal(t, "[fd00::1]:80", sa.String())
+
+	// IPv4-mapped IPv6 address is the same as IPv4 address
+	sa = sockaddr{IP: net.ParseIP("::ffff:192.168.1.100"), Port: 80}
+	sa.Family = syscall.AF_INET6
+	assert.Equal(t, "192.168.1.100:80", sa.String())
+}
+
+func TestSockaddrToUnix(t *testing.T) {
+	sa := sockaddr{IP: net.ParseIP("192.168.1.100"), Port: 80}
+	sa.Family = syscall.AF_INET
+	usa, err := sa.toUnix()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &unix.SockaddrInet4{Port: 80, Addr: [4]byte{192, 168, 1, 100}}, usa)
+
+	sa = sockaddr{IP: net.ParseIP("fe80::1"), Port: 80, ScopeID: 2}
+	sa.Family = syscall.AF_INET6
+	usa, err = sa.toUnix()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &unix.SockaddrInet6{Port: 80, ZoneId: 2, Addr: [16]byte{0: 0xfe, 1: 0x80, 15: 1}}, usa)
+}
+
+func TestSockaddrByteOrder(t *testing.T) {
+	// struct sockaddr_in for 192.168.1.100:12345 (0x3039)
+	little4 := []byte{0x02, 0x00, 0x30, 0x39, 192, 168, 1, 100, 0, 0, 0, 0, 0, 0, 0, 0}
+	big4 := []byte{0x00, 0x02, 0x30, 0x39, 192, 168, 1, 100, 0, 0, 0, 0, 0, 0, 0, 0}
+	// struct sockaddr_in6 for [2001:db8::1]:12345 with flowinfo 0x00012345 and scope id 3
+	little6 := []byte{0x0a, 0x00, 0x30, 0x39, 0x00, 0x01, 0x23, 0x45,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		0x03, 0x00, 0x00, 0x00}
+	big6 := []byte{0x00, 0x0a, 0x30, 0x39, 0x00, 0x01, 0x23, 0x45,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		0x00, 0x00, 0x00, 0x03}
+
+	for _, tc := range []struct {
+		order binary.ByteOrder
+		buf4  []byte
+		buf6  []byte
+	}{
+		{binary.LittleEndian, little4, little6},
+		{binary.BigEndian, big4, big6},
+	} {
+		sa, err := newSockaddrWithByteOrder(tc.buf4, tc.order)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, uint16(syscall.AF_INET), sa.Family)
+		assert.Equal(t, "192.168.1.100:12345", sa.String())
+		buf, err := sa.toBytesWithByteOrder(tc.order)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, tc.buf4, buf)
+
+		sa, err = newSockaddrWithByteOrder(tc.buf6, tc.order)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, uint16(syscall.AF_INET6), sa.Family)
+		assert.Equal(t, "[2001:db8::1]:12345", sa.String())
+		assert.Equal(t, uint32(0x12345), sa.Flowinfo)
+		assert.Equal(t, uint32(3), sa.ScopeID)
+		buf, err = sa.toBytesWithByteOrder(tc.order)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, tc.buf6, buf)
+	}
+
+	// the family in the other byte order is not parsed
+	_, err := newSockaddrWithByteOrder(big4, binary.LittleEndian)
+	assert.NotEqual(t, nil, err)
+	// truncated addresses are not parsed
+	_, err = newSockaddrWithByteOrder(little6[:24], binary.LittleEndian)
+	assert.NotEqual(t, nil, err)
+}
@@ -3,14 +3,20 @@ package bypass4netns
 import (
 	gocontext "context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
 
+	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	libseccomp "github.com/seccomp/libseccomp-golang"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
@@ -28,6 +34,9 @@ type fcntlOption struct {
 	value uint64
 }
 
+// sockTypeMask masks SOCK_NONBLOCK and SOCK_CLOEXEC out of the socket type.
+const sockTypeMask = 0xf
+
 type socketState int
 
 const (
@@ -60,12 +69,79 @@ func (ss socketState) String() string {
 }
 
 type processStatus struct {
+	// mu is held while the request of the process is handled
+	mu      sync.Mutex
 	sockets map[int]*socketStatus
+	// unverifiedFds are the close-on-exec fds when execve(2) was called.
+	// They are closed when execve(2) succeeded and verified when they are used.
+	unverifiedFds map[int]struct{}
+	// pendingSockets are the IP sockets created with socket(2) and not seen yet.
+	// socket(2) is notified before the fd is allocated, so they are matched when the fd is used first.
+	pendingSockets []socketArgs
+	// forkSnapshot is the status of the sockets when fork(2) was called last.
+	// The child process inherits the sockets from it. nil when fork(2) is not notified.
+	forkSnapshot map[int]*socketStatus
+}
+
+// socketArgs are the arguments of socket(2).
+type socketArgs struct {
+	sockDomain int
+	sockType   int
+	sockProto  int
+}
+
+// protocol returns the protocol of the socket. 0 is the default protocol of the type.
+func (args socketArgs) protocol() int {
+	if args.sockProto != 0 {
+		return args.sockProto
+	}
+	switch args.sockType & sockTypeMask {
+	case syscall.SOCK_STREAM:
+		return syscall.IPPROTO_TCP
+	case syscall.SOCK_DGRAM:
+		return syscall.IPPROTO_UDP
+	}
+	return 0
+}
+
+// maxPendingSockets limits pendingSockets not to grow with the calls of socket(2) which failed.
+const maxPendingSockets = 16
+
+// addPendingSocket records the IP socket being created with socket(2).
+func (proc *processStatus) addPendingSocket(args socketArgs) {
+	if len(proc.pendingSockets) >= maxPendingSockets {
+		proc.pendingSockets = proc.pendingSockets[1:]
+	}
+	proc.pendingSockets = append(proc.pendingSockets, args)
+}
+
+// popPendingSocket returns the oldest pending socket of the domain, the type and the protocol.
+func (proc *processStatus) popPendingSocket(sockDomain, sockType, sockProto int) (socketArgs, bool) {
+	for i, args := range proc.pendingSockets {
+		if args.sockDomain == sockDomain && args.sockType&sockTypeMask == sockType && args.protocol() == sockProto {
+			proc.pendingSockets = append(proc.pendingSockets[:i], proc.pendingSockets[i+1:]...)
+			return args, true
+		}
+	}
+	return socketArgs{}, false
+}
+
+// releaseForkSnapshot closes the fds kept for the snapshot of the sockets.
+func (proc *processStatus) releaseForkSnapshot() {
+	released := map[*socketStatus]bool{}
+	for _, sock := range proc.forkSnapshot {
+		if !released[sock] {
+			released[sock] = true
+			sock.close()
+		}
+	}
+	proc.forkSnapshot = nil
 }
 
 func newProcessStatus() *processStatus {
 	return &processStatus{
-		sockets: map[int]*socketStatus{},
+		sockets:       map[int]*socketStatus{},
+		unverifiedFds: map[int]struct{}{},
 	}
 }
 
@@ -83,21 +159,101 @@ type socketStatus struct {
 
 	logger     *logrus.Entry
 	ignoreBind bool
+
+	// bypassedBind is true when the socket was replaced by bind(2).
+	bypassedBind bool
+
+	// connecting is true while the connection on the host is checked before falling back.
+	// connect(2) from other threads fails with EALREADY meanwhile.
+	connecting bool
+
+	// datagram sockets can switch between the host and the container socket per destination.
+	// these fds are owned by bypass4netns and are closed in close().
+	containerSockfd int
+	hostSockfd      int
+
+	// c2cHostAddr is the host-side address registered to bypass4netnsd
+	c2cHostAddr string
+
+	// reuseportGroup is the group of the host sockets bound with SO_REUSEPORT
+	reuseportGroup *reuseportGroup
+
+	// ino is the inode number of the socket in the process to detect reused fds.
+	ino uint64
+	// inoTracked is true while ino is counted in socketInodes of the handler
+	inoTracked bool
+
+	// fds holds the fds referring to the socket in the process and their close-on-exec flags.
+	// fds duplicated with dup(2) share the same socketStatus.
+	fds map[int]bool
 }
 
 func newSocketStatus(pid int, sockfd int, sockDomain, sockType, sockProto int, ignoreBind bool) *socketStatus {
 	return &socketStatus{
-		state:         NotBypassed,
-		pid:           pid,
-		sockfd:        sockfd,
-		sockDomain:    sockDomain,
-		sockType:      sockType,
-		sockProto:     sockProto,
-		socketOptions: []socketOption{},
-		fcntlOptions:  []fcntlOption{},
-		logger:        logrus.WithFields(logrus.Fields{"pid": pid, "sockfd": sockfd}),
-		ignoreBind:    ignoreBind,
+		state:           NotBypassed,
+		pid:             pid,
+		sockfd:          sockfd,
+		sockDomain:      sockDomain,
+		sockType:        sockType,
+		sockProto:       sockProto,
+		socketOptions:   []socketOption{},
+		fcntlOptions:    []fcntlOption{},
+		logger:          logrus.WithFields(logrus.Fields{"pid": pid, "sockfd": sockfd}),
+		ignoreBind:      ignoreBind,
+		containerSockfd: -1,
+		hostSockfd:      -1,
+		fds:             map[int]bool{sockfd: sockType&syscall.SOCK_CLOEXEC != 0},
+	}
+}
+
+// isDatagram returns true when the socket is SOCK_DGRAM (e.g. UDP)
+func (ss *socketStatus) isDatagram() bool {
+	return ss.sockType&sockTypeMask == syscall.SOCK_DGRAM
+}
+
+// close releases the fds kept by bypass4netns for the socket.
+func (ss *socketStatus) close() {
+	if ss.containerSockfd >= 0 {
+		syscall.Close(ss.containerSockfd)
+		ss.containerSockfd = -1
+	}
+	if ss.hostSockfd >= 0 {
+		syscall.Close(ss.hostSockfd)
+		ss.hostSockfd = -1
+	}
+}
+
+// cloneForProcess copies the socket status for the process which inherited the socket with fork(2).
+// The fds kept by bypass4netns are duplicated. The c2c connection registered by the parent is not inherited.
+func (ss *socketStatus) cloneForProcess(pid int, sockfd int) (*socketStatus, error) {
+	c := *ss
+	c.pid = pid
+	c.sockfd = sockfd
+	c.socketOptions = append([]socketOption{}, ss.socketOptions...)
+	c.fcntlOptions = append([]fcntlOption{}, ss.fcntlOptions...)
+	c.logger = logrus.WithFields(logrus.Fields{"pid": pid, "sockfd": sockfd})
+	c.c2cHostAddr = ""
+	c.connecting = false
+	c.inoTracked = false
+	c.fds = map[int]bool{}
+	c.containerSockfd = -1
+	c.hostSockfd = -1
+
+	var err error
+	if ss.containerSockfd >= 0 {
+		c.containerSockfd, err = syscall.Dup(ss.containerSockfd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dup container socket: %w", err)
+		}
+	}
+	if ss.hostSockfd >= 0 {
+		c.hostSockfd, err = syscall.Dup(ss.hostSockfd)
+		if err != nil {
+			c.close()
+			return nil, fmt.Errorf("failed to dup host socket: %w", err)
+		}
 	}
+	return &c, nil
 }
 
 func (ss *socketStatus) handleSysSetsockopt(pid int, handler *notifHandler, ctx *context) {
@@ -126,6 +282,7 @@ func (ss *socketStatus) handleSysFcntl(ctx *context) {
 	fcntlCmd := ctx.req.Data.Args[1]
 	switch fcntlCmd {
 	case unix.F_SETFD: // 0x2
+		// close-on-exec flag is per fd and is tracked in handleReq
 	case unix.F_SETFL: // 0x4
 		opt := fcntlOption{
 			cmd:   fcntlCmd,
@@ -133,44 +290,48 @@ func (ss *socketStatus) handleSysFcntl(ctx *context) {
 		}
 		ss.fcntlOptions = append(ss.fcntlOptions, opt)
 		ss.logger.Debugf("fcntl cmd=0x%x value=%d was recorded.", fcntlCmd, opt.value)
-	case unix.F_GETFL: // 0x3
-		// ignore these
 	default:
 		ss.logger.Warnf("Unknown fcntl command 0x%x ignored.", fcntlCmd)
 	}
 }
 
-func (ss *socketStatus) handleSysConnect(handler *notifHandler, ctx *context) {
-	destAddr, err := handler.readSockaddrFromProcess(ss.pid, ctx.req.Data.Args[1], ctx.req.Data.Args[2])
-	if err != nil {
-		ss.logger.Errorf("failed to read sockaddr from process: %q", err)
-		return
-	}
-	ss.addr = destAddr
-	ss.logger.Infof("destination address: %s", destAddr)
+// destination describes how the destination of connect(2), sendto(2) or sendmsg(2) is handled.
+type destination struct {
+	// bypass is true when the socket should be replaced with the one created on the host.
+	bypass bool
+	// rewritePort is true when the destination port is rewritten to hostPort.
+	rewritePort bool
+	hostPort    int
+	// rewriteAddr is true when the destination address is rewritten to hostAddr.
+	rewriteAddr bool
+	hostAddr    net.IP
+	// c2c is true when the destination is other container bypassed via bypass4netnsd.
+	c2c bool
+}
 
+// resolveDestination checks whether the destination is bypassed or not.
+func (ss *socketStatus) resolveDestination(handler *notifHandler, destAddr *sockaddr) (*destination, error) {
+	dest := &destination{}
 	if handler.ip != "" && destAddr.IP.String() != handler.ip {
 		ss.logger.Infof("destination IP %s does not match handler IP %s, skipping socket creation", destAddr.IP, handler.ip)
-		ss.state = NotBypassable
-		return
+		return dest, nil
 	}
 
-	var newDestAddr net.IP
 	switch destAddr.Family {
 	case syscall.AF_INET:
-		newDestAddr = net.IPv4zero
-		newDestAddr = newDestAddr.To4()
-		newDestAddr[0] = 127
-		newDestAddr[3] = 1
-		ss.logger.Infof("destination address is IPv4, newDestAddr set to loopback: %s", newDestAddr)
+		dest.hostAddr = net.IPv4(127, 0, 0, 1).To4()
+		ss.logger.Infof("destination address is IPv4, newDestAddr set to loopback: %s", dest.hostAddr)
 	case syscall.AF_INET6:
-		newDestAddr = net.IPv6loopback
-		newDestAddr = newDestAddr.To16()
-		ss.logger.Infof("destination address is IPv6, newDestAddr set to loopback: %s", newDestAddr)
+		if destAddr.IP.To4() != nil {
+			// IPv4-mapped IPv6 destination reaches IPv4 sockets on the host via IPv4-mapped loopback address.
+			dest.hostAddr = net.IPv4(127, 0, 0, 1).To16()
+			ss.logger.Infof("destination address is IPv4-mapped IPv6, newDestAddr set to loopback: %s", dest.hostAddr)
+		} else {
+			dest.hostAddr = net.IPv6loopback
+			ss.logger.Infof("destination address is IPv6, newDestAddr set to loopback: %s", dest.hostAddr)
+		}
 	default:
-		ss.logger.Errorf("unexpected destination address family %d", destAddr.Family)
-		ss.state = Error
-		return
+		return nil, fmt.Errorf("unexpected destination address family %d", destAddr.Family)
 	}
 
 	// check whether the destination is bypassed or not.
@@ -187,7 +348,7 @@ func (ss *socketStatus) handleSysConnect(handler *notifHandler, ctx *context) {
 			if destAddr.IP.IsLoopback() {
 				ss.logger.Infof("destination address %v is loopback and bypassed", destAddr)
 				connectToLoopback = true
-			} else if contIf, ok := handler.containerInterfaces[destAddr.String()]; ok && contIf.containerID == handler.state.State.ID {
+			} else if contIf, ok := handler.getContainerInterface(destAddr.String()); ok && contIf.containerID == handler.state.State.ID {
 				ss.logger.Infof("destination address %v is interface's address and bypassed", destAddr)
 				connectToInterface = true
 			}
@@ -198,34 +359,32 @@ func (ss *socketStatus) handleSysConnect(handler *notifHandler, ctx *context) {
 	if handler.multinode.Enable && destAddr.IP.IsPrivate() {
 		// currently, only private addresses are available in multinode communication.
 		key := ETCD_MULTINODE_PREFIX + destAddr.String()
-		ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 2*time.Second)
-		res, err := handler.multinode.etcdClient.Get(ctx, ETCD_MULTINODE_PREFIX+destAddr.String())
-		cancel()
+		values, err := handler.lookupMultinode(destAddr.String())
 		ss.logger.Infof("multinode lookup for %s resulted in error: %v", key, err)
 		if err != nil {
 			ss.logger.WithError(err).Warnf("destination address %q is not registered", key)
 		} else {
-			if len(res.Kvs) != 1 {
-				ss.logger.Errorf("invalid len(res.Kvs) %d", len(res.Kvs))
-				ss.state = Error
-				return
+			if len(values) != 1 {
+				return nil, fmt.Errorf("invalid len(res.Kvs) %d", len(values))
 			}
-			hostAddrWithPort := string(res.Kvs[0].Value)
-			hostAddrs := strings.Split(hostAddrWithPort, ":")
-			ss.logger.Infof("etcd response: hostAddrWithPort=%s, hostAddrs=%v", hostAddrWithPort, hostAddrs)
-			if len(hostAddrs) != 2 {
-				ss.logger.Errorf("invalid address format %q", hostAddrWithPort)
-				ss.state = Error
-				return
+			hostAddrWithPort := values[0]
+			hostAddr, hostPortStr, err := net.SplitHostPort(hostAddrWithPort)
+			ss.logger.Infof("etcd response: hostAddrWithPort=%s", hostAddrWithPort)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address format %q: %w", hostAddrWithPort, err)
 			}
-			hostAddr := hostAddrs[0]
-			hostPort, err := strconv.Atoi(hostAddrs[1])
+			hostPort, err := strconv.Atoi(hostPortStr)
 			if err != nil {
-				ss.logger.Errorf("invalid address format %q", hostAddrWithPort)
-				ss.state = Error
-				return
+				return nil, fmt.Errorf("invalid address format %q", hostAddrWithPort)
+			}
+			dest.hostAddr = net.ParseIP(hostAddr)
+			if dest.hostAddr == nil {
+				return nil, fmt.Errorf("invalid address format %q", hostAddrWithPort)
+			}
+			if destAddr.Family == syscall.AF_INET && dest.hostAddr.To4() == nil {
+				ss.logger.Warnf("host address %s of %v is not reachable from AF_INET socket", dest.hostAddr, destAddr)
+				return &destination{}, nil
 			}
-			newDestAddr = net.ParseIP(hostAddr)
 			fwdPort.HostPort = hostPort
 			connectToOtherBypassedContainer = true
 			ss.logger.Infof("destination address %v is container address and bypassed via overlay network", destAddr)
@@ -233,12 +392,13 @@ func (ss *socketStatus) handleSysConnect(handler *notifHandler, ctx *context) {
 	} else {
 		ss.logger.Infof("c2cConnections.Enable=%v", handler.c2cConnections.Enable)
 		if handler.c2cConnections.Enable {
-			contIf, ok := handler.containerInterfaces[destAddr.String()]
+			contIf, ok := handler.getContainerInterface(destAddr.String())
 			ss.logger.Infof("containerInterfaces for destination %v: %v", destAddr.String(), ok)
 			if ok {
 				ss.logger.Infof("destination address %v is container address and bypassed", destAddr)
 				fwdPort.HostPort = contIf.hostPort
 				connectToOtherBypassedContainer = true
+				dest.c2c = true
 			}
 		}
 	}
@@ -249,208 +409,1300 @@ func (ss *socketStatus) handleSysConnect(handler *notifHandler, ctx *context) {
 
 	if !connectToLoopback && !connectToInterface && !connectToOtherBypassedContainer && isNotBypassed {
 		ss.logger.Infof("destination address %v is not bypassed.", destAddr.IP)
-		ss.state = NotBypassable
-		return
-	}
-
-	sockfdOnHost, err := syscall.Socket(ss.sockDomain, ss.sockType, ss.sockProto)
-	if err != nil {
-		ss.logger.Errorf("failed to create socket: %q", err)
-		ss.state = NotBypassable
-		return
-	}
-	defer syscall.Close(sockfdOnHost)
-
-	err = ss.configureSocket(sockfdOnHost)
-	if err != nil {
-		ss.logger.Errorf("failed to configure socket: %q", err)
-		ss.state = NotBypassable
-		return
+		return dest, nil
 	}
 
-	addfd := seccompNotifAddFd{
-		id:    ctx.req.ID,
-		flags: SeccompAddFdFlagSetFd,
-		srcfd: uint32(sockfdOnHost),
-		newfd: uint32(ctx.req.Data.Args[0]),
-		// SOCK_CLOEXEC must be configured in this flag.
-		newfdFlags: uint32(ss.sockType & syscall.SOCK_CLOEXEC),
-	}
+	ss.logger.Infof("connectToLoopback=%v, connectToInterface=%v, connectToOtherBypassedContainer=%v", connectToLoopback, connectToInterface, connectToOtherBypassedContainer)
+	dest.bypass = true
+	dest.rewritePort = connectToLoopback || connectToInterface || connectToOtherBypassedContainer
+	dest.hostPort = fwdPort.HostPort
+	dest.rewriteAddr = connectToInterface || connectToOtherBypassedContainer
 
-	err = addfd.ioctlNotifAddFd(ctx.notifFd)
-	if err != nil {
-		ss.logger.Errorf("ioctl NotifAddFd failed: %q", err)
-		ss.state = NotBypassable
-		return
-	}
+	return dest, nil
+}
 
-	ss.logger.Infof("connectToLoopback=%v, connectToInterface=%v, connectToOtherBypassedContainer=%v", connectToLoopback, connectToInterface, connectToOtherBypassedContainer)
-	if connectToLoopback || connectToInterface || connectToOtherBypassedContainer {
+// rewriteDestination rewrites the destination sockaddr at addrPtr in the process memory.
+// addrLen is the length of the sockaddr specified by the process.
+func (ss *socketStatus) rewriteDestination(handler *notifHandler, addrPtr uint64, addrLen uint64, destAddr *sockaddr, dest *destination) error {
+	if dest.rewritePort {
 		p := make([]byte, 2)
-		binary.BigEndian.PutUint16(p, uint16(fwdPort.HostPort))
+		binary.BigEndian.PutUint16(p, uint16(dest.hostPort))
 		// writing host port at sock_addr's port offset
 		// TODO: should we return dummy value when getpeername(2) is called?
-		err = handler.writeProcMem(ss.pid, ctx.req.Data.Args[1]+2, p)
+		err := handler.writeProcMem(ss.pid, addrPtr+2, p)
 		if err != nil {
-			ss.logger.Errorf("failed to rewrite destination port: %q", err)
-			ss.state = Error
-			return
+			return fmt.Errorf("failed to rewrite destination port: %w", err)
 		}
-		ss.logger.Infof("destination's port %d is rewritten to host-side port %d", ss.addr.Port, fwdPort.HostPort)
+		ss.logger.Infof("destination's port %d is rewritten to host-side port %d", destAddr.Port, dest.hostPort)
 	}
 
-	ss.logger.Infof("connectToInterface=%v, connectToOtherBypassedContainer=%v", connectToInterface, connectToOtherBypassedContainer)
-	if connectToInterface || connectToOtherBypassedContainer {
+	if dest.rewriteAddr {
 		// writing host's loopback address to connect to bypassed socket at sock_addr's address offset
 		// TODO: should we return dummy value when getpeername(2) is called?
+		var err error
 		switch destAddr.Family {
 		case syscall.AF_INET:
-			newDestAddr = newDestAddr.To4()
-			err = handler.writeProcMem(ss.pid, ctx.req.Data.Args[1]+4, newDestAddr[0:4])
+			newDestAddr := dest.hostAddr.To4()
+			err = handler.writeProcMem(ss.pid, addrPtr+4, newDestAddr[0:4])
 		case syscall.AF_INET6:
-			newDestAddr = newDestAddr.To16()
-			err = handler.writeProcMem(ss.pid, ctx.req.Data.Args[1]+8, newDestAddr[0:16])
+			// flowinfo and scope id in the container are meaningless on the host.
+			newDestAddr := &sockaddr{
+				IP:   dest.hostAddr.To16(),
+				Port: destAddr.Port,
+			}
+			newDestAddr.Family = syscall.AF_INET6
+			if dest.rewritePort {
+				newDestAddr.Port = dest.hostPort
+			}
+			var buf []byte
+			buf, err = newDestAddr.toBytes()
+			if err != nil {
+				return err
+			}
+			// sockaddr_in6 without sin6_scope_id (RFC2133) is also accepted
+			if addrLen < uint64(len(buf)) {
+				buf = buf[:addrLen]
+			}
+			err = handler.writeProcMem(ss.pid, addrPtr, buf)
 		default:
-			ss.logger.Errorf("unexpected destination address family %d", destAddr.Family)
-			ss.state = Error
-			return
+			return fmt.Errorf("unexpected destination address family %d", destAddr.Family)
 		}
 		if err != nil {
-			ss.logger.Errorf("failed to rewrite destination address: %q", err)
-			ss.state = Error
-			return
+			return fmt.Errorf("failed to rewrite destination address: %w", err)
 		}
 
-		ss.logger.Infof("destination address %s is rewritten to %s", destAddr.IP, newDestAddr)
+		ss.logger.Infof("destination address %s is rewritten to %s", destAddr.IP, dest.hostAddr)
 	}
 
-	ss.state = Bypassed
-	ss.logger.Infof("bypassed connect socket destAddr=%s", ss.addr)
+	return nil
 }
 
-func (ss *socketStatus) handleSysBind(pid int, handler *notifHandler, ctx *context) {
-	if ss.ignoreBind {
-		ss.state = NotBypassable
-		return
+// injectSocket replaces the socket in the process with sockfd.
+// All the duplicated fds of the socket are replaced.
+func (ss *socketStatus) injectSocket(ctx *context, sockfd int) error {
+	for fd, cloexec := range ss.fds {
+		addfd := seccompNotifAddFd{
+			id:    ctx.req.ID,
+			flags: SeccompAddFdFlagSetFd,
+			srcfd: uint32(sockfd),
+			newfd: uint32(fd),
+		}
+		// O_CLOEXEC must be configured in this flag.
+		if cloexec {
+			addfd.newfdFlags = unix.O_CLOEXEC
+		}
+
+		_, err := addfd.ioctlNotifAddFd(ctx.notifFd)
+		if err != nil {
+			return fmt.Errorf("failed to replace fd %d: %w", fd, err)
+		}
 	}
-	sa, err := handler.readSockaddrFromProcess(pid, ctx.req.Data.Args[1], ctx.req.Data.Args[2])
+	if ino, err := fileInode(sockfd); err == nil {
+		ss.ino = ino
+	}
+	return nil
+}
+
+// createHostSocket creates the socket on the host configured with the recorded options.
+func (ss *socketStatus) createHostSocket(handler *notifHandler, dest *destination) (int, error) {
+	sockfdOnHost, err := syscall.Socket(ss.sockDomain, ss.sockType, ss.sockProto)
 	if err != nil {
-		ss.logger.Errorf("failed to read sockaddr from process: %q", err)
-		ss.state = NotBypassable
-		return
+		return -1, fmt.Errorf("failed to create socket: %w", err)
 	}
-	ss.addr = sa
 
-	ss.logger.Infof("handle port=%d, ip=%v", sa.Port, sa.IP)
+	err = ss.configureSocket(sockfdOnHost)
+	if err != nil {
+		syscall.Close(sockfdOnHost)
+		return -1, fmt.Errorf("failed to configure socket: %w", err)
+	}
 
-	// TODO: get port-fowrad mapping from nerdctl
-	fwdPort, ok := handler.forwardingPorts[int(sa.Port)]
-	if !ok {
-		ss.logger.Infof("port=%d is not target of port forwarding.", sa.Port)
-		ss.state = NotBypassable
-		return
+	if dest.c2c && !ss.isDatagram() && handler.comClient != nil {
+		// failure of the registration only affects the peer address seen by the destination container.
+		err = ss.registerC2CConnection(handler, sockfdOnHost, dest)
+		if err != nil {
+			ss.logger.WithError(err).Warn("failed to register connection to bypass4netnsd")
+		}
 	}
 
-	sockfdOnHost, err := syscall.Socket(ss.sockDomain, ss.sockType, ss.sockProto)
+	return sockfdOnHost, nil
+}
+
+// replaceWithHostSocket creates the socket on the host and replaces the socket in the process with it.
+func (ss *socketStatus) replaceWithHostSocket(handler *notifHandler, ctx *context, dest *destination) error {
+	if ss.hostSockfd >= 0 {
+		// the datagram socket has already been replaced once.
+		return ss.injectSocket(ctx, ss.hostSockfd)
+	}
+
+	sockfdOnHost, err := ss.createHostSocket(handler, dest)
 	if err != nil {
-		ss.logger.Errorf("failed to create socket: %q", err)
+		return err
+	}
+
+	if ss.isDatagram() && ss.containerSockfd < 0 {
+		// keep the container's socket to switch back to it when a destination is not bypassed.
+		ss.containerSockfd, err = handler.getFdInProcess(ss.pid, ss.sockfd)
+		if err != nil {
+			syscall.Close(sockfdOnHost)
+			return fmt.Errorf("failed to get the container's socket: %w", err)
+		}
+	}
+
+	err = ss.injectSocket(ctx, sockfdOnHost)
+	if err != nil {
+		syscall.Close(sockfdOnHost)
+		return fmt.Errorf("ioctl NotifAddFd failed: %w", err)
+	}
+
+	if ss.isDatagram() {
+		ss.hostSockfd = sockfdOnHost
+	} else {
+		syscall.Close(sockfdOnHost)
+	}
+
+	return nil
+}
+
+// handleNotBypassedDestination lets the process use the container's socket for the destination.
+func (ss *socketStatus) handleNotBypassedDestination(ctx *context, destAddr *sockaddr) {
+	if !ss.isDatagram() {
 		ss.state = NotBypassable
 		return
 	}
-	defer syscall.Close(sockfdOnHost)
+	if ss.state != Bypassed {
+		// datagram sockets are checked again with the next destination.
+		return
+	}
+	if ss.bypassedBind {
+		ss.logger.Warnf("destination %s is not bypassed, but the socket is bound on the host", destAddr)
+		return
+	}
+	err := ss.injectSocket(ctx, ss.containerSockfd)
+	if err != nil {
+		ss.logger.Errorf("failed to switch back to the container's socket: %q", err)
+		ss.state = Error
+		return
+	}
+	ss.state = NotBypassed
+	ss.logger.Infof("switched back to the container's socket for destAddr=%s", destAddr)
+}
 
-	err = ss.configureSocket(sockfdOnHost)
+// handleDestination replaces the socket and rewrites the destination at addrPtr if the destination is bypassed.
+func (ss *socketStatus) handleDestination(handler *notifHandler, ctx *context, addrPtr uint64, addrLen uint64, destAddr *sockaddr) {
+	dest, err := ss.resolveDestination(handler, destAddr)
 	if err != nil {
-		ss.logger.Errorf("failed to configure socket: %q", err)
-		ss.state = NotBypassable
+		ss.logger.Errorf("failed to resolve destination %s: %q", destAddr, err)
+		ss.state = Error
 		return
 	}
 
-	var bind_addr syscall.Sockaddr
+	if !dest.bypass {
+		ss.handleNotBypassedDestination(ctx, destAddr)
+		return
+	}
 
-	switch sa.Family {
-	case syscall.AF_INET:
-		var addr [4]byte
-		for i := 0; i < 4; i++ {
-			addr[i] = sa.IP[i]
-		}
-		bind_addr = &syscall.SockaddrInet4{
-			Port: fwdPort.HostPort,
-			Addr: addr,
-		}
-	case syscall.AF_INET6:
-		var addr [16]byte
-		for i := 0; i < 16; i++ {
-			addr[i] = sa.IP[i]
-		}
-		bind_addr = &syscall.SockaddrInet6{
-			Port:   fwdPort.HostPort,
-			ZoneId: sa.ScopeID,
-			Addr:   addr,
+	if ss.state != Bypassed {
+		err = ss.replaceWithHostSocket(handler, ctx, dest)
+		if err != nil {
+			ss.logger.Errorf("failed to replace socket: %q", err)
+			if !ss.isDatagram() {
+				ss.state = NotBypassable
+			}
+			return
 		}
 	}
+	ss.state = Bypassed
 
-	err = syscall.Bind(sockfdOnHost, bind_addr)
+	err = ss.rewriteDestination(handler, addrPtr, addrLen, destAddr, dest)
 	if err != nil {
-		ss.logger.Errorf("bind failed: %s", err)
-		ss.state = NotBypassable
+		ss.logger.Errorf("%s", err)
+		ss.state = Error
 		return
 	}
+}
 
-	addfd := seccompNotifAddFd{
-		id:    ctx.req.ID,
-		flags: SeccompAddFdFlagSetFd,
-		srcfd: uint32(sockfdOnHost),
-		newfd: uint32(ctx.req.Data.Args[0]),
-		// SOCK_CLOEXEC must be configured in this flag.
-		newfdFlags: uint32(ss.sockType & syscall.SOCK_CLOEXEC),
+func (ss *socketStatus) handleSysConnect(handler *notifHandler, ctx *context) {
+	destAddr, err := handler.readSockaddrFromProcess(ss.pid, ctx.req.Data.Args[1], ctx.req.Data.Args[2])
+	if err != nil {
+		ss.logger.Errorf("failed to read sockaddr from process: %q", err)
+		return
 	}
+	ss.addr = destAddr
+	ss.logger.Infof("destination address: %s", destAddr)
 
-	err = addfd.ioctlNotifAddFd(ctx.notifFd)
-	if err != nil {
-		ss.logger.Errorf("ioctl NotifAddFd failed: %s", err)
-		ss.state = NotBypassable
+	if handler.connectInSupervisor || (handler.connectFallback && !ss.isDatagram()) {
+		// connect(2) from another thread fails like the one for the socket being connected
+		if ss.connecting {
+			ctx.resp.Error = -int32(unix.EALREADY)
+			ctx.resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+			return
+		}
+		ss.handleConnectInSupervisor(handler, ctx, destAddr)
+		if ss.state == Bypassed {
+			ss.logger.Infof("bypassed connect socket in supervisor destAddr=%s", ss.addr)
+		}
 		return
 	}
 
-	ss.state = Bypassed
-	ss.logger.Infof("bypassed bind socket for %d:%d is done", fwdPort.HostPort, fwdPort.ChildPort)
+	ss.handleDestination(handler, ctx, ctx.req.Data.Args[1], ctx.req.Data.Args[2], destAddr)
+	if ss.state == Bypassed {
+		ss.logger.Infof("bypassed connect socket destAddr=%s", ss.addr)
+	}
+}
 
-	ctx.resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+// connectFallbackTimeout is the time to wait for the connection on the host before injecting the socket.
+// Connections not established within the timeout are not fallen back.
+const connectFallbackTimeout = 1 * time.Second
+
+// hostDestination returns the address to connect from the host socket.
+func hostDestination(destAddr *sockaddr, dest *destination) *sockaddr {
+	hostDest := &sockaddr{
+		IP:      destAddr.IP,
+		Port:    destAddr.Port,
+		ScopeID: destAddr.ScopeID,
+	}
+	hostDest.Family = destAddr.Family
+	if dest.rewriteAddr {
+		hostDest.IP = dest.hostAddr
+		hostDest.ScopeID = 0
+	}
+	if dest.rewritePort {
+		hostDest.Port = dest.hostPort
+	}
+	return hostDest
 }
 
-func (ss *socketStatus) handleSysGetpeername(handler *notifHandler, ctx *context) {
-	if ss.addr == nil {
+// handleConnectInSupervisor connects the host socket to the destination in bypass4netns
+// and returns the result of connect(2) to the process without rewriting the process's memory.
+func (ss *socketStatus) handleConnectInSupervisor(handler *notifHandler, ctx *context, destAddr *sockaddr) {
+	dest, err := ss.resolveDestination(handler, destAddr)
+	if err != nil {
+		ss.logger.Errorf("failed to resolve destination %s: %q", destAddr, err)
+		ss.state = Error
+		return
+	}
+	if !dest.bypass {
+		ss.handleNotBypassedDestination(ctx, destAddr)
 		return
 	}
 
-	buf, err := ss.addr.toBytes()
+	hostDest := hostDestination(destAddr, dest)
+	usa, err := hostDest.toUnix()
 	if err != nil {
-		ss.logger.WithError(err).Errorf("failed to serialize address %s", ss.addr)
+		ss.logger.Errorf("failed to convert destination %s: %q", hostDest, err)
+		ss.state = Error
+		return
+	}
+
+	// the datagram socket already replaced once is connected again.
+	if ss.hostSockfd >= 0 {
+		connErr := unix.Connect(ss.hostSockfd, usa)
+		if ss.state != Bypassed {
+			if err = ss.injectSocket(ctx, ss.hostSockfd); err != nil {
+				ss.logger.Errorf("ioctl NotifAddFd failed: %q", err)
+				ss.state = Error
+				return
+			}
+			ss.state = Bypassed
+		}
+		ss.finishConnectInSupervisor(ctx, connErr)
 		return
 	}
 
-	err = handler.writeProcMem(ss.pid, ctx.req.Data.Args[1], buf)
+	flags, err := getFdFlags(ss.pid, ss.sockfd)
 	if err != nil {
-		ss.logger.WithError(err).Errorf("failed to write address %s", ss.addr)
+		ss.logger.Errorf("failed to get file status flags: %q", err)
+		ss.state = Error
 		return
 	}
+	nonblock := flags&unix.O_NONBLOCK != 0
 
-	bufLen := make([]byte, 4)
-	binary.LittleEndian.PutUint32(bufLen, uint32(len(buf)))
-	err = handler.writeProcMem(ss.pid, ctx.req.Data.Args[2], bufLen)
+	sockfdOnHost, err := ss.createHostSocket(handler, dest)
 	if err != nil {
-		ss.logger.WithError(err).Errorf("failed to write address length %d", len(buf))
+		ss.logger.Errorf("failed to create socket: %q", err)
+		if !ss.isDatagram() {
+			ss.state = NotBypassable
+		}
 		return
 	}
 
-	ctx.resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+	if ss.isDatagram() && ss.containerSockfd < 0 {
+		ss.containerSockfd, err = handler.getFdInProcess(ss.pid, ss.sockfd)
+		if err != nil {
+			syscall.Close(sockfdOnHost)
+			ss.logger.Errorf("failed to get the container's socket: %q", err)
+			return
+		}
+	}
 
-	ss.logger.Infof("rewrite getpeername() address to %s", ss.addr)
+	// connect(2) in bypass4netns must not block handling other notifications.
+	if err = unix.SetNonblock(sockfdOnHost, true); err != nil {
+		syscall.Close(sockfdOnHost)
+		ss.logger.Errorf("failed to set O_NONBLOCK: %q", err)
+		ss.state = Error
+		return
+	}
+	connErr := unix.Connect(sockfdOnHost, usa)
+
+	if handler.connectFallback && !ss.isDatagram() {
+		// the connection is checked before injecting the host socket to leave the container's socket untouched on failure.
+		if connErr == unix.EINPROGRESS {
+			// the connection refused on the host (e.g. loopback) has already failed
+			_, connErr = pollConnect(sockfdOnHost, -1, 0)
+		}
+		if connErr == unix.EINPROGRESS && !nonblock {
+			// it is waited asynchronously not to block the other processes handled by the same worker.
+			ctx.deferResponse = true
+			ss.connecting = true
+			stopfd := handler.stopfd
+			handler.deferred.Add(1)
+			go func() {
+				defer handler.deferred.Done()
+				ss.waitConnectFallback(handler, ctx, sockfdOnHost, hostDest, stopfd)
+			}()
+			return
+		}
+		if connErr != nil && connErr != unix.EINPROGRESS {
+			ss.fallBackConnect(handler, sockfdOnHost, hostDest, connErr)
+			return
+		}
+		// non-blocking connect(2) returns EINPROGRESS with the host socket without waiting.
+		// the socket cannot be replaced after the response, so the connection failed later is not fallen back.
+	}
+	ss.injectConnectingSocket(handler, ctx, sockfdOnHost, connErr, nonblock)
 }
 
-func (ss *socketStatus) configureSocket(sockfd int) error {
-	for _, optVal := range ss.socketOptions {
+// fallBackConnect closes the host socket failed to connect and continues connect(2) in the container's network.
+func (ss *socketStatus) fallBackConnect(handler *notifHandler, sockfdOnHost int, hostDest *sockaddr, connErr error) {
+	syscall.Close(sockfdOnHost)
+	handler.releaseSocket(ss)
+	ss.state = NotBypassable
+	fallbacks := atomic.AddUint64(&handler.connectFallbacks, 1)
+	ss.logger.Warnf("connect to %s on the host failed: %q, falling back to the container's network (fallbacks=%d)", hostDest, connErr, fallbacks)
+}
+
+// waitConnectFallback waits for the blocking connect(2) on the host up to connectFallbackTimeout
+// and responds after injecting the host socket or falling back to the container's network.
+// The host socket is injected and connect(2) is interrupted with EINTR when the handler is stopped for the handover.
+func (ss *socketStatus) waitConnectFallback(handler *notifHandler, ctx *context, sockfdOnHost int, hostDest *sockaddr, stopfd int) {
+	stopped, connErr := pollConnect(sockfdOnHost, stopfd, connectFallbackTimeout)
+	if stopped {
+		connErr = unix.EINTR
+	}
+
+	// the other requests of the process are handled while waiting
+	if proc, ok := handler.getProcess(ss.pid); ok {
+		proc.mu.Lock()
+		defer proc.mu.Unlock()
+	}
+	ss.connecting = false
+	ctx.deferResponse = false
+	if connErr != nil && connErr != unix.EINPROGRESS && !stopped {
+		ss.fallBackConnect(handler, sockfdOnHost, hostDest, connErr)
+	} else {
+		ss.injectConnectingSocket(handler, ctx, sockfdOnHost, connErr, false)
+		if ctx.deferResponse {
+			return
+		}
+	}
+	if err := libseccomp.NotifRespond(ctx.notifFd, ctx.resp); err != nil {
+		ss.logger.Errorf("Error in notification response: %s", err)
+	}
+}
+
+// injectConnectingSocket replaces the socket with the host socket connected or connecting in bypass4netns
+// and configures the response with the result of connect(2).
+func (ss *socketStatus) injectConnectingSocket(handler *notifHandler, ctx *context, sockfdOnHost int, connErr error, nonblock bool) {
+	err := ss.injectSocket(ctx, sockfdOnHost)
+	if err != nil {
+		syscall.Close(sockfdOnHost)
+		ss.logger.Errorf("ioctl NotifAddFd failed: %q", err)
+		if !ss.isDatagram() {
+			ss.state = NotBypassable
+		}
+		return
+	}
+	ss.state = Bypassed
+	if ss.isDatagram() {
+		ss.hostSockfd = sockfdOnHost
+	}
+
+	if connErr == unix.EINPROGRESS && !nonblock {
+		// wait for the connection to be established like blocking connect(2)
+		ctx.deferResponse = true
+		stopfd := handler.stopfd
+		handler.deferred.Add(1)
+		go func() {
+			defer handler.deferred.Done()
+			ss.waitConnectInSupervisor(ctx, sockfdOnHost, stopfd)
+		}()
+		return
+	}
+
+	if !nonblock {
+		if err = unix.SetNonblock(sockfdOnHost, false); err != nil {
+			ss.logger.Warnf("failed to clear O_NONBLOCK: %q", err)
+		}
+	}
+	if !ss.isDatagram() {
+		syscall.Close(sockfdOnHost)
+	}
+	ss.finishConnectInSupervisor(ctx, connErr)
+}
+
+// pollConnect waits for the non-blocking connect(2) on sockfd up to timeout and returns its result.
+// EINPROGRESS is returned when the connection is not established within timeout.
+// stopped is true when stopfd is readable, i.e. the handler is stopped for the handover.
+func pollConnect(sockfd, stopfd int, timeout time.Duration) (stopped bool, err error) {
+	deadline := time.Now().Add(timeout)
+	fds := []unix.PollFd{{Fd: int32(sockfd), Events: unix.POLLOUT}}
+	if stopfd >= 0 {
+		fds = append(fds, unix.PollFd{Fd: int32(stopfd), Events: unix.POLLIN})
+	}
+	for {
+		remaining := time.Until(deadline)
+		if remaining < 0 {
+			remaining = 0
+		}
+		n, err := unix.Poll(fds, int(remaining.Milliseconds()))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if n == 0 {
+			return false, unix.EINPROGRESS
+		}
+		if len(fds) > 1 && fds[1].Revents != 0 {
+			return true, unix.EINPROGRESS
+		}
+		soErr, err := unix.GetsockoptInt(sockfd, unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			return false, err
+		}
+		if soErr != 0 {
+			return false, syscall.Errno(soErr)
+		}
+		return false, nil
+	}
+}
+
+// waitConnectInSupervisor waits for the connection on sockfd and responds the result to the blocked process.
+// connect(2) is interrupted with EINTR when the handler is stopped for the handover,
+// and the connection is established asynchronously. sockfd is closed after the response.
+func (ss *socketStatus) waitConnectInSupervisor(ctx *context, sockfd int, stopfd int) {
+	defer syscall.Close(sockfd)
+
+	connErr, ok := ss.waitConnected(ctx, sockfd, stopfd)
+	if !ok {
+		return
+	}
+	if err := unix.SetNonblock(sockfd, false); err != nil {
+		ss.logger.Warnf("failed to clear O_NONBLOCK: %q", err)
+	}
+	ss.finishConnectInSupervisor(ctx, connErr)
+	if err := libseccomp.NotifRespond(ctx.notifFd, ctx.resp); err != nil {
+		ss.logger.Errorf("Error in notification response: %s", err)
+	}
+}
+
+// waitConnected waits for the connection on sockfd while the blocked request is valid.
+// ok is false when the request is cancelled. EINTR is returned when the handler is stopped for the handover.
+func (ss *socketStatus) waitConnected(ctx *context, sockfd int, stopfd int) (connErr error, ok bool) {
+	for {
+		// the process can be interrupted by signals while waiting
+		if err := libseccomp.NotifIDValid(ctx.notifFd, ctx.req.ID); err != nil {
+			ss.logger.Infof("connect(2) is cancelled: %q", err)
+			return nil, false
+		}
+		stopped, connErr := pollConnect(sockfd, stopfd, time.Second)
+		if stopped {
+			return unix.EINTR, true
+		}
+		if connErr != unix.EINPROGRESS {
+			return connErr, true
+		}
+	}
+}
+
+// finishConnectInSupervisor configures the response with the result of connect(2).
+func (ss *socketStatus) finishConnectInSupervisor(ctx *context, connErr error) {
+	ctx.resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+	if connErr == nil {
+		ctx.resp.Val = 0
+		return
+	}
+	errno, ok := connErr.(syscall.Errno)
+	if !ok {
+		errno = syscall.ECONNREFUSED
+	}
+	ctx.resp.Error = -int32(errno)
+	if errno != unix.EINPROGRESS && errno != unix.EINTR {
+		ss.logger.Infof("connect to %s in supervisor failed: %s", ss.addr, connErr)
+	}
+}
+
+// tcp_fastopen sysctl bits described in Documentation/networking/ip-sysctl.rst
+const (
+	tcpFastopenClient = 0x1
+	tcpFastopenServer = 0x2
+)
+
+// hostTCPFastopen reads net.ipv4.tcp_fastopen of the host's network namespace.
+func hostTCPFastopen() int {
+	b, err := os.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		logrus.WithError(err).Debug("failed to read tcp_fastopen")
+		return 0
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		logrus.WithError(err).Debug("failed to parse tcp_fastopen")
+		return 0
+	}
+	return v
+}
+
+// handleFastopen checks whether the stream socket is connected implicitly by sendto(2) or sendmsg(2) with MSG_FASTOPEN.
+// Such sockets are handled in the same way as connect(2).
+func (ss *socketStatus) handleFastopen(flags uint64) bool {
+	if flags&unix.MSG_FASTOPEN == 0 {
+		return false
+	}
+	// the host socket fails with EOPNOTSUPP when TCP Fast Open is disabled on the host.
+	if hostTCPFastopen()&tcpFastopenClient == 0 {
+		ss.logger.Warn("TCP Fast Open client is disabled on the host, the socket is not bypassed")
+		ss.state = NotBypassable
+		return false
+	}
+	return true
+}
+
+// fastopenMaxLen limits the data sent with MSG_FASTOPEN in bypass4netns.
+// The rest of the data is left unsent like a partial write on stream sockets.
+const fastopenMaxLen = 64 * 1024
+
+// handleFastopenInSupervisor sends data with MSG_FASTOPEN from the host socket in bypass4netns
+// and returns the result of sendto(2) or sendmsg(2) to the process without rewriting the process's memory.
+func (ss *socketStatus) handleFastopenInSupervisor(handler *notifHandler, ctx *context, destAddr *sockaddr, data, oob []byte, flags int) {
+	dest, err := ss.resolveDestination(handler, destAddr)
+	if err != nil {
+		ss.logger.Errorf("failed to resolve destination %s: %q", destAddr, err)
+		ss.state = Error
+		return
+	}
+	if !dest.bypass {
+		ss.handleNotBypassedDestination(ctx, destAddr)
+		return
+	}
+
+	hostDest := hostDestination(destAddr, dest)
+	usa, err := hostDest.toUnix()
+	if err != nil {
+		ss.logger.Errorf("failed to convert destination %s: %q", hostDest, err)
+		ss.state = Error
+		return
+	}
+
+	fdFlags, err := getFdFlags(ss.pid, ss.sockfd)
+	if err != nil {
+		ss.logger.Errorf("failed to get file status flags: %q", err)
+		ss.state = Error
+		return
+	}
+	nonblock := fdFlags&unix.O_NONBLOCK != 0 || flags&unix.MSG_DONTWAIT != 0
+
+	sockfdOnHost, err := ss.createHostSocket(handler, dest)
+	if err != nil {
+		ss.logger.Errorf("failed to create socket: %q", err)
+		ss.state = NotBypassable
+		return
+	}
+	// sendto(2) in bypass4netns must not block handling other notifications.
+	if err = unix.SetNonblock(sockfdOnHost, true); err != nil {
+		syscall.Close(sockfdOnHost)
+		ss.logger.Errorf("failed to set O_NONBLOCK: %q", err)
+		ss.state = Error
+		return
+	}
+	// the data is sent in SYN only with the cookie. Otherwise, EINPROGRESS is returned without sending the data.
+	n, sendErr := unix.SendmsgN(sockfdOnHost, data, oob, usa, flags)
+
+	if err = ss.injectSocket(ctx, sockfdOnHost); err != nil {
+		syscall.Close(sockfdOnHost)
+		ss.logger.Errorf("ioctl NotifAddFd failed: %q", err)
+		ss.state = NotBypassable
+		return
+	}
+	ss.state = Bypassed
+	ss.logger.Infof("bypassed fastopen socket in supervisor destAddr=%s", ss.addr)
+
+	if sendErr == unix.EINPROGRESS && !nonblock {
+		// wait for the connection and send the data like blocking sendto(2)
+		ctx.deferResponse = true
+		stopfd := handler.stopfd
+		handler.deferred.Add(1)
+		go func() {
+			defer handler.deferred.Done()
+			ss.waitFastopenInSupervisor(ctx, sockfdOnHost, data, oob, flags&^unix.MSG_FASTOPEN, stopfd)
+		}()
+		return
+	}
+
+	if fdFlags&unix.O_NONBLOCK == 0 {
+		if err = unix.SetNonblock(sockfdOnHost, false); err != nil {
+			ss.logger.Warnf("failed to clear O_NONBLOCK: %q", err)
+		}
+	}
+	syscall.Close(sockfdOnHost)
+	ss.finishSendInSupervisor(ctx, n, sendErr)
+}
+
+// waitFastopenInSupervisor waits for the connection on sockfd, sends the data and responds the result to the blocked process.
+// sockfd is closed after the response.
+func (ss *socketStatus) waitFastopenInSupervisor(ctx *context, sockfd int, data, oob []byte, flags int, stopfd int) {
+	defer syscall.Close(sockfd)
+
+	connErr, ok := ss.waitConnected(ctx, sockfd, stopfd)
+	if !ok {
+		return
+	}
+	n := 0
+	if connErr == nil {
+		n, connErr = unix.SendmsgN(sockfd, data, oob, nil, flags)
+	}
+	if err := unix.SetNonblock(sockfd, false); err != nil {
+		ss.logger.Warnf("failed to clear O_NONBLOCK: %q", err)
+	}
+	ss.finishSendInSupervisor(ctx, n, connErr)
+	if err := libseccomp.NotifRespond(ctx.notifFd, ctx.resp); err != nil {
+		ss.logger.Errorf("Error in notification response: %s", err)
+	}
+}
+
+// finishSendInSupervisor configures the response with the result of sendto(2) or sendmsg(2).
+func (ss *socketStatus) finishSendInSupervisor(ctx *context, n int, sendErr error) {
+	ss.finishConnectInSupervisor(ctx, sendErr)
+	if sendErr == nil {
+		ctx.resp.Val = uint64(n)
+	}
+}
+
+// handleSysSendto handles sendto(2) with a destination address on datagram sockets
+// and sendto(2) with MSG_FASTOPEN on stream sockets.
+func (ss *socketStatus) handleSysSendto(handler *notifHandler, ctx *context) {
+	// int sendto(int sockfd, const void *buf, size_t len, int flags, const struct sockaddr *dest_addr, socklen_t addrlen)
+	addrPtr := ctx.req.Data.Args[4]
+	addrLen := ctx.req.Data.Args[5]
+	if addrPtr == 0 || addrLen == 0 {
+		return
+	}
+	if !ss.isDatagram() && !ss.handleFastopen(ctx.req.Data.Args[3]) {
+		return
+	}
+
+	destAddr, err := handler.readSockaddrFromProcess(ss.pid, addrPtr, addrLen)
+	if err != nil {
+		ss.logger.Errorf("failed to read sockaddr from process: %q", err)
+		return
+	}
+	ss.logger.Debugf("sendto destination address: %s", destAddr)
+	if !ss.isDatagram() {
+		ss.addr = destAddr
+		if handler.connectInSupervisor {
+			data, err := handler.readProcMem(ss.pid, ctx.req.Data.Args[1], min(ctx.req.Data.Args[2], fastopenMaxLen))
+			if err != nil {
+				ss.logger.Errorf("failed to read data from process: %q", err)
+				return
+			}
+			ss.handleFastopenInSupervisor(handler, ctx, destAddr, data, nil, int(ctx.req.Data.Args[3]))
+			return
+		}
+	}
+
+	ss.handleDestination(handler, ctx, addrPtr, addrLen, destAddr)
+}
+
+// handleSysSendmsg handles sendmsg(2) with a destination address on datagram sockets
+// and sendmsg(2) with MSG_FASTOPEN on stream sockets.
+func (ss *socketStatus) handleSysSendmsg(handler *notifHandler, ctx *context) {
+	// ssize_t sendmsg(int sockfd, const struct msghdr *msg, int flags)
+	if !ss.isDatagram() && !ss.handleFastopen(ctx.req.Data.Args[2]) {
+		return
+	}
+	addrPtr, addrLen, err := handler.readMsghdrName(ss.pid, ctx.req.Data.Args[1], pointerSize(ctx.req.Data.Arch))
+	if err != nil {
+		ss.logger.Errorf("failed to read msghdr from process: %q", err)
+		return
+	}
+	if addrPtr == 0 || addrLen == 0 {
+		return
+	}
+
+	destAddr, err := handler.readSockaddrFromProcess(ss.pid, addrPtr, addrLen)
+	if err != nil {
+		ss.logger.Errorf("failed to read sockaddr from process: %q", err)
+		return
+	}
+	ss.logger.Debugf("sendmsg destination address: %s", destAddr)
+	if !ss.isDatagram() {
+		ss.addr = destAddr
+		if handler.connectInSupervisor {
+			data, oob, err := handler.readMsghdrPayload(ss.pid, ctx.req.Data.Args[1], pointerSize(ctx.req.Data.Arch), fastopenMaxLen)
+			if err != nil {
+				ss.logger.Errorf("failed to read msghdr from process: %q", err)
+				return
+			}
+			ss.handleFastopenInSupervisor(handler, ctx, destAddr, data, oob, int(ctx.req.Data.Args[2]))
+			return
+		}
+	}
+
+	ss.handleDestination(handler, ctx, addrPtr, addrLen, destAddr)
+}
+
+// errNotContainerAddress is returned by translateBindAddress when the address is not found in the container's addresses.
+var errNotContainerAddress = errors.New("not the container's address")
+
+// translateBindAddress translates the address the container binds to into the address to bind on the host.
+// The wildcard address is translated into parentIP, or the wildcard address when parentIP is nil.
+// Binds to the container's interface addresses are translated in the same way with BindAddressPolicyWildcard.
+// Binds to loopback addresses are never bypassed because they must not be exposed to the host.
+func translateBindAddress(policy BindAddressPolicy, ip net.IP, sockDomain int, containerAddrs []net.IP, parentIP net.IP) (net.IP, error) {
+	if ip.IsLoopback() {
+		return nil, fmt.Errorf("loopback address %s is not exposed to the host", ip)
+	}
+
+	if !ip.IsUnspecified() {
+		if policy != BindAddressPolicyWildcard {
+			return nil, fmt.Errorf("bind to %s is not bypassed with bind address policy %q", ip, policy)
+		}
+		isContainerAddr := false
+		for _, addr := range containerAddrs {
+			if addr.Equal(ip) {
+				isContainerAddr = true
+				break
+			}
+		}
+		if !isContainerAddr {
+			return nil, fmt.Errorf("%s is %w", ip, errNotContainerAddress)
+		}
+	}
+
+	if parentIP == nil {
+		if sockDomain == syscall.AF_INET {
+			return net.IPv4zero.To4(), nil
+		}
+		return net.IPv6unspecified, nil
+	}
+	if sockDomain == syscall.AF_INET {
+		if parentIP.To4() == nil {
+			return nil, fmt.Errorf("parent IP %s is not available for AF_INET socket", parentIP)
+		}
+		return parentIP.To4(), nil
+	}
+	// IPv4 parent IP is used as IPv4-mapped IPv6 address
+	return parentIP.To16(), nil
+}
+
+func (ss *socketStatus) handleSysBind(pid int, handler *notifHandler, ctx *context) {
+	if ss.ignoreBind {
+		ss.state = NotBypassable
+		return
+	}
+	sa, err := handler.readSockaddrFromProcess(pid, ctx.req.Data.Args[1], ctx.req.Data.Args[2])
+	if err != nil {
+		ss.logger.Errorf("failed to read sockaddr from process: %q", err)
+		ss.state = NotBypassable
+		return
+	}
+	ss.addr = sa
+
+	ss.logger.Infof("handle port=%d, ip=%v", sa.Port, sa.IP)
+
+	fwdPort, ok := handler.forwardingPorts[int(sa.Port)]
+	if !ok {
+		ss.logger.Infof("port=%d is not target of port forwarding.", sa.Port)
+		ss.state = NotBypassable
+		return
+	}
+
+	hostIP, err := translateBindAddress(handler.bindAddressPolicy, sa.IP, ss.sockDomain, handler.getContainerAddrs(), fwdPort.ParentIP)
+	if errors.Is(err, errNotContainerAddress) {
+		// the address can be added after the addresses are retrieved
+		handler.refreshContainerAddrs()
+		hostIP, err = translateBindAddress(handler.bindAddressPolicy, sa.IP, ss.sockDomain, handler.getContainerAddrs(), fwdPort.ParentIP)
+	}
+	if err != nil {
+		ss.logger.Infof("bind to %s is not bypassed: %s", sa, err)
+		ss.state = NotBypassable
+		return
+	}
+	ss.logger.Infof("bind address %s is translated to %s on the host", sa.IP, hostIP)
+
+	sockfdOnHost, err := syscall.Socket(ss.sockDomain, ss.sockType, ss.sockProto)
+	if err != nil {
+		ss.logger.Errorf("failed to create socket: %q", err)
+		ss.state = NotBypassable
+		return
+	}
+	defer syscall.Close(sockfdOnHost)
+
+	err = ss.configureSocket(sockfdOnHost)
+	if err != nil {
+		ss.logger.Errorf("failed to configure socket: %q", err)
+		ss.state = NotBypassable
+		return
+	}
+
+	// SO_REUSEPORT is configured before bind(2) by configureSocket, so the host sockets for the published port are in the same group.
+	reuseport := ss.reuseport()
+
+	var bind_addr syscall.Sockaddr
+
+	switch sa.Family {
+	case syscall.AF_INET:
+		var addr [4]byte
+		copy(addr[:], hostIP.To4())
+		bind_addr = &syscall.SockaddrInet4{
+			Port: fwdPort.HostPort,
+			Addr: addr,
+		}
+	case syscall.AF_INET6:
+		var addr [16]byte
+		copy(addr[:], hostIP.To16())
+		bind_addr = &syscall.SockaddrInet6{
+			Port: fwdPort.HostPort,
+			Addr: addr,
+		}
+		// zone is meaningful only for the address in the container
+		if hostIP.Equal(sa.IP) {
+			bind_addr.(*syscall.SockaddrInet6).ZoneId = sa.ScopeID
+		}
+	}
+
+	err = syscall.Bind(sockfdOnHost, bind_addr)
+	if err != nil {
+		ss.logger.Errorf("bind failed: %s", err)
+		ss.state = NotBypassable
+		return
+	}
+
+	err = ss.injectSocket(ctx, sockfdOnHost)
+	if err != nil {
+		ss.logger.Errorf("ioctl NotifAddFd failed: %s", err)
+		ss.state = NotBypassable
+		return
+	}
+
+	ss.state = Bypassed
+	ss.bypassedBind = true
+	if reuseport {
+		handler.joinReuseportGroup(ss, fwdPort, hostIP)
+	}
+	ss.logger.Infof("bypassed bind socket for %s:%d:%d is done", hostIP, fwdPort.HostPort, fwdPort.ChildPort)
+
+	ctx.resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+}
+
+func (ss *socketStatus) handleSysGetpeername(handler *notifHandler, ctx *context) {
+	if ss.addr == nil {
+		return
+	}
+
+	err := handler.writeSockaddrToProcess(ss.pid, ctx.req.Data.Args[1], ctx.req.Data.Args[2], ss.addr)
+	if err != nil {
+		ss.logger.WithError(err).Errorf("failed to write address %s", ss.addr)
+		return
+	}
+
+	ctx.resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+
+	ss.logger.Infof("rewrite getpeername() address to %s", ss.addr)
+}
+
+// localAddress returns the local address of the bypassed socket seen from the container.
+func (ss *socketStatus) localAddress(handler *notifHandler) (*sockaddr, error) {
+	if ss.bypassedBind && ss.addr != nil {
+		// the address requested by bind(2)
+		return ss.addr, nil
+	}
+
+	sockfd, err := handler.getFdInProcess(ss.pid, ss.sockfd)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(sockfd)
+
+	usa, err := unix.Getsockname(sockfd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to getsockname: %w", err)
+	}
+	local, err := newSockaddrFromUnix(usa)
+	if err != nil {
+		return nil, err
+	}
+
+	// sockets accepted by bypassed listeners have host-side port
+	for _, fwd := range handler.forwardingPorts {
+		if fwd.HostPort == local.Port {
+			local.Port = fwd.ChildPort
+			break
+		}
+	}
+
+	if !local.IP.IsUnspecified() {
+		contIP := handler.containerAddress(ss.sockDomain)
+		if contIP == nil {
+			return nil, fmt.Errorf("container address for domain %d is not found", ss.sockDomain)
+		}
+		local.IP = contIP
+		local.Flowinfo = 0
+		local.ScopeID = 0
+	}
+
+	return local, nil
+}
+
+func (ss *socketStatus) handleSysGetsockname(handler *notifHandler, ctx *context) {
+	local, err := ss.localAddress(handler)
+	if err != nil {
+		ss.logger.WithError(err).Warn("failed to get local address")
+		return
+	}
+
+	err = handler.writeSockaddrToProcess(ss.pid, ctx.req.Data.Args[1], ctx.req.Data.Args[2], local)
+	if err != nil {
+		ss.logger.WithError(err).Errorf("failed to write address %s", local)
+		return
+	}
+
+	ctx.resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+
+	ss.logger.Infof("rewrite getsockname() address to %s", local)
+}
+
+// registerC2CConnection binds the host socket to the loopback address and registers its address
+// with the container's address, so that the destination container can see the container's address as the peer.
+func (ss *socketStatus) registerC2CConnection(handler *notifHandler, sockfd int, dest *destination) error {
+	// the source address must be the same family as the destination.
+	// IPv4-mapped destination is accepted by IPv4 sockets and the container is identified by its IPv4 address.
+	var bindAddr syscall.Sockaddr
+	var contIP net.IP
+	switch {
+	case ss.sockDomain == syscall.AF_INET:
+		bindAddr = &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}
+		contIP = handler.containerAddress(syscall.AF_INET)
+	case ss.sockDomain == syscall.AF_INET6 && dest.hostAddr.To4() != nil:
+		sa6 := &syscall.SockaddrInet6{}
+		copy(sa6.Addr[:], net.IPv4(127, 0, 0, 1).To16())
+		bindAddr = sa6
+		if ip := handler.containerAddress(syscall.AF_INET); ip != nil {
+			contIP = ip.To16()
+		}
+	case ss.sockDomain == syscall.AF_INET6:
+		bindAddr = &syscall.SockaddrInet6{Addr: [16]byte{15: 1}}
+		contIP = handler.containerAddress(syscall.AF_INET6)
+	default:
+		return fmt.Errorf("unexpected socket domain %d", ss.sockDomain)
+	}
+	if contIP == nil {
+		return fmt.Errorf("container address for destination %s is not found", dest.hostAddr)
+	}
+
+	err := syscall.Bind(sockfd, bindAddr)
+	if err != nil {
+		return fmt.Errorf("failed to bind: %w", err)
+	}
+	usa, err := unix.Getsockname(sockfd)
+	if err != nil {
+		return fmt.Errorf("failed to getsockname: %w", err)
+	}
+	localAddr, err := newSockaddrFromUnix(usa)
+	if err != nil {
+		return err
+	}
+
+	conn := &com.ContainerConnection{
+		HostAddress:      net.JoinHostPort(localAddr.IP.String(), strconv.Itoa(localAddr.Port)),
+		ContainerID:      handler.state.State.ID,
+		ContainerAddress: net.JoinHostPort(contIP.String(), strconv.Itoa(localAddr.Port)),
+		DestinationPort:  dest.hostPort,
+	}
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 2*time.Second)
+	defer cancel()
+	_, err = handler.comClient.PostConnection(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("failed to post connection: %w", err)
+	}
+	ss.c2cHostAddr = conn.HostAddress
+	ss.logger.Infof("registered connection %s as %s", conn.HostAddress, conn.ContainerAddress)
+
+	return nil
+}
+
+// handleSysAccept accepts the connection on the bypassed listener on behalf of the process,
+// so that the peer address of connections from other bypassed containers can be virtualized.
+// The connection is waited for and accepted asynchronously not to block the other requests handled by the worker.
+// accept(2) is continued in the process when no connection from other bypassed containers is pending.
+func (ss *socketStatus) handleSysAccept(handler *notifHandler, ctx *context, flags int) {
+	if handler.comClient == nil || !handler.c2cConnections.Enable || ss.isDatagram() {
+		return
+	}
+
+	listenfd, err := handler.getFdInProcess(ss.pid, ss.sockfd)
+	if err != nil {
+		ss.logger.WithError(err).Warn("failed to get listener socket")
+		return
+	}
+	// the file status flags are shared with the fd in the process
+	fl, err := unix.FcntlInt(uintptr(listenfd), unix.F_GETFL, 0)
+	if err != nil {
+		syscall.Close(listenfd)
+		ss.logger.WithError(err).Warn("failed to get file status flags of listener socket")
+		return
+	}
+	nonblock := fl&unix.O_NONBLOCK != 0
+	if nonblock {
+		ready, _, err := pollAccept(listenfd, -1, 0)
+		if err != nil || !ready {
+			// accept(2) fails with EAGAIN in the process
+			syscall.Close(listenfd)
+			return
+		}
+	}
+
+	ctx.deferResponse = true
+	stopfd := handler.stopfd
+	handler.deferred.Add(1)
+	go func() {
+		defer handler.deferred.Done()
+		ss.waitAccept(handler, ctx, listenfd, flags, nonblock, stopfd)
+	}()
+}
+
+// pollAccept waits for a connection on the listener up to timeout.
+// stopped is true when stopfd is readable, i.e. the handler is stopped for the handover.
+func pollAccept(listenfd, stopfd int, timeout time.Duration) (ready bool, stopped bool, err error) {
+	fds := []unix.PollFd{{Fd: int32(listenfd), Events: unix.POLLIN}}
+	if stopfd >= 0 {
+		fds = append(fds, unix.PollFd{Fd: int32(stopfd), Events: unix.POLLIN})
+	}
+	for {
+		n, err := unix.Poll(fds, int(timeout.Milliseconds()))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, false, err
+		}
+		if n == 0 {
+			return false, false, nil
+		}
+		if len(fds) > 1 && fds[1].Revents != 0 {
+			return false, true, nil
+		}
+		return fds[0].Revents != 0, false, nil
+	}
+}
+
+// waitAccept waits for a connection on listenfd and accepts it for the blocked process.
+// accept(2) is continued in the process when the handler is stopped for the handover
+// or the pending connection is not from other bypassed containers. listenfd is closed.
+func (ss *socketStatus) waitAccept(handler *notifHandler, ctx *context, listenfd int, flags int, nonblock bool, stopfd int) {
+	defer syscall.Close(listenfd)
+
+	var connfd int
+	var usa unix.Sockaddr
+	for {
+		// the process can be interrupted by signals while waiting
+		if err := libseccomp.NotifIDValid(ctx.notifFd, ctx.req.ID); err != nil {
+			ss.logger.Infof("accept(2) is cancelled: %q", err)
+			return
+		}
+		ready, stopped, err := pollAccept(listenfd, stopfd, time.Second)
+		if err != nil || stopped {
+			ss.respondAccept(ctx)
+			return
+		}
+		if !ready {
+			continue
+		}
+		// connections are registered before connect(2), so the pending one is registered if it is from other containers.
+		if !handler.hasC2CConnections(listenfd) {
+			ss.respondAccept(ctx)
+			return
+		}
+		connfd, usa, err = handler.acceptConn(listenfd)
+		if err == unix.EAGAIN {
+			// other process or thread accepted the connection.
+			if nonblock {
+				ctx.resp.Error = -int32(syscall.EAGAIN)
+				ctx.resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+				ss.respondAccept(ctx)
+				return
+			}
+			continue
+		}
+		if err != nil {
+			ss.logger.WithError(err).Debug("accept4 in handler failed")
+			ss.respondAccept(ctx)
+			return
+		}
+		break
+	}
+	defer syscall.Close(connfd)
+
+	if flags&syscall.SOCK_NONBLOCK == 0 {
+		if err := unix.SetNonblock(connfd, false); err != nil {
+			ss.logger.WithError(err).Error("failed to clear O_NONBLOCK")
+		}
+	}
+
+	peer, err := newSockaddrFromUnix(usa)
+	if err != nil {
+		ss.logger.WithError(err).Error("failed to parse peer address")
+		ctx.resp.Error = -int32(syscall.ECONNABORTED)
+		ctx.resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		ss.respondAccept(ctx)
+		return
+	}
+	// the connection is looked up without the lock not to block the other requests of the process
+	if virtPeer := handler.lookupC2CPeer(peer); virtPeer != nil {
+		ss.logger.Infof("peer address %s is virtualized to %s", peer, virtPeer)
+		peer = virtPeer
+	}
+
+	// the accepted fd is registered before the other requests of the process are handled
+	if proc, ok := handler.getProcess(ss.pid); ok {
+		proc.mu.Lock()
+		defer proc.mu.Unlock()
+	}
+	if ss.installAccepted(handler, ctx, connfd, peer, flags) {
+		return
+	}
+	ss.respondAccept(ctx)
+}
+
+// acceptConn accepts the pending connection on listenfd without blocking.
+// The listener can be blocking, so the connections are checked and accepted exclusively for each listener.
+func (h *notifHandler) acceptConn(listenfd int) (int, unix.Sockaddr, error) {
+	ino, err := fileInode(listenfd)
+	if err != nil {
+		return -1, nil, err
+	}
+	unlock := h.lockListener(ino)
+	defer unlock()
+	ready, _, err := pollAccept(listenfd, -1, 0)
+	if err != nil {
+		return -1, nil, err
+	}
+	if !ready {
+		return -1, nil, unix.EAGAIN
+	}
+	return unix.Accept4(listenfd, unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+}
+
+// lockListener locks the listener identified by ino and returns the function to unlock it.
+func (h *notifHandler) lockListener(ino uint64) func() {
+	h.listenerLocksMu.Lock()
+	l, ok := h.listenerLocks[ino]
+	if !ok {
+		l = &listenerLock{}
+		h.listenerLocks[ino] = l
+	}
+	l.refs++
+	h.listenerLocksMu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		h.listenerLocksMu.Lock()
+		defer h.listenerLocksMu.Unlock()
+		l.refs--
+		if l.refs == 0 {
+			delete(h.listenerLocks, ino)
+		}
+	}
+}
+
+// installAccepted installs the accepted connection in the process as the result of accept(2).
+// It returns true when the response is sent with the fd.
+func (ss *socketStatus) installAccepted(handler *notifHandler, ctx *context, connfd int, peer *sockaddr, flags int) bool {
+	// the address is written before the response because the process may resume with the response.
+	if ctx.req.Data.Args[1] != 0 {
+		err := handler.writeSockaddrToProcess(ss.pid, ctx.req.Data.Args[1], ctx.req.Data.Args[2], peer)
+		if err != nil {
+			ss.logger.WithError(err).Errorf("failed to write address %s", peer)
+		}
+	}
+
+	addfd := seccompNotifAddFd{
+		id:         ctx.req.ID,
+		flags:      0,
+		srcfd:      uint32(connfd),
+		newfd:      0,
+		newfdFlags: uint32(flags & syscall.SOCK_CLOEXEC),
+	}
+	// the fd is installed and returned by accept(2) atomically if supported.
+	// otherwise the process can lose the installed fd when it is interrupted before the response.
+	newfd, sent, err := addfd.ioctlNotifAddFdSend(ctx.notifFd)
+	if err == nil && !sent {
+		newfd, err = addfd.ioctlNotifAddFd(ctx.notifFd)
+	}
+	if err != nil {
+		// the connection is already consumed.
+		ss.logger.WithError(err).Error("ioctl NotifAddFd failed")
+		ctx.resp.Error = -int32(syscall.ECONNABORTED)
+		ctx.resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		return false
+	}
+
+	accepted := newSocketStatus(ss.pid, newfd, ss.sockDomain, ss.sockType&sockTypeMask|flags, ss.sockProto, ss.ignoreBind)
+	accepted.state = Bypassed
+	accepted.addr = peer
+	if ino, err := fileInode(connfd); err == nil {
+		accepted.ino = ino
+		handler.trackInode(accepted)
+	}
+	handler.addSocket(ss.pid, newfd, accepted, flags&syscall.SOCK_CLOEXEC != 0)
+
+	ctx.resp.Val = uint64(newfd)
+	ctx.resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+	ss.logger.Infof("accepted connection from %s as fd %d", peer, newfd)
+	return sent
+}
+
+// respondAccept sends the response of accept(2) handled asynchronously.
+func (ss *socketStatus) respondAccept(ctx *context) {
+	if err := libseccomp.NotifRespond(ctx.notifFd, ctx.resp); err != nil {
+		ss.logger.Errorf("Error in notification response: %s", err)
+	}
+}
+
+// tcpFastopenOptionSupported checks whether the TCP Fast Open option can be configured on the host.
+// Other options are always configured.
+func tcpFastopenOptionSupported(optVal socketOption) bool {
+	if optVal.level != unix.IPPROTO_TCP {
+		return true
+	}
+	switch optVal.optname {
+	case unix.TCP_FASTOPEN:
+		return hostTCPFastopen()&tcpFastopenServer != 0
+	case unix.TCP_FASTOPEN_CONNECT:
+		return hostTCPFastopen()&tcpFastopenClient != 0
+	}
+	return true
+}
+
+func (ss *socketStatus) configureSocket(sockfd int) error {
+	for _, optVal := range ss.socketOptions {
+		if !tcpFastopenOptionSupported(optVal) {
+			// the connection works without TCP Fast Open
+			ss.logger.Warnf("TCP Fast Open is disabled on the host, socket option val=%v is not configured", optVal)
+			continue
+		}
 		_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(sockfd), uintptr(optVal.level), uintptr(optVal.optname), uintptr(unsafe.Pointer(&optVal.optval[0])), uintptr(optVal.optlen), 0)
 		if errno != 0 {
 			return fmt.Errorf("setsockopt failed(%v): %s", optVal, errno)
@@ -0,0 +1,270 @@
+package bypass4netns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestTranslateBindAddress(t *testing.T) {
+	containerAddrs := []net.IP{net.ParseIP("10.4.0.5"), net.ParseIP("fd00::5")}
+
+	// wildcard is bound to the wildcard
+	ip, err := translateBindAddress(BindAddressPolicyWildcard, net.ParseIP("0.0.0.0"), syscall.AF_INET, containerAddrs, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "0.0.0.0", ip.String())
+	ip, err = translateBindAddress(BindAddressPolicyWildcard, net.ParseIP("::"), syscall.AF_INET6, containerAddrs, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "::", ip.String())
+
+	// container's address is bound to the wildcard
+	ip, err = translateBindAddress(BindAddressPolicyWildcard, net.ParseIP("10.4.0.5"), syscall.AF_INET, containerAddrs, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "0.0.0.0", ip.String())
+	ip, err = translateBindAddress(BindAddressPolicyWildcard, net.ParseIP("fd00::5"), syscall.AF_INET6, containerAddrs, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "::", ip.String())
+
+	// parent IP is used if specified
+	ip, err = translateBindAddress(BindAddressPolicyWildcard, net.ParseIP("10.4.0.5"), syscall.AF_INET, containerAddrs, net.ParseIP("192.168.1.1"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "192.168.1.1", ip.String())
+	assert.Equal(t, 4, len(ip))
+	ip, err = translateBindAddress(BindAddressPolicyWildcard, net.ParseIP("::"), syscall.AF_INET6, containerAddrs, net.ParseIP("192.168.1.1"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 16, len(ip))
+	_, err = translateBindAddress(BindAddressPolicyWildcard, net.ParseIP("0.0.0.0"), syscall.AF_INET, containerAddrs, net.ParseIP("fd00::1"))
+	assert.NotEqual(t, nil, err)
+
+	// strict policy bypasses only the wildcard
+	ip, err = translateBindAddress(BindAddressPolicyStrict, net.ParseIP("0.0.0.0"), syscall.AF_INET, containerAddrs, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "0.0.0.0", ip.String())
+	_, err = translateBindAddress(BindAddressPolicyStrict, net.ParseIP("10.4.0.5"), syscall.AF_INET, containerAddrs, nil)
+	assert.NotEqual(t, nil, err)
+
+	// loopback and unknown addresses are not bypassed
+	_, err = translateBindAddress(BindAddressPolicyWildcard, net.ParseIP("127.0.0.1"), syscall.AF_INET, containerAddrs, nil)
+	assert.NotEqual(t, nil, err)
+	_, err = translateBindAddress(BindAddressPolicyWildcard, net.ParseIP("::1"), syscall.AF_INET6, containerAddrs, nil)
+	assert.NotEqual(t, nil, err)
+	// the addresses are retrieved again with this error
+	_, err = translateBindAddress(BindAddressPolicyWildcard, net.ParseIP("10.4.0.6"), syscall.AF_INET, containerAddrs, nil)
+	assert.True(t, errors.Is(err, errNotContainerAddress))
+}
+
+func TestReuseport(t *testing.T) {
+	sock := newSocketStatus(1, 3, syscall.AF_INET, syscall.SOCK_STREAM, 0, false)
+	assert.Equal(t, false, sock.reuseport())
+
+	enable := make([]byte, 4)
+	binary.NativeEndian.PutUint32(enable, 1)
+	sock.socketOptions = append(sock.socketOptions, socketOption{level: unix.SOL_SOCKET, optname: unix.SO_REUSEPORT, optval: enable, optlen: 4})
+	assert.Equal(t, true, sock.reuseport())
+
+	// the last one is effective
+	sock.socketOptions = append(sock.socketOptions, socketOption{level: unix.SOL_SOCKET, optname: unix.SO_REUSEPORT, optval: make([]byte, 4), optlen: 4})
+	assert.Equal(t, false, sock.reuseport())
+}
+
+func TestPollConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	port := l.Addr().(*net.TCPAddr).Port
+
+	connect := func(timeout time.Duration) (int, error) {
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_NONBLOCK, 0)
+		assert.Equal(t, nil, err)
+		err = unix.Connect(fd, &unix.SockaddrInet4{Port: port, Addr: [4]byte{127, 0, 0, 1}})
+		if err == unix.EINPROGRESS {
+			_, err = pollConnect(fd, -1, timeout)
+		}
+		return fd, err
+	}
+
+	fd, err := connect(time.Second)
+	assert.Equal(t, nil, err)
+	unix.Close(fd)
+
+	l.Close()
+	fd, err = connect(time.Second)
+	assert.Equal(t, unix.ECONNREFUSED, err)
+	unix.Close(fd)
+
+	// the connection refused on loopback fails without waiting, so non-blocking connect(2) is fallen back
+	fd, err = connect(0)
+	assert.Equal(t, unix.ECONNREFUSED, err)
+	unix.Close(fd)
+}
+
+func TestPollConnectStopped(t *testing.T) {
+	stopfd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	assert.Equal(t, nil, err)
+	defer unix.Close(stopfd)
+	// the read end of a pipe is never writable like the connection not established
+	var p [2]int
+	assert.Equal(t, nil, unix.Pipe2(p[:], unix.O_CLOEXEC))
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+	fd := p[0]
+
+	stopped, err := pollConnect(fd, stopfd, 10*time.Millisecond)
+	assert.False(t, stopped)
+	assert.Equal(t, unix.EINPROGRESS, err)
+
+	// the handler is stopped
+	_, err = unix.Write(stopfd, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+	assert.Equal(t, nil, err)
+	start := time.Now()
+	stopped, err = pollConnect(fd, stopfd, 10*time.Second)
+	assert.True(t, stopped)
+	assert.Equal(t, unix.EINPROGRESS, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestPollAccept(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer l.Close()
+	lf, err := l.(*net.TCPListener).File()
+	assert.Equal(t, nil, err)
+	defer lf.Close()
+	listenfd := int(lf.Fd())
+	stopfd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	assert.Equal(t, nil, err)
+	defer unix.Close(stopfd)
+
+	// no connection is pending
+	ready, stopped, err := pollAccept(listenfd, stopfd, 10*time.Millisecond)
+	assert.Equal(t, nil, err)
+	assert.False(t, ready)
+	assert.False(t, stopped)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	ready, stopped, err = pollAccept(listenfd, stopfd, time.Second)
+	assert.Equal(t, nil, err)
+	assert.True(t, ready)
+	assert.False(t, stopped)
+
+	// the handler is stopped
+	_, err = unix.Write(stopfd, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+	assert.Equal(t, nil, err)
+	_, stopped, err = pollAccept(listenfd, stopfd, time.Second)
+	assert.Equal(t, nil, err)
+	assert.True(t, stopped)
+}
+
+func TestAcceptConn(t *testing.T) {
+	h := newTestNotifHandler(t, "container", 100, &containerConfig{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer l.Close()
+	lf, err := l.(*net.TCPListener).File()
+	assert.Equal(t, nil, err)
+	defer lf.Close()
+	listenfd := int(lf.Fd())
+	// the listener is blocking in the process
+	assert.Equal(t, nil, unix.SetNonblock(listenfd, false))
+
+	// accept(2) does not block without pending connections
+	_, _, err = h.acceptConn(listenfd)
+	assert.Equal(t, unix.EAGAIN, err)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	assert.Eventually(t, func() bool {
+		ready, _, _ := pollAccept(listenfd, -1, 0)
+		return ready
+	}, time.Second, 10*time.Millisecond)
+	connfd, _, err := h.acceptConn(listenfd)
+	assert.Equal(t, nil, err)
+	unix.Close(connfd)
+
+	// the lock of the listener is released
+	assert.Equal(t, 0, len(h.listenerLocks))
+}
+
+func TestLockListener(t *testing.T) {
+	h := newTestNotifHandler(t, "container", 100, &containerConfig{})
+
+	unlock1 := h.lockListener(1)
+	// the other listener is not blocked
+	unlock2 := h.lockListener(2)
+	unlock2()
+
+	locked := make(chan struct{})
+	go func() {
+		unlock := h.lockListener(1)
+		close(locked)
+		unlock()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("the listener is locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock1()
+	<-locked
+	assert.Eventually(t, func() bool {
+		h.listenerLocksMu.Lock()
+		defer h.listenerLocksMu.Unlock()
+		return len(h.listenerLocks) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestPendingSockets(t *testing.T) {
+	proc := newProcessStatus()
+	proc.addPendingSocket(socketArgs{sockDomain: syscall.AF_INET, sockType: syscall.SOCK_DGRAM})
+	proc.addPendingSocket(socketArgs{sockDomain: syscall.AF_INET, sockType: syscall.SOCK_STREAM | syscall.SOCK_NONBLOCK, sockProto: unix.IPPROTO_MPTCP})
+	proc.addPendingSocket(socketArgs{sockDomain: syscall.AF_INET, sockType: syscall.SOCK_STREAM})
+
+	_, ok := proc.popPendingSocket(syscall.AF_INET6, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	assert.False(t, ok)
+	// the protocol is matched
+	args, ok := proc.popPendingSocket(syscall.AF_INET, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	assert.True(t, ok)
+	assert.Equal(t, 0, args.sockProto)
+	args, ok = proc.popPendingSocket(syscall.AF_INET, syscall.SOCK_STREAM, unix.IPPROTO_MPTCP)
+	assert.True(t, ok)
+	assert.Equal(t, unix.IPPROTO_MPTCP, args.sockProto)
+	assert.Equal(t, 1, len(proc.pendingSockets))
+
+	// the oldest ones are dropped
+	for i := 0; i < maxPendingSockets; i++ {
+		proc.addPendingSocket(socketArgs{sockDomain: syscall.AF_INET6, sockType: syscall.SOCK_STREAM, sockProto: syscall.IPPROTO_TCP})
+	}
+	assert.Equal(t, maxPendingSockets, len(proc.pendingSockets))
+	_, ok = proc.popPendingSocket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	assert.False(t, ok)
+	args, ok = proc.popPendingSocket(syscall.AF_INET6, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	assert.True(t, ok)
+	assert.Equal(t, syscall.IPPROTO_TCP, args.sockProto)
+}
+
+func TestTrackInode(t *testing.T) {
+	h := newTestNotifHandler(t, "container", 100, &containerConfig{})
+	sock := newSocketStatus(100, 3, syscall.AF_INET, syscall.SOCK_STREAM, 0, false)
+	sock.ino = 1234
+	h.trackInode(sock)
+	// the socket is counted once
+	h.trackInode(sock)
+	c, err := sock.cloneForProcess(101, 3)
+	assert.Equal(t, nil, err)
+	h.trackInode(c)
+	assert.True(t, h.isInodeTracked(1234))
+
+	h.releaseSocket(sock)
+	h.releaseSocket(sock)
+	assert.True(t, h.isInodeTracked(1234))
+	h.releaseSocket(c)
+	assert.False(t, h.isInodeTracked(1234))
+}
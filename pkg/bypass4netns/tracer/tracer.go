@@ -3,6 +3,7 @@ package tracer
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -67,6 +68,24 @@ func (x *Tracer) StartTracer(ctx context.Context, pid int) error {
 	return nil
 }
 
+// StopTracer kills the tracer and waits for it to exit.
+func (x *Tracer) StopTracer() error {
+	if x.tracerCmd == nil || x.tracerCmd.Process == nil {
+		return nil
+	}
+	if err := x.tracerCmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	// unblock the goroutines copying stdin and stdout
+	for _, p := range []interface{}{x.reader, x.writer} {
+		if c, ok := p.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	_ = x.tracerCmd.Wait()
+	return nil
+}
+
 func (x *Tracer) RegisterForwardPorts(ports []int) error {
 	cmd := TracerCommand{
 		Cmd:             RegisterForwardPorts,
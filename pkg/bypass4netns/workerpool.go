@@ -0,0 +1,95 @@
+package bypass4netns
+
+import (
+	"sync"
+)
+
+// notifWorkerPool runs the jobs concurrently.
+// The jobs with the same key are run by one worker at a time in the dispatched order.
+// The jobs are queued for each key, so the jobs of a blocked key do not delay the other keys.
+type notifWorkerPool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// queues holds the jobs of the keys queued or being run
+	queues map[int][]func()
+	// ready are the keys waiting for a worker
+	ready  []int
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newNotifWorkerPool(workers int) *notifWorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &notifWorkerPool{
+		queues: map[int][]func(){},
+	}
+	p.cond = sync.NewCond(&p.mu)
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for {
+				key, ok := p.next()
+				if !ok {
+					return
+				}
+				for job := p.pop(key); job != nil; job = p.pop(key) {
+					job()
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// dispatch queues the job for the key without blocking.
+// Each thread of the container has one notification at most, so the queue of a key does not grow unboundedly.
+func (p *notifWorkerPool) dispatch(key int, job func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	jobs, ok := p.queues[key]
+	p.queues[key] = append(jobs, job)
+	if !ok {
+		p.ready = append(p.ready, key)
+		p.cond.Signal()
+	}
+}
+
+// next waits for the key to run. ok is false when the pool is closed and no key is ready.
+func (p *notifWorkerPool) next() (key int, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.ready) == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if len(p.ready) == 0 {
+		return 0, false
+	}
+	key = p.ready[0]
+	p.ready = p.ready[1:]
+	return key, true
+}
+
+// pop returns the next job of the key. nil is returned and the key is released when no job is queued.
+func (p *notifWorkerPool) pop(key int) func() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	jobs := p.queues[key]
+	if len(jobs) == 0 {
+		delete(p.queues, key)
+		return nil
+	}
+	p.queues[key] = jobs[1:]
+	return jobs[0]
+}
+
+// close waits for the queued jobs to finish and stops the workers.
+func (p *notifWorkerPool) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	p.wg.Wait()
+}
@@ -0,0 +1,127 @@
+package bypass4netns
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestNotifWorkerPoolOrder(t *testing.T) {
+	pool := newNotifWorkerPool(4)
+
+	var mu sync.Mutex
+	results := map[int][]int{}
+	for i := 0; i < 100; i++ {
+		for key := 0; key < 10; key++ {
+			key, i := key, i
+			pool.dispatch(key, func() {
+				mu.Lock()
+				defer mu.Unlock()
+				results[key] = append(results[key], i)
+			})
+		}
+	}
+	pool.close()
+
+	for key := 0; key < 10; key++ {
+		assert.Equal(t, 100, len(results[key]))
+		for i, v := range results[key] {
+			assert.Equal(t, i, v)
+		}
+	}
+}
+
+func TestNotifWorkerPoolNonBlocking(t *testing.T) {
+	pool := newNotifWorkerPool(2)
+	defer pool.close()
+
+	// the key is blocked with more jobs than the workers
+	blocked := make(chan struct{})
+	for i := 0; i < 1000; i++ {
+		pool.dispatch(0, func() {
+			<-blocked
+		})
+	}
+	defer close(blocked)
+
+	// the other keys are not delayed
+	done := make(chan struct{})
+	for key := 1; key <= 10; key++ {
+		pool.dispatch(key*2, func() {
+			done <- struct{}{}
+		})
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("jobs of the other keys are blocked")
+		}
+	}
+}
+
+// BenchmarkNotifWorkerPoolConnect measures the latency of concurrent connect(2)s from the threads of a process
+// dispatched to the pool while another thread is blocked in its request, e.g. waiting for etcd.
+func BenchmarkNotifWorkerPoolConnect(b *testing.B) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(b, nil, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	addr := &unix.SockaddrInet4{Port: l.Addr().(*net.TCPAddr).Port, Addr: [4]byte{127, 0, 0, 1}}
+
+	const threads = 64
+	workers := runtime.NumCPU()
+	if workers < 2 {
+		workers = 2
+	}
+	pool := newNotifWorkerPool(workers)
+	defer pool.close()
+	blocked := make(chan struct{})
+	defer close(blocked)
+	pool.dispatch(1, func() {
+		<-blocked
+	})
+
+	var latency int64
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		var wg sync.WaitGroup
+		for tid := 2; tid < threads+2; tid++ {
+			wg.Add(1)
+			start := time.Now()
+			pool.dispatch(tid, func() {
+				defer wg.Done()
+				fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer unix.Close(fd)
+				err = unix.Connect(fd, addr)
+				if err == unix.EINPROGRESS {
+					_, err = pollConnect(fd, -1, time.Second)
+				}
+				if err != nil {
+					b.Error(err)
+				}
+				atomic.AddInt64(&latency, int64(time.Since(start)))
+			})
+		}
+		wg.Wait()
+	}
+	b.ReportMetric(float64(latency)/float64(b.N*threads)/float64(time.Microsecond), "us/connect")
+}
@@ -1,16 +1,21 @@
 package bypass4netnsd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/rootless-containers/bypass4netns/pkg/api"
 	"github.com/rootless-containers/bypass4netns/pkg/api/com"
+	handlerapi "github.com/rootless-containers/bypass4netns/pkg/api/handler"
+	"github.com/rootless-containers/bypass4netns/pkg/oci"
 	"github.com/rootless-containers/bypass4netns/pkg/util"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
@@ -23,21 +28,39 @@ type Driver struct {
 	lock                 sync.RWMutex
 	containerInterfaces  map[string]com.ContainerInterfaces
 	interfacesLock       sync.RWMutex
+	// key is host-side address of the connection
+	connections          map[string]com.ContainerConnection
+	connectionsLock      sync.RWMutex
 	HandleC2CEnable      bool
 	TracerEnable         bool
 	MultinodeEnable      bool
 	MultinodeEtcdAddress string
 	MultinodeHostAddress string
+	// HandlerSocketPath receives the seccomp fds of the containers without their own sockets
+	HandlerSocketPath string
+	// HandlerAPISocketPath is used to add the containers to bypass4netns
+	HandlerAPISocketPath string
+	// handler is the bypass4netns process shared by the containers.
+	// It is started for the first container and terminated after the last container.
+	handler *handlerProcess
 }
 
+// handlerStopTimeout limits the time to wait for bypass4netns terminated with SIGTERM.
+const handlerStopTimeout = 10 * time.Second
+
 func NewDriver(execPath string, comSocketPath string) *Driver {
+	dir := filepath.Dir(comSocketPath)
 	return &Driver{
 		BypassExecutablePath: execPath,
 		ComSocketPath:        comSocketPath,
+		HandlerSocketPath:    filepath.Join(dir, oci.SocketName),
+		HandlerAPISocketPath: filepath.Join(dir, "bypass4netnsd-handler-api.sock"),
 		bypass:               map[string]api.BypassStatus{},
 		lock:                 sync.RWMutex{},
 		containerInterfaces:  map[string]com.ContainerInterfaces{},
 		interfacesLock:       sync.RWMutex{},
+		connections:          map[string]com.ContainerConnection{},
+		connectionsLock:      sync.RWMutex{},
 		TracerEnable:         false,
 		MultinodeEnable:      false,
 	}
@@ -58,39 +81,109 @@ func (d *Driver) ListBypass() []api.BypassStatus {
 func (d *Driver) StartBypass(spec *api.BypassSpec) (*api.BypassStatus, error) {
 	logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(spec.ID)})
 	logger.Info("Starting bypass")
-	b4nnArgs := []string{}
+	d.lock.Lock()
+	defer d.lock.Unlock()
 
-	if logger.Logger.GetLevel() == logrus.DebugLevel {
-		b4nnArgs = append(b4nnArgs, "--debug")
+	if _, ok := d.bypass[spec.ID]; ok {
+		return nil, fmt.Errorf("bypass %s is already started", spec.ID)
+	}
+	if err := d.startHandler(); err != nil {
+		return nil, err
+	}
+	if spec.LogFilePath != "" {
+		logger.Infof("log file %s is not used. bypass4netns handling the containers logs to the stderr of bypass4netnsd", spec.LogFilePath)
+	}
+	if err := d.handler.client.AddContainer(context.TODO(), spec); err != nil {
+		d.stopHandlerIfUnused()
+		return nil, fmt.Errorf("failed to add container to bypass4netns: %w", err)
+	}
+	pid := d.handler.cmd.Process.Pid
+	if spec.PidFilePath != "" {
+		if err := os.WriteFile(spec.PidFilePath, []byte(strconv.Itoa(pid)), 0o644); err != nil {
+			logger.WithError(err).Warnf("failed to write pid file %s", spec.PidFilePath)
+		}
 	}
 
-	if spec.SocketPath != "" {
-		socketOption := fmt.Sprintf("--socket=%s", spec.SocketPath)
-		b4nnArgs = append(b4nnArgs, socketOption)
+	status := api.BypassStatus{
+		ID:   spec.ID,
+		Pid:  pid,
+		Spec: *spec,
 	}
 
-	if spec.PidFilePath != "" {
-		pidFileOption := fmt.Sprintf("--pid-file=%s", spec.PidFilePath)
-		b4nnArgs = append(b4nnArgs, pidFileOption)
+	d.bypass[status.ID] = status
+	logger.Info("Started bypass")
+
+	return &status, nil
+}
+
+func (d *Driver) StopBypass(id string) error {
+	logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(id)})
+	logger.Infof("Stopping bypass")
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	bStatus, ok := d.bypass[id]
+	if !ok {
+		return fmt.Errorf("child %s not found", id)
 	}
 
-	if spec.LogFilePath != "" {
-		logFileOption := fmt.Sprintf("--log-file=%s", spec.LogFilePath)
-		b4nnArgs = append(b4nnArgs, logFileOption)
+	if d.handler != nil && !d.handler.exited() {
+		if err := d.handler.client.RemoveContainer(context.TODO(), id); err != nil {
+			logger.WithError(err).Warn("failed to remove container from bypass4netns")
+		}
+	}
+	if bStatus.Spec.PidFilePath != "" {
+		if err := os.Remove(bStatus.Spec.PidFilePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.WithError(err).Warnf("failed to remove pid file %s", bStatus.Spec.PidFilePath)
+		}
 	}
 
-	for _, port := range spec.PortMapping {
-		b4nnArgs = append(b4nnArgs, fmt.Sprintf("-p=%d:%d", port.ParentPort, port.ChildPort))
+	delete(d.bypass, id)
+	d.stopHandlerIfUnused()
+	logger.Info("Stopped bypass")
+
+	// remove the container's interfaces and connections
+	d.DeleteInterface(id)
+	d.deleteConnectionsOf(id)
+
+	return nil
+}
+
+// handlerProcess is the bypass4netns process handling the containers.
+type handlerProcess struct {
+	cmd    *exec.Cmd
+	client *handlerapi.Client
+	// done is closed when the process exits
+	done chan struct{}
+}
+
+func (p *handlerProcess) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
 	}
+}
 
-	for _, subnet := range spec.IgnoreSubnets {
-		b4nnArgs = append(b4nnArgs, fmt.Sprintf("--ignore=%s", subnet))
+// startHandler starts bypass4netns handling the containers unless it is running.
+// d.lock must be held.
+func (d *Driver) startHandler() error {
+	if d.handler != nil && !d.handler.exited() {
+		return nil
 	}
+	if d.handler != nil {
+		logrus.Warnf("bypass4netns pid=%d exited. the containers started before are not handled", d.handler.cmd.Process.Pid)
+		d.handler = nil
+	}
+	b4nnArgs := []string{}
 
-	if spec.IgnoreBind {
-		b4nnArgs = append(b4nnArgs, "--ignore-bind")
+	if logrus.GetLevel() == logrus.DebugLevel {
+		b4nnArgs = append(b4nnArgs, "--debug")
 	}
 
+	b4nnArgs = append(b4nnArgs, fmt.Sprintf("--socket=%s", d.HandlerSocketPath))
+	b4nnArgs = append(b4nnArgs, fmt.Sprintf("--api-socket=%s", d.HandlerAPISocketPath))
 	b4nnArgs = append(b4nnArgs, fmt.Sprintf("--com-socket=%s", d.ComSocketPath))
 	if d.HandleC2CEnable {
 		b4nnArgs = append(b4nnArgs, "--handle-c2c-connections")
@@ -108,7 +201,7 @@ func (d *Driver) StartBypass(spec *api.BypassSpec) (*api.BypassStatus, error) {
 	// prepare pipe for ready notification
 	readyR, readyW, err := os.Pipe()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer readyR.Close()
 	defer readyW.Close()
@@ -117,78 +210,66 @@ func (d *Driver) StartBypass(spec *api.BypassSpec) (*api.BypassStatus, error) {
 	readyFdOption := "--ready-fd=3"
 	b4nnArgs = append(b4nnArgs, readyFdOption)
 
-	logger.Infof("bypass4netns args:%v", b4nnArgs)
+	logrus.Infof("bypass4netns args:%v", b4nnArgs)
 	b4nnCmd := exec.Command(d.BypassExecutablePath, b4nnArgs...)
+	b4nnCmd.Stdout = os.Stderr
+	b4nnCmd.Stderr = os.Stderr
 	b4nnCmd.ExtraFiles = append(b4nnCmd.ExtraFiles, readyW)
 	err = b4nnCmd.Start()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	err = waitForReadyFD(b4nnCmd.Process.Pid, readyR)
 	if err != nil {
-		return nil, err
-	}
-	logger.Info("bypass4netns successfully started")
-
-	d.lock.Lock()
-	defer d.lock.Unlock()
-	status := api.BypassStatus{
-		ID:   spec.ID,
-		Pid:  b4nnCmd.Process.Pid,
-		Spec: *spec,
-	}
-
-	d.bypass[status.ID] = status
-	logger.Info("Started bypass")
-
-	return &status, nil
-}
-
-func (d *Driver) StopBypass(id string) error {
-	logger := logrus.WithFields(logrus.Fields{"ID": util.ShrinkID(id)})
-	logger.Infof("Stopping bypass")
-	d.lock.Lock()
-	defer d.lock.Unlock()
-
-	bStatus, ok := d.bypass[id]
-	if !ok {
-		return fmt.Errorf("child %s not found", id)
-	}
-
-	proc, err := os.FindProcess(bStatus.Pid)
-	if err != nil {
+		_ = b4nnCmd.Process.Kill()
+		_ = b4nnCmd.Wait()
 		return err
 	}
-	logger.Debugf("bypass4netns found pid=%d", proc.Pid)
-
-	logger.Infof("Terminating bypass4netns pid=%d", proc.Pid)
-	err = proc.Signal(unix.SIGTERM)
+	// the API is served before the seccomp fds are received
+	client, err := handlerapi.NewClient(d.HandlerAPISocketPath)
 	if err != nil {
+		_ = b4nnCmd.Process.Kill()
+		_ = b4nnCmd.Wait()
 		return err
 	}
-
-	// wait for the process exit
-	// TODO: Timeout
-	if _, err := proc.Wait(); err != nil {
-		logrus.Warnf("Failed to terminate bypass4netns pid=%d with SIGTERM, killing...", proc.Pid)
-		err = proc.Kill()
-		if err != nil {
-			return err
-		}
-		_, _ = proc.Wait()
+	p := &handlerProcess{
+		cmd:    b4nnCmd,
+		client: client,
+		done:   make(chan struct{}),
 	}
-	logger.Infof("Terminated bypass4netns pid=%d", proc.Pid)
-
-	delete(d.bypass, id)
-	logger.Info("Stopped bypass")
-
-	// remove the container's interfaces
-	d.DeleteInterface(id)
-
+	go func() {
+		_ = b4nnCmd.Wait()
+		close(p.done)
+	}()
+	d.handler = p
+	logrus.Infof("bypass4netns successfully started pid=%d", b4nnCmd.Process.Pid)
 	return nil
 }
 
+// stopHandlerIfUnused terminates bypass4netns when no container is handled.
+// d.lock must be held.
+func (d *Driver) stopHandlerIfUnused() {
+	if d.handler == nil || len(d.bypass) > 0 {
+		return
+	}
+	p := d.handler
+	d.handler = nil
+	pid := p.cmd.Process.Pid
+	logrus.Infof("Terminating bypass4netns pid=%d", pid)
+	if err := p.cmd.Process.Signal(unix.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		logrus.WithError(err).Warnf("failed to terminate bypass4netns pid=%d", pid)
+	}
+	select {
+	case <-p.done:
+	case <-time.After(handlerStopTimeout):
+		logrus.Warnf("Failed to terminate bypass4netns pid=%d with SIGTERM, killing...", pid)
+		_ = p.cmd.Process.Kill()
+		<-p.done
+	}
+	logrus.Infof("Terminated bypass4netns pid=%d", pid)
+}
+
 func (d *Driver) ListInterfaces() map[string]com.ContainerInterfaces {
 	d.interfacesLock.RLock()
 	defer d.interfacesLock.RUnlock()
@@ -228,6 +309,57 @@ func (d *Driver) DeleteInterface(id string) {
 	delete(d.containerInterfaces, id)
 }
 
+func (d *Driver) ListConnections(destPort int) []com.ContainerConnection {
+	d.connectionsLock.RLock()
+	defer d.connectionsLock.RUnlock()
+
+	res := []com.ContainerConnection{}
+	for _, v := range d.connections {
+		if destPort == 0 || v.DestinationPort == destPort {
+			res = append(res, v)
+		}
+	}
+
+	return res
+}
+
+func (d *Driver) GetConnection(hostAddr string) *com.ContainerConnection {
+	d.connectionsLock.RLock()
+	defer d.connectionsLock.RUnlock()
+
+	conn, ok := d.connections[hostAddr]
+	if !ok {
+		return nil
+	}
+
+	return &conn
+}
+
+func (d *Driver) PostConnection(conn *com.ContainerConnection) {
+	d.connectionsLock.Lock()
+	defer d.connectionsLock.Unlock()
+
+	d.connections[conn.HostAddress] = *conn
+}
+
+func (d *Driver) DeleteConnection(hostAddr string) {
+	d.connectionsLock.Lock()
+	defer d.connectionsLock.Unlock()
+
+	delete(d.connections, hostAddr)
+}
+
+func (d *Driver) deleteConnectionsOf(id string) {
+	d.connectionsLock.Lock()
+	defer d.connectionsLock.Unlock()
+
+	for k, v := range d.connections {
+		if v.ContainerID == id {
+			delete(d.connections, k)
+		}
+	}
+}
+
 // waitForReady is from libpod
 // https://github.com/containers/libpod/blob/e6b843312b93ddaf99d0ef94a7e60ff66bc0eac8/libpod/networking_linux.go#L272-L308
 func waitForReadyFD(cmdPid int, r *os.File) error {
@@ -3,21 +3,267 @@ package oci
 import (
 	"fmt"
 	"reflect"
+	"runtime"
+	"strings"
 
 	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
 )
 
 const (
 	SocketName = "bypass4netns.sock"
 )
 
-var SyscallsToBeNotified = []string{"bind", "close", "connect", "setsockopt", "fcntl", "_exit", "exit_group", "getpeername"}
+var SyscallsToBeNotified = []string{"bind", "close", "connect", "setsockopt", "fcntl", "fcntl64", "getpeername", "sendto", "sendmsg", "accept", "accept4", "getsockname", "dup2", "dup3", "execve", "execveat", "close_range", "socketcall"}
+
+// Options are the options of the seccomp profile for bypass4netns.
+type Options struct {
+	// NotifySendmsg notifies every sendmsg(2) to bypass datagram sockets.
+	// sendmsg(2) cannot be filtered by its destination, so only sendmsg(2) with MSG_FASTOPEN is notified by default.
+	NotifySendmsg bool
+}
+
+// ListenerMetadataNotifySendmsg is added to the listener metadata when every sendmsg(2) is notified.
+// Datagram sockets are bypassed only with it, because sendmsg(2) on the host socket is not checked otherwise.
+const ListenerMetadataNotifySendmsg = "notify-sendmsg=true"
+
+// syscallsNotifiedIfAllowed are notified only when the existing profile allows them,
+// not to allow them via the notifier when the profile denies them.
+// fork(2) is notified to take the snapshot of the sockets inherited by the child process.
+var syscallsNotifiedIfAllowed = []string{"io_uring_setup", "io_uring_register", "fork", "vfork", "clone3"}
+
+// argFilteredSyscall is notified only when one of the conditions on its arguments matches,
+// so that the kernel does not notify the calls which bypass4netns does not handle.
+type argFilteredSyscall struct {
+	name string
+	// notified are the conditions to be notified.
+	notified []specs.LinuxSeccompArg
+	// allowed are the conditions not to be notified. They must cover the rest of notified.
+	allowed []specs.LinuxSeccompArg
+}
+
+var fcntlNotified = []specs.LinuxSeccompArg{
+	{Index: 1, Value: unix.F_SETFD, Op: specs.OpEqualTo},
+	{Index: 1, Value: unix.F_SETFL, Op: specs.OpEqualTo},
+}
+
+// F_SETFD (2) < F_GETFL (3) < F_SETFL (4)
+var fcntlAllowed = []specs.LinuxSeccompArg{
+	{Index: 1, Value: unix.F_SETFD, Op: specs.OpLessThan},
+	{Index: 1, Value: unix.F_GETFL, Op: specs.OpEqualTo},
+	{Index: 1, Value: unix.F_SETFL, Op: specs.OpGreaterThan},
+}
+
+// argFilteredSyscalls are the syscalls in SyscallsToBeNotified filtered by their arguments.
+// libseccomp allows one comparison for each argument in a rule, so each condition is a separate rule.
+var argFilteredSyscalls = []argFilteredSyscall{
+	{
+		// send(2) is also implemented with sendto(2) and its destination is always NULL.
+		name: "sendto",
+		notified: []specs.LinuxSeccompArg{
+			{Index: 4, Value: 0, Op: specs.OpNotEqual},
+		},
+		allowed: []specs.LinuxSeccompArg{
+			{Index: 4, Value: 0, Op: specs.OpEqualTo},
+		},
+	},
+	{
+		// only F_SETFD and F_SETFL are recorded.
+		// fds duplicated with F_DUPFD and F_DUPFD_CLOEXEC are detected when they are used.
+		name:     "fcntl",
+		notified: fcntlNotified,
+		allowed:  fcntlAllowed,
+	},
+	{
+		// fcntl(2) is implemented with fcntl64(2) on some 32-bit architectures (e.g. i386).
+		name:     "fcntl64",
+		notified: fcntlNotified,
+		allowed:  fcntlAllowed,
+	},
+	{
+		// socket syscalls are multiplexed with socketcall(2) on some 32-bit architectures (e.g. i386).
+		// only the call is filtered because the other arguments are in the memory.
+		name:     "socketcall",
+		notified: socketcallArgs(true),
+		allowed:  socketcallArgs(false),
+	},
+}
+
+// sendmsgWithFastopen notifies sendmsg(2) only with MSG_FASTOPEN, unless Options.NotifySendmsg is set.
+var sendmsgWithFastopen = argFilteredSyscall{
+	name: "sendmsg",
+	notified: []specs.LinuxSeccompArg{
+		{Index: 2, Value: unix.MSG_FASTOPEN, ValueTwo: unix.MSG_FASTOPEN, Op: specs.OpMaskedEqual},
+	},
+	allowed: []specs.LinuxSeccompArg{
+		{Index: 2, Value: unix.MSG_FASTOPEN, ValueTwo: 0, Op: specs.OpMaskedEqual},
+	},
+}
+
+// argFilteredSyscallsFor returns argFilteredSyscalls for the options.
+func argFilteredSyscallsFor(opts Options) []argFilteredSyscall {
+	if opts.NotifySendmsg {
+		return argFilteredSyscalls
+	}
+	return append(append([]argFilteredSyscall{}, argFilteredSyscalls...), sendmsgWithFastopen)
+}
+
+// socketcallsNotified are the calls of socketcall(2) handled by bypass4netns.
+// SYS_BIND, SYS_CONNECT, SYS_ACCEPT, SYS_GETSOCKNAME, SYS_GETPEERNAME, SYS_SENDTO, SYS_SETSOCKOPT, SYS_SENDMSG and SYS_ACCEPT4.
+// SYS_SOCKET is not notified not to override the existing conditional rules for socket(2).
+var socketcallsNotified = []uint64{2, 3, 5, 6, 7, 11, 14, 16, 18}
+
+// socketcallMax is the largest call of socketcall(2) (SYS_SENDMMSG).
+const socketcallMax = 20
+
+// socketcallArgs returns the conditions of socketcall(2) to be notified, or not to be notified.
+func socketcallArgs(notified bool) []specs.LinuxSeccompArg {
+	args := []specs.LinuxSeccompArg{}
+	if !notified {
+		args = append(args, specs.LinuxSeccompArg{Index: 0, Value: 1, Op: specs.OpLessThan})
+	}
+	for call := uint64(1); call <= socketcallMax; call++ {
+		isNotified := false
+		for _, c := range socketcallsNotified {
+			isNotified = isNotified || c == call
+		}
+		if isNotified == notified {
+			args = append(args, specs.LinuxSeccompArg{Index: 0, Value: call, Op: specs.OpEqualTo})
+		}
+	}
+	if !notified {
+		args = append(args, specs.LinuxSeccompArg{Index: 0, Value: socketcallMax, Op: specs.OpGreaterThan})
+	}
+	return args
+}
+
+// argFilteredSyscallsIfAllowed are filtered by their arguments and notified only when the existing profile
+// allows them unconditionally, not to override the existing conditional rules for them.
+// When socket(2) is not notified, bypass4netns retrieves the new sockets from the processes with pidfd_getfd(2).
+var argFilteredSyscallsIfAllowed = []argFilteredSyscall{
+	{
+		// only IP sockets are recorded. the other fds are classified without notifications.
+		name: "socket",
+		notified: []specs.LinuxSeccompArg{
+			{Index: 0, Value: unix.AF_INET, Op: specs.OpEqualTo},
+			{Index: 0, Value: unix.AF_INET6, Op: specs.OpEqualTo},
+		},
+		allowed: otherSocketDomains(),
+	},
+	{
+		// threads share the sockets with the process. the flags are the first argument except on s390.
+		name: "clone",
+		notified: []specs.LinuxSeccompArg{
+			{Index: 0, Value: unix.CLONE_THREAD, ValueTwo: 0, Op: specs.OpMaskedEqual},
+		},
+		allowed: []specs.LinuxSeccompArg{
+			{Index: 0, Value: unix.CLONE_THREAD, ValueTwo: unix.CLONE_THREAD, Op: specs.OpMaskedEqual},
+		},
+	},
+}
+
+// otherSocketDomains returns the conditions of socket(2) for the domains except AF_INET and AF_INET6.
+// AF_INET (2) < AF_INET6 (10)
+func otherSocketDomains() []specs.LinuxSeccompArg {
+	args := []specs.LinuxSeccompArg{
+		{Index: 0, Value: unix.AF_INET, Op: specs.OpLessThan},
+	}
+	for domain := uint64(unix.AF_INET + 1); domain < unix.AF_INET6; domain++ {
+		args = append(args, specs.LinuxSeccompArg{Index: 0, Value: domain, Op: specs.OpEqualTo})
+	}
+	return append(args, specs.LinuxSeccompArg{Index: 0, Value: unix.AF_INET6, Op: specs.OpGreaterThan})
+}
+
+// notifyRules returns the rules to notify the syscall.
+func (f argFilteredSyscall) notifyRules() []specs.LinuxSyscall {
+	return f.rules(specs.ActNotify, f.notified)
+}
+
+// allowRules returns the rules to allow the syscall when it is not notified.
+func (f argFilteredSyscall) allowRules() []specs.LinuxSyscall {
+	return f.rules(specs.ActAllow, f.allowed)
+}
+
+func (f argFilteredSyscall) rules(action specs.LinuxSeccompAction, args []specs.LinuxSeccompArg) []specs.LinuxSyscall {
+	rules := []specs.LinuxSyscall{}
+	for _, arg := range args {
+		rules = append(rules, specs.LinuxSyscall{
+			Names:  []string{f.name},
+			Action: action,
+			Args:   []specs.LinuxSeccompArg{arg},
+		})
+	}
+	return rules
+}
+
+func argFilteredSyscallNames(opts Options) []string {
+	names := []string{}
+	for _, f := range argFilteredSyscallsFor(opts) {
+		names = append(names, f.name)
+	}
+	return names
+}
+
+// notifyRules returns the rules to be prepended to the seccomp profile.
+func notifyRules(opts Options) []specs.LinuxSyscall {
+	rules := []specs.LinuxSyscall{
+		{
+			Names:  filterStringSlice(SyscallsToBeNotified, argFilteredSyscallNames(opts)),
+			Action: specs.ActNotify,
+		},
+	}
+	for _, f := range argFilteredSyscallsFor(opts) {
+		rules = append(rules, f.notifyRules()...)
+	}
+	return rules
+}
+
+// allowRules allows argFilteredSyscalls and argFilteredSyscallsIfAllowed when they are not notified.
+// libseccomp prefers an unconditional rule to conditional ones for the same syscall,
+// so the existing rules for them are replaced with these rules.
+func allowRules(names []string, opts Options) []specs.LinuxSyscall {
+	rules := []specs.LinuxSyscall{}
+	for _, f := range append(argFilteredSyscallsFor(opts), argFilteredSyscallsIfAllowed...) {
+		if !containsString(names, f.name) {
+			continue
+		}
+		rules = append(rules, f.allowRules()...)
+	}
+	return rules
+}
+
+// architectures are the seccomp architectures of the native and the compat ABIs for GOARCH.
+var architectures = map[string][]specs.Arch{
+	"386":      {specs.ArchX86},
+	"amd64":    {specs.ArchX86_64, specs.ArchX86, specs.ArchX32},
+	"arm":      {specs.ArchARM},
+	"arm64":    {specs.ArchAARCH64, specs.ArchARM},
+	"mips":     {specs.ArchMIPS},
+	"mipsle":   {specs.ArchMIPSEL},
+	"mips64":   {specs.ArchMIPS64, specs.ArchMIPS64N32, specs.ArchMIPS},
+	"mips64le": {specs.ArchMIPSEL64, specs.ArchMIPSEL64N32, specs.ArchMIPSEL},
+	"ppc64":    {specs.ArchPPC64, specs.ArchPPC},
+	"ppc64le":  {specs.ArchPPC64LE},
+	"riscv64":  {specs.ArchRISCV64},
+	"s390x":    {specs.ArchS390X, specs.ArchS390},
+}
+
+// nativeArchitectures returns the seccomp architectures for GOARCH.
+// nil is returned for unknown GOARCH and the runtime uses the native architecture.
+func nativeArchitectures(goarch string) []specs.Arch {
+	return architectures[goarch]
+}
 
 func GetDefaultSeccompProfile(listenerPath string) *specs.LinuxSeccomp {
+	return GetDefaultSeccompProfileWithOptions(listenerPath, Options{})
+}
+
+func GetDefaultSeccompProfileWithOptions(listenerPath string, opts Options) *specs.LinuxSeccomp {
 	tmpl := specs.LinuxSeccomp{
 		DefaultAction: specs.ActAllow,
+		Architectures: nativeArchitectures(runtime.GOARCH),
 	}
-	seccomp, err := TranslateSeccompProfile(tmpl, listenerPath)
+	seccomp, err := TranslateSeccompProfileWithOptions(tmpl, listenerPath, opts)
 	if err != nil {
 		panic(err)
 	}
@@ -25,25 +271,83 @@ func GetDefaultSeccompProfile(listenerPath string) *specs.LinuxSeccomp {
 }
 
 func TranslateSeccompProfile(old specs.LinuxSeccomp, listenerPath string) (*specs.LinuxSeccomp, error) {
+	return TranslateSeccompProfileWithOptions(old, listenerPath, Options{})
+}
+
+func TranslateSeccompProfileWithOptions(old specs.LinuxSeccomp, listenerPath string, opts Options) (*specs.LinuxSeccomp, error) {
 	sc := old
 	if sc.ListenerPath != "" && sc.ListenerPath != listenerPath {
 		return nil, fmt.Errorf("bypass4netns's seccomp listener path %q conflicts with the existing seccomp listener path %q", listenerPath, sc.ListenerPath)
 	}
 	sc.ListenerPath = listenerPath
-	prepend := specs.LinuxSyscall{
-		Names:  SyscallsToBeNotified,
-		Action: specs.ActNotify,
-	}
-	if alreadyPrepended := len(sc.Syscalls) > 0 && reflect.DeepEqual(sc.Syscalls[0], prepend); !alreadyPrepended {
+	prepend := notifyRules(opts)
+	if alreadyPrepended := len(sc.Syscalls) >= len(prepend) && reflect.DeepEqual(sc.Syscalls[:len(prepend)], prepend); !alreadyPrepended {
+		notifiedIfAllowed := []string{}
+		for _, name := range syscallsNotifiedIfAllowed {
+			if isAllowed(old, name) {
+				notifiedIfAllowed = append(notifiedIfAllowed, name)
+			}
+		}
+		if len(notifiedIfAllowed) > 0 {
+			prepend = append(prepend, specs.LinuxSyscall{
+				Names:  notifiedIfAllowed,
+				Action: specs.ActNotify,
+			})
+		}
+		argFiltered := argFilteredSyscallNames(opts)
+		for _, f := range argFilteredSyscallsIfAllowed {
+			if isAllowed(old, f.name) && !hasConditionalRule(old, f.name) {
+				prepend = append(prepend, f.notifyRules()...)
+				argFiltered = append(argFiltered, f.name)
+				notifiedIfAllowed = append(notifiedIfAllowed, f.name)
+			}
+		}
+
+		allowed := []string{}
 		for i := range sc.Syscalls {
 			i := i
+			if sc.Syscalls[i].Action == specs.ActAllow {
+				for _, name := range argFiltered {
+					if containsString(sc.Syscalls[i].Names, name) && !containsString(allowed, name) {
+						allowed = append(allowed, name)
+					}
+				}
+			}
 			sc.Syscalls[i].Names = filterStringSlice(sc.Syscalls[i].Names, SyscallsToBeNotified)
+			sc.Syscalls[i].Names = filterStringSlice(sc.Syscalls[i].Names, notifiedIfAllowed)
+		}
+		prepend = append(prepend, allowRules(allowed, opts)...)
+		sc.Syscalls = append(prepend, sc.Syscalls...)
+		if opts.NotifySendmsg && !strings.Contains(sc.ListenerMetadata, ListenerMetadataNotifySendmsg) {
+			if sc.ListenerMetadata != "" {
+				sc.ListenerMetadata += ";"
+			}
+			sc.ListenerMetadata += ListenerMetadataNotifySendmsg
 		}
-		sc.Syscalls = append([]specs.LinuxSyscall{prepend}, sc.Syscalls...)
 	}
 	return &sc, nil
 }
 
+// isAllowed checks whether the syscall is allowed unconditionally by the profile.
+func isAllowed(sc specs.LinuxSeccomp, name string) bool {
+	for _, rule := range sc.Syscalls {
+		if len(rule.Args) == 0 && containsString(rule.Names, name) {
+			return rule.Action == specs.ActAllow
+		}
+	}
+	return sc.DefaultAction == specs.ActAllow
+}
+
+// hasConditionalRule checks whether the profile has a rule with conditions on the arguments for the syscall.
+func hasConditionalRule(sc specs.LinuxSeccomp, name string) bool {
+	for _, rule := range sc.Syscalls {
+		if len(rule.Args) > 0 && containsString(rule.Names, name) {
+			return true
+		}
+	}
+	return false
+}
+
 func filterStringSlice(ss, banned []string) []string {
 	bannedM := make(map[string]struct{}, len(banned))
 	for _, f := range banned {
@@ -57,3 +361,12 @@ func filterStringSlice(ss, banned []string) []string {
 	}
 	return res
 }
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,287 @@
+package oci
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestTranslateSeccompProfile(t *testing.T) {
+	old := specs.LinuxSeccomp{
+		DefaultAction: specs.ActErrno,
+		Syscalls: []specs.LinuxSyscall{
+			{
+				Names:  []string{"read", "sendto", "connect", "fcntl"},
+				Action: specs.ActAllow,
+			},
+		},
+	}
+
+	sc, err := TranslateSeccompProfile(old, "/run/bypass4netns.sock")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/run/bypass4netns.sock", sc.ListenerPath)
+	n := len(notifyRules(Options{}))
+	assert.Equal(t, n+5, len(sc.Syscalls))
+
+	assert.Equal(t, specs.ActNotify, sc.Syscalls[0].Action)
+	assert.Contains(t, sc.Syscalls[0].Names, "connect")
+	assert.NotContains(t, sc.Syscalls[0].Names, "sendto")
+	assert.NotContains(t, sc.Syscalls[0].Names, "fcntl")
+	assert.NotContains(t, sc.Syscalls[0].Names, "fcntl64")
+
+	assert.Equal(t, specs.ActNotify, sc.Syscalls[1].Action)
+	assert.Equal(t, []string{"sendto"}, sc.Syscalls[1].Names)
+	assert.Equal(t, specs.OpNotEqual, sc.Syscalls[1].Args[0].Op)
+
+	// fcntl is notified only for F_SETFD and F_SETFL
+	assert.Equal(t, specs.ActNotify, sc.Syscalls[2].Action)
+	assert.Equal(t, []string{"fcntl"}, sc.Syscalls[2].Names)
+	assert.Equal(t, specs.LinuxSeccompArg{Index: 1, Value: 2, Op: specs.OpEqualTo}, sc.Syscalls[2].Args[0])
+	assert.Equal(t, specs.LinuxSeccompArg{Index: 1, Value: 4, Op: specs.OpEqualTo}, sc.Syscalls[3].Args[0])
+	assert.Equal(t, []string{"fcntl64"}, sc.Syscalls[4].Names)
+	assert.Equal(t, sc.Syscalls[2].Args, sc.Syscalls[4].Args)
+	assert.Equal(t, sc.Syscalls[3].Args, sc.Syscalls[5].Args)
+
+	// socketcall(2) is notified only for the handled calls
+	for _, rule := range sc.Syscalls[6 : n-1] {
+		assert.Equal(t, specs.ActNotify, rule.Action)
+		assert.Equal(t, []string{"socketcall"}, rule.Names)
+		assert.NotEqual(t, uint64(1), rule.Args[0].Value)
+	}
+	assert.Equal(t, []string{"sendmsg"}, sc.Syscalls[n-1].Names)
+
+	// send(2) must be still allowed
+	assert.Equal(t, specs.ActAllow, sc.Syscalls[n].Action)
+	assert.Equal(t, []string{"sendto"}, sc.Syscalls[n].Names)
+	assert.Equal(t, specs.OpEqualTo, sc.Syscalls[n].Args[0].Op)
+
+	// the other fcntl commands must be still allowed
+	for i, op := range []specs.LinuxSeccompOperator{specs.OpLessThan, specs.OpEqualTo, specs.OpGreaterThan} {
+		assert.Equal(t, specs.ActAllow, sc.Syscalls[n+1+i].Action)
+		assert.Equal(t, []string{"fcntl"}, sc.Syscalls[n+1+i].Names)
+		assert.Equal(t, op, sc.Syscalls[n+1+i].Args[0].Op)
+	}
+
+	assert.Equal(t, []string{"read"}, sc.Syscalls[n+4].Names)
+
+	// translating twice does not prepend the rules again
+	sc2, err := TranslateSeccompProfile(*sc, "/run/bypass4netns.sock")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(sc.Syscalls), len(sc2.Syscalls))
+
+	_, err = TranslateSeccompProfile(*sc, "/run/other.sock")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestTranslateSeccompProfileSendmsg(t *testing.T) {
+	old := specs.LinuxSeccomp{
+		DefaultAction:    specs.ActErrno,
+		ListenerMetadata: "publish=8080:80",
+		Syscalls: []specs.LinuxSyscall{
+			{
+				Names:  []string{"sendmsg"},
+				Action: specs.ActAllow,
+			},
+		},
+	}
+	// sendmsg(2) is notified only with MSG_FASTOPEN by default
+	sc, err := TranslateSeccompProfile(old, "/run/bypass4netns.sock")
+	assert.Equal(t, nil, err)
+	assert.NotContains(t, sc.Syscalls[0].Names, "sendmsg")
+	rules := map[specs.LinuxSeccompAction][]specs.LinuxSeccompArg{}
+	for _, rule := range sc.Syscalls {
+		if containsString(rule.Names, "sendmsg") {
+			rules[rule.Action] = append(rules[rule.Action], rule.Args...)
+		}
+	}
+	assert.Equal(t, []specs.LinuxSeccompArg{{Index: 2, Value: 0x20000000, ValueTwo: 0x20000000, Op: specs.OpMaskedEqual}}, rules[specs.ActNotify])
+	assert.Equal(t, []specs.LinuxSeccompArg{{Index: 2, Value: 0x20000000, ValueTwo: 0, Op: specs.OpMaskedEqual}}, rules[specs.ActAllow])
+	assert.Equal(t, "publish=8080:80", sc.ListenerMetadata)
+
+	sc, err = TranslateSeccompProfileWithOptions(old, "/run/bypass4netns.sock", Options{NotifySendmsg: true})
+	assert.Equal(t, nil, err)
+	assert.Contains(t, sc.Syscalls[0].Names, "sendmsg")
+	for _, rule := range sc.Syscalls[1:] {
+		assert.NotContains(t, rule.Names, "sendmsg")
+	}
+	assert.Equal(t, "publish=8080:80;notify-sendmsg=true", sc.ListenerMetadata)
+
+	// translating twice does not add the metadata again
+	sc2, err := TranslateSeccompProfileWithOptions(*sc, "/run/bypass4netns.sock", Options{NotifySendmsg: true})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, sc.ListenerMetadata, sc2.ListenerMetadata)
+}
+
+func TestTranslateSeccompProfileIOUring(t *testing.T) {
+	// io_uring is notified when it is allowed
+	n := len(notifyRules(Options{}))
+	sc := GetDefaultSeccompProfile("/run/bypass4netns.sock")
+	assert.Equal(t, n+4, len(sc.Syscalls))
+	assert.Equal(t, specs.ActNotify, sc.Syscalls[n].Action)
+	assert.Equal(t, []string{"io_uring_setup", "io_uring_register", "fork", "vfork", "clone3"}, sc.Syscalls[n].Names)
+
+	old := specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+		Syscalls: []specs.LinuxSyscall{
+			{
+				Names:  []string{"io_uring_setup"},
+				Action: specs.ActErrno,
+			},
+		},
+	}
+	sc, err := TranslateSeccompProfile(old, "/run/bypass4netns.sock")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"io_uring_register", "fork", "vfork", "clone3"}, sc.Syscalls[n].Names)
+	// the denied syscall is kept denied
+	assert.Equal(t, specs.ActErrno, sc.Syscalls[n+4].Action)
+	assert.Equal(t, []string{"io_uring_setup"}, sc.Syscalls[n+4].Names)
+
+	// io_uring is not notified when it is denied by default
+	old = specs.LinuxSeccomp{
+		DefaultAction: specs.ActErrno,
+	}
+	sc, err = TranslateSeccompProfile(old, "/run/bypass4netns.sock")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, n, len(sc.Syscalls))
+}
+
+func TestTranslateSeccompProfileSocket(t *testing.T) {
+	old := specs.LinuxSeccomp{
+		DefaultAction: specs.ActErrno,
+		Syscalls: []specs.LinuxSyscall{
+			{
+				Names:  []string{"read", "socket"},
+				Action: specs.ActAllow,
+			},
+		},
+	}
+	sc, err := TranslateSeccompProfile(old, "/run/bypass4netns.sock")
+	assert.Equal(t, nil, err)
+	assert.NotContains(t, sc.Syscalls[len(sc.Syscalls)-1].Names, "socket")
+
+	// socket(2) is notified only for AF_INET and AF_INET6
+	notified := []uint64{}
+	allowed := map[uint64]bool{}
+	for _, rule := range sc.Syscalls {
+		if !containsString(rule.Names, "socket") {
+			continue
+		}
+		assert.Equal(t, 1, len(rule.Args))
+		switch rule.Action {
+		case specs.ActNotify:
+			assert.Equal(t, specs.OpEqualTo, rule.Args[0].Op)
+			notified = append(notified, rule.Args[0].Value)
+		case specs.ActAllow:
+			for domain := uint64(0); domain < 64; domain++ {
+				arg := rule.Args[0]
+				if (arg.Op == specs.OpLessThan && domain < arg.Value) || (arg.Op == specs.OpEqualTo && domain == arg.Value) || (arg.Op == specs.OpGreaterThan && domain > arg.Value) {
+					assert.False(t, allowed[domain])
+					allowed[domain] = true
+				}
+			}
+		}
+	}
+	assert.Equal(t, []uint64{2, 10}, notified)
+	for domain := uint64(0); domain < 64; domain++ {
+		assert.Equal(t, domain != 2 && domain != 10, allowed[domain], "domain %d", domain)
+	}
+
+	// the existing conditional rules are kept
+	old = specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+		Syscalls: []specs.LinuxSyscall{
+			{
+				Names:  []string{"socket"},
+				Action: specs.ActErrno,
+				Args: []specs.LinuxSeccompArg{
+					{Index: 0, Value: 40, Op: specs.OpEqualTo},
+				},
+			},
+		},
+	}
+	sc, err = TranslateSeccompProfile(old, "/run/bypass4netns.sock")
+	assert.Equal(t, nil, err)
+	last := sc.Syscalls[len(sc.Syscalls)-1]
+	assert.Equal(t, []string{"socket"}, last.Names)
+	assert.Equal(t, specs.ActErrno, last.Action)
+	for _, rule := range sc.Syscalls[:len(sc.Syscalls)-1] {
+		assert.NotContains(t, rule.Names, "socket")
+	}
+}
+
+func TestTranslateSeccompProfileClone(t *testing.T) {
+	old := specs.LinuxSeccomp{
+		DefaultAction: specs.ActErrno,
+		Syscalls: []specs.LinuxSyscall{
+			{
+				Names:  []string{"clone", "fork"},
+				Action: specs.ActAllow,
+			},
+		},
+	}
+	sc, err := TranslateSeccompProfile(old, "/run/bypass4netns.sock")
+	assert.Equal(t, nil, err)
+	// clone(2) is notified except for threads
+	rules := map[specs.LinuxSeccompAction][]specs.LinuxSeccompArg{}
+	for _, rule := range sc.Syscalls {
+		if containsString(rule.Names, "clone") {
+			assert.Equal(t, []string{"clone"}, rule.Names)
+			rules[rule.Action] = append(rules[rule.Action], rule.Args...)
+		}
+		if containsString(rule.Names, "fork") {
+			assert.Equal(t, specs.ActNotify, rule.Action)
+		}
+	}
+	assert.Equal(t, []specs.LinuxSeccompArg{{Index: 0, Value: unix.CLONE_THREAD, ValueTwo: 0, Op: specs.OpMaskedEqual}}, rules[specs.ActNotify])
+	assert.Equal(t, []specs.LinuxSeccompArg{{Index: 0, Value: unix.CLONE_THREAD, ValueTwo: unix.CLONE_THREAD, Op: specs.OpMaskedEqual}}, rules[specs.ActAllow])
+
+	// clone(2) restricted by the existing conditional rules is not notified
+	old = specs.LinuxSeccomp{
+		DefaultAction: specs.ActErrno,
+		Syscalls: []specs.LinuxSyscall{
+			{
+				Names:  []string{"clone"},
+				Action: specs.ActAllow,
+				Args: []specs.LinuxSeccompArg{
+					{Index: 0, Value: unix.CLONE_NEWNS, ValueTwo: 0, Op: specs.OpMaskedEqual},
+				},
+			},
+		},
+	}
+	sc, err = TranslateSeccompProfile(old, "/run/bypass4netns.sock")
+	assert.Equal(t, nil, err)
+	for _, rule := range sc.Syscalls {
+		if containsString(rule.Names, "clone") {
+			assert.Equal(t, old.Syscalls[0], rule)
+		}
+	}
+}
+
+func TestNativeArchitectures(t *testing.T) {
+	assert.Equal(t, []specs.Arch{specs.ArchX86_64, specs.ArchX86, specs.ArchX32}, nativeArchitectures("amd64"))
+	assert.Equal(t, []specs.Arch{specs.ArchAARCH64, specs.ArchARM}, nativeArchitectures("arm64"))
+	assert.Equal(t, []specs.Arch{specs.ArchS390X, specs.ArchS390}, nativeArchitectures("s390x"))
+	assert.Equal(t, 0, len(nativeArchitectures("wasm")))
+
+	sc := GetDefaultSeccompProfile("/run/bypass4netns.sock")
+	assert.Equal(t, nativeArchitectures(runtime.GOARCH), sc.Architectures)
+}
+
+func TestSocketcallArgs(t *testing.T) {
+	// every call is either notified or allowed
+	for call := uint64(0); call <= socketcallMax+1; call++ {
+		matched := 0
+		for _, args := range [][]specs.LinuxSeccompArg{socketcallArgs(true), socketcallArgs(false)} {
+			for _, arg := range args {
+				if (arg.Op == specs.OpLessThan && call < arg.Value) || (arg.Op == specs.OpEqualTo && call == arg.Value) || (arg.Op == specs.OpGreaterThan && call > arg.Value) {
+					matched++
+				}
+			}
+		}
+		assert.Equal(t, 1, matched, "call %d", call)
+	}
+	assert.Equal(t, len(socketcallsNotified), len(socketcallArgs(true)))
+}
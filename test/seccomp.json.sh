@@ -3,19 +3,32 @@
 # $ ./seccomp.json.sh >$HOME/seccomp.json
 # $ nerdctl run -it --rm --security-opt seccomp=$HOME/seccomp.json alpine
 
-# TODO: support non-x86
 # TODO: inherit the default seccomp profile (https://github.com/containerd/containerd/blob/v1.6.0-rc.1/contrib/seccomp/seccomp_default.go#L52)
 
 set -eu
+
+# the native and the compat architectures of the host
+case "$(uname -m)" in
+x86_64) ARCHITECTURES='"SCMP_ARCH_X86_64", "SCMP_ARCH_X86", "SCMP_ARCH_X32"' ;;
+aarch64) ARCHITECTURES='"SCMP_ARCH_AARCH64", "SCMP_ARCH_ARM"' ;;
+armv7l | armv6l) ARCHITECTURES='"SCMP_ARCH_ARM"' ;;
+s390x) ARCHITECTURES='"SCMP_ARCH_S390X", "SCMP_ARCH_S390"' ;;
+ppc64le) ARCHITECTURES='"SCMP_ARCH_PPC64LE"' ;;
+riscv64) ARCHITECTURES='"SCMP_ARCH_RISCV64"' ;;
+*)
+	echo >&2 "unsupported architecture: $(uname -m)"
+	exit 1
+	;;
+esac
+
 cat <<EOF
 {
   "defaultAction": "SCMP_ACT_ALLOW",
   "architectures": [
-    "SCMP_ARCH_X86_64",
-    "SCMP_ARCH_X86",
-    "SCMP_ARCH_X32"
+    ${ARCHITECTURES}
   ],
   "listenerPath": "${XDG_RUNTIME_DIR}/bypass4netns.sock",
+  "listenerMetadata": "notify-sendmsg=true",
   "syscalls": [
     {
       "names": [
@@ -23,10 +36,108 @@ cat <<EOF
         "close",
         "connect",
         "setsockopt",
+        "getpeername",
+        "sendmsg",
+        "accept",
+        "accept4",
+        "getsockname",
+        "dup2",
+        "dup3",
+        "execve",
+        "execveat",
+        "close_range",
+        "socketcall"
+      ],
+      "action": "SCMP_ACT_NOTIFY"
+    },
+    {
+      "names": [
+        "sendto"
+      ],
+      "action": "SCMP_ACT_NOTIFY",
+      "args": [
+        {
+          "index": 4,
+          "value": 0,
+          "op": "SCMP_CMP_NE"
+        }
+      ]
+    },
+    {
+      "names": [
+        "fcntl",
+        "fcntl64"
+      ],
+      "action": "SCMP_ACT_NOTIFY",
+      "args": [
+        {
+          "index": 1,
+          "value": 2,
+          "op": "SCMP_CMP_EQ"
+        }
+      ]
+    },
+    {
+      "names": [
         "fcntl",
-        "_exit",
-        "exit_group",
-        "getpeername"
+        "fcntl64"
+      ],
+      "action": "SCMP_ACT_NOTIFY",
+      "args": [
+        {
+          "index": 1,
+          "value": 4,
+          "op": "SCMP_CMP_EQ"
+        }
+      ]
+    },
+    {
+      "names": [
+        "socket"
+      ],
+      "action": "SCMP_ACT_NOTIFY",
+      "args": [
+        {
+          "index": 0,
+          "value": 2,
+          "op": "SCMP_CMP_EQ"
+        }
+      ]
+    },
+    {
+      "names": [
+        "socket"
+      ],
+      "action": "SCMP_ACT_NOTIFY",
+      "args": [
+        {
+          "index": 0,
+          "value": 10,
+          "op": "SCMP_CMP_EQ"
+        }
+      ]
+    },
+    {
+      "names": [
+        "clone"
+      ],
+      "action": "SCMP_ACT_NOTIFY",
+      "args": [
+        {
+          "index": 0,
+          "value": 65536,
+          "valueTwo": 0,
+          "op": "SCMP_CMP_MASKED_EQ"
+        }
+      ]
+    },
+    {
+      "names": [
+        "io_uring_setup",
+        "io_uring_register",
+        "fork",
+        "vfork",
+        "clone3"
       ],
       "action": "SCMP_ACT_NOTIFY"
     }